@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/MultiverseHQ/abci_proxy"
@@ -14,18 +16,68 @@ import (
 )
 
 var logger tmlog.Logger
+var logConfig *abciproxy.LogConfig
 var opts options
 
 func init() {
 	opts = ParseOptions()
 
-	baselogger := tmlog.NewTMLogger(tmlog.NewSyncWriter(os.Stderr))
+	var baselogger tmlog.Logger
+	switch opts.LogFormat {
+	case "plain":
+		baselogger = tmlog.NewTMLogger(tmlog.NewSyncWriter(os.Stderr))
+	case "json":
+		baselogger = tmlog.NewTMJSONLogger(tmlog.NewSyncWriter(os.Stderr))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown log format %q, expected plain or json\n", opts.LogFormat)
+		os.Exit(1)
+	}
 
+	var err error
+	logConfig, err = abciproxy.ParseLogConfig(opts.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if opts.Verbose == true {
+		logConfig.Default = abciproxy.LogDebug
+	}
+	logger = logConfig.Filter(baselogger)
 	if opts.Verbose == true {
-		logger = tmlog.NewFilter(baselogger, tmlog.AllowAll())
 		logger.Info("Debug output")
-	} else {
-		logger = tmlog.NewFilter(baselogger, tmlog.AllowInfo())
+	}
+}
+
+// connect connects to a target application, retrying until it is up
+func connect(address string) abcicli.Client {
+	client := abcicli.NewSocketClient(address, true)
+	logger.Info("Connecting to client target application", "address", address)
+
+	for {
+		if _, err := client.Start(); err != nil {
+			retryTime := 3 * time.Second
+			logger.Error("Got connection error", "error", err, "retry", retryTime.String())
+			time.Sleep(retryTime)
+			continue
+		}
+		break
+	}
+	return client
+}
+
+// connectAll opens the consensus, mempool and query connections to a
+// target application, retrying until it is up
+func connectAll(address string) abciproxy.Connections {
+	logger.Info("Connecting to client target application", "address", address)
+	for {
+		conns, err := abciproxy.NewSocketConnections(address)
+		if err != nil {
+			retryTime := 3 * time.Second
+			logger.Error("Got connection error", "error", err, "retry", retryTime.String())
+			time.Sleep(retryTime)
+			continue
+		}
+		return conns
 	}
 }
 
@@ -38,22 +90,135 @@ func Execute() error {
 	fmt.Printf("<3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3 <3\n")
 	fmt.Printf("\n")
 
-	next := abcicli.NewSocketClient(opts.AppAddress, true)
-	logger.Info("Connecting to client target application")
+	var next abciproxy.Connections
+	if len(opts.Fanout) != 0 {
+		configs, err := abciproxy.LoadDownstreamConfigs(opts.Fanout)
+		if err != nil {
+			return err
+		}
+		downstreams := make([]*abciproxy.Downstream, 0, len(configs))
+		for _, c := range configs {
+			downstreams = append(downstreams, &abciproxy.Downstream{
+				Name:        c.Name,
+				Conns:       connectAll(c.Address),
+				TxPrefix:    []byte(c.TxPrefix),
+				QueryPrefix: c.QueryPrefix,
+			})
+		}
+		mux, err := abciproxy.NewMultiplexApplication(downstreams)
+		if err != nil {
+			return err
+		}
+		if _, err := mux.CheckInfo(); err != nil {
+			return err
+		}
+		next = mux.Connections()
+	} else {
+		next = connectAll(opts.AppAddress)
+	}
 
-	for {
-		if _, err := next.Start(); err != nil {
-			retryTime := 3 * time.Second
-			logger.Error("Got connection error", "error", err, "retry", retryTime.String())
-			time.Sleep(retryTime)
+	proxy := abciproxy.NewProxyAppWithConnections(next, logger.With("module", "abci-proxy"))
+	proxy.ConfigureLogs(logConfig, "abci-proxy")
+	proxy.SetMinimumLead(opts.MinLead, opts.AutoBump)
+	for _, address := range strings.Split(opts.Peers, ",") {
+		address = strings.TrimSpace(address)
+		if len(address) == 0 {
 			continue
 		}
-		break
+		proxy.AddPeer(&abciproxy.Peer{Name: address, Client: abciproxy.NewRPCPeerClient(address)})
+	}
+	if opts.PeerCheckInterval > 0 {
+		proxy.EnablePeerCheck(opts.PeerCheckWindow)
+	}
+	if len(opts.Genesis) != 0 {
+		cfg, err := abciproxy.LoadGenesisConfig(opts.Genesis)
+		if err != nil {
+			return err
+		}
+		if err := proxy.SetGenesisConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if len(opts.KeyRegistry) != 0 {
+		if err := proxy.EnableKeyRegistry(opts.KeyRegistry); err != nil {
+			return err
+		}
+	}
+	if len(opts.DiffHistory) != 0 {
+		if err := proxy.EnableDiffHistory(opts.DiffHistory); err != nil {
+			return err
+		}
+	}
+	if len(opts.Approval) != 0 {
+		policy, err := abciproxy.LoadApprovalPolicy(opts.Approval)
+		if err != nil {
+			return err
+		}
+		if err := proxy.EnableApproval(policy); err != nil {
+			return err
+		}
+		logger.Info("Validator changes require approval", "threshold", policy.Threshold, "operators", len(policy.Operators))
+	}
+	if len(opts.Governance) != 0 {
+		// a restarted node forgetting the proposals would emit other
+		// diffs than the rest of the network
+		if len(opts.GovernanceState) == 0 {
+			return fmt.Errorf("Governance mode requires a file to persist its state in (-governance-state)")
+		}
+		policy, err := abciproxy.LoadApprovalPolicy(opts.Governance)
+		if err != nil {
+			return err
+		}
+		if err := proxy.EnableGovernance([]byte(opts.GovernancePrefix), policy); err != nil {
+			return err
+		}
+		if err := proxy.EnableGovernanceState(opts.GovernanceState); err != nil {
+			return err
+		}
+		logger.Info("Validator changes are decided on-chain", "prefix", opts.GovernancePrefix, "threshold", policy.Threshold)
+	}
+	if len(opts.ShadowAddress) != 0 {
+		proxy.EnableShadow(connect(opts.ShadowAddress))
+	}
+	var recorder *abciproxy.Recorder
+	if len(opts.Record) != 0 {
+		var err error
+		recorder, err = abciproxy.NewRecorder(opts.Record)
+		if err != nil {
+			return err
+		}
+		proxy.EnableRecording(recorder)
+	}
+	if opts.InfoMetadata == true {
+		proxy.EnableInfoMetadata()
+	}
+	if len(opts.TxFilters) != 0 {
+		filters, err := abciproxy.LoadTxFilters(opts.TxFilters)
+		if err != nil {
+			return err
+		}
+		for _, f := range filters {
+			proxy.AddTxFilter(f)
+		}
+	}
+	txHandlers := []struct {
+		prefix  string
+		handler abciproxy.TxHandler
+	}{
+		{opts.EchoPrefix, abciproxy.EchoTxHandler},
+		{opts.PingPrefix, abciproxy.PingTxHandler},
+		{opts.ControlPrefix, proxy.ControlTxHandler()},
+	}
+	for _, h := range txHandlers {
+		if len(h.prefix) == 0 {
+			continue
+		}
+		if err := proxy.RegisterTxHandler([]byte(h.prefix), h.handler); err != nil {
+			return err
+		}
 	}
-
-	proxy := abciproxy.NewProxyAppWithLogger(next, logger)
 	// Start the listener
-	srv, err := server.NewServer(opts.Address, opts.ABCIType, proxy)
+	srv, err := newServer(proxy)
 	if err != nil {
 		return err
 	}
@@ -63,18 +228,45 @@ func Execute() error {
 	}
 
 	proxy.StartRPCServer(opts.RPCAddress)
+	if opts.PeerCheckInterval > 0 {
+		proxy.StartPeerCheck(opts.PeerCheckInterval)
+	}
 
 	// Wait forever
 	cmn.TrapSignal(func() {
 		// Cleanup
 		srv.Stop()
+		if recorder != nil {
+			recorder.Close()
+		}
+		proxy.CloseDiffHistory()
 	})
 
 	return nil
 }
 
+// newServer pipelines CheckTx and DeliverTx on socket connections
+func newServer(proxy *abciproxy.ProxyApplication) (cmn.Service, error) {
+	if opts.ABCIType == "socket" {
+		return abciproxy.NewPipelinedServer(opts.Address, proxy), nil
+	}
+	return server.NewServer(opts.Address, opts.ABCIType, proxy)
+}
+
 func main() {
-	if err := Execute(); err != nil {
+	var err error
+	switch flag.Arg(0) {
+	case "replay":
+		err = Replay(flag.Args()[1:])
+	case "import-genesis":
+		err = ImportGenesis(flag.Args()[1:])
+	case "import-priv-validator":
+		err = ImportPrivValidator(flag.Args()[1:])
+	default:
+		err = Execute()
+	}
+	if err != nil {
 		logger.Error("unhandled error", "error", err)
+		os.Exit(1)
 	}
 }
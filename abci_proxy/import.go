@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/MultiverseHQ/abci_proxy"
+	"github.com/tendermint/tendermint/rpc/lib/client"
+)
+
+// importFlags are the flags shared by the import commands
+type importFlags struct {
+	fs              *flag.FlagSet
+	rpc             *string
+	file            *string
+	register        *bool
+	scheduledHeight *uint64
+}
+
+func newImportFlags(name string, file string) *importFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return &importFlags{
+		fs:              fs,
+		rpc:             fs.String("rpc", "http://127.0.0.1:46660", "RPC address of the proxy"),
+		file:            fs.String("file", "", file+" file to import"),
+		register:        fs.Bool("register", true, "register the names of the validators"),
+		scheduledHeight: fs.Uint64("height", 0, "height to schedule the validators at (not scheduled if 0)"),
+	}
+}
+
+// call sends the content of the imported file, as returned by filter,
+// as the fileParam of the proxy RPC method
+func (f *importFlags) call(method string, fileParam string, filter func([]byte) ([]byte, error), params map[string]interface{}) error {
+	if len(*f.file) == 0 {
+		return fmt.Errorf("%s requires a file to import (-file)", f.fs.Name())
+	}
+	content, err := ioutil.ReadFile(*f.file)
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		if content, err = filter(content); err != nil {
+			return err
+		}
+	}
+	params[fileParam] = string(content)
+	params["register"] = *f.register
+	params["scheduled_height"] = *f.scheduledHeight
+
+	res := &abciproxy.ImportValidatorsResult{}
+	if _, err := rpcclient.NewJSONRPCClient(*f.rpc).Call(method, params, res); err != nil {
+		return err
+	}
+	for _, v := range res.Validators {
+		fmt.Printf("%s %X power:%d\n", v.Name, v.PubKey.Bytes(), v.Power)
+	}
+	if res.Change != nil {
+		fmt.Printf("Scheduled change %d at height %d\n", res.Change.ID, res.Change.ScheduledHeight)
+	}
+	return nil
+}
+
+// ImportGenesis implements the import-genesis command: it registers or
+// schedules the validators of a genesis.json file on a running proxy.
+func ImportGenesis(args []string) error {
+	f := newImportFlags("import-genesis", "genesis.json")
+	f.fs.Parse(args)
+	return f.call("import_genesis", "genesis", nil, map[string]interface{}{})
+}
+
+// ImportPrivValidator implements the import-priv-validator command: it
+// registers or schedules the key of a priv_validator.json file on a
+// running proxy. Only the public part of the file is sent.
+func ImportPrivValidator(args []string) error {
+	f := newImportFlags("import-priv-validator", "priv_validator.json")
+	name := f.fs.String("name", "", "name to register the validator with")
+	power := f.fs.Uint64("power", 10, "voting power to schedule the validator with")
+	f.fs.Parse(args)
+	return f.call("import_priv_validator", "priv_validator", abciproxy.PrivValidatorPublicPart, map[string]interface{}{
+		"name":  *name,
+		"power": *power,
+	})
+}
@@ -1,6 +1,9 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 type options struct {
 	Address    string
@@ -8,6 +11,42 @@ type options struct {
 	AppAddress string
 	Verbose    bool
 	RPCAddress string
+	Approval   string
+
+	Governance       string
+	GovernancePrefix string
+	GovernanceState  string
+
+	EchoPrefix    string
+	PingPrefix    string
+	ControlPrefix string
+
+	TxFilters string
+
+	InfoMetadata bool
+
+	Fanout string
+
+	ShadowAddress string
+
+	Record string
+
+	DiffHistory string
+
+	Genesis string
+
+	KeyRegistry string
+
+	MinLead  uint64
+	AutoBump bool
+
+	Peers string
+
+	PeerCheckInterval time.Duration
+	PeerCheckWindow   uint64
+
+	LogLevel  string
+	LogFormat string
 }
 
 func ParseOptions() options {
@@ -17,6 +56,28 @@ func ParseOptions() options {
 	flag.StringVar(&opts.RPCAddress, "rpc", "tcp://0.0.0.0:46660", "listen address for rcp")
 	flag.StringVar(&opts.ABCIType, "abci", "socket", "socket | grpc")
 	flag.StringVar(&opts.AppAddress, "proxy", "tcp://0.0.0.0:46658", "Address of next ABCI app")
+	flag.StringVar(&opts.Approval, "approval", "", "JSON file with the operators required to approve validator changes")
+	flag.StringVar(&opts.Governance, "governance", "", "JSON file with the operators deciding validator changes on-chain")
+	flag.StringVar(&opts.GovernancePrefix, "governance-prefix", "proxy/gov:", "Prefix of the governance transactions")
+	flag.StringVar(&opts.GovernanceState, "governance-state", "", "File to persist the governance proposals in at every commit, to restore them after a restart (required with -governance)")
+	flag.StringVar(&opts.EchoPrefix, "echo-prefix", "", "Prefix of the transactions echoed by the proxy (disabled if empty)")
+	flag.StringVar(&opts.PingPrefix, "ping-prefix", "", "Prefix of the transactions answered pong by the proxy (disabled if empty)")
+	flag.StringVar(&opts.ControlPrefix, "control-prefix", "", "Prefix of the proxy control transactions (disabled if empty)")
+	flag.StringVar(&opts.TxFilters, "tx-filters", "", "JSON file with the CheckTx admission policy")
+	flag.BoolVar(&opts.InfoMetadata, "info-metadata", false, "add the proxy metadata to the Info response")
+	flag.StringVar(&opts.Fanout, "fanout", "", "JSON file with the downstream applications to multiplex (replaces -proxy)")
+	flag.StringVar(&opts.ShadowAddress, "shadow", "", "Address of an ABCI app to mirror consensus calls to, for comparison")
+	flag.StringVar(&opts.Record, "record", "", "File to record all calls to the target app in, for replay")
+	flag.StringVar(&opts.DiffHistory, "diff-history", "", "File to persist the emitted validator diffs in, to re-emit them on block replay after a crash")
+	flag.StringVar(&opts.Genesis, "genesis", "", "JSON file with the validators overriding or augmenting the genesis ones")
+	flag.StringVar(&opts.KeyRegistry, "key-registry", "", "JSON file with the names of the validator keys, edited through the RPC")
+	flag.Uint64Var(&opts.MinLead, "min-lead", 0, "Minimum number of blocks between the current height and a validator change")
+	flag.BoolVar(&opts.AutoBump, "auto-bump", false, "Move the validator changes scheduled before the minimum lead to the earliest allowed height")
+	flag.StringVar(&opts.Peers, "peers", "", "Comma separated RPC addresses of the peer proxies to broadcast validator changes to, like http://10.0.0.2:46660")
+	flag.DurationVar(&opts.PeerCheckInterval, "peer-check-interval", 0, "Interval between comparisons of the validator change schedule with the peers (disabled if 0)")
+	flag.Uint64Var(&opts.PeerCheckWindow, "peer-check-window", 100, "Number of upcoming heights of the schedule compared with the peers")
+	flag.StringVar(&opts.LogLevel, "log-level", "", "Log levels per ABCI method or module, like deliver_tx:none,end_block:info,abci-server:error,*:info")
+	flag.StringVar(&opts.LogFormat, "log-format", "plain", "plain | json")
 	flag.BoolVar(&opts.Verbose, "verbose", false, "verbose output")
 	flag.BoolVar(&opts.Verbose, "v", false, "verbose output")
 	flag.Parse()
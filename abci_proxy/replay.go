@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/MultiverseHQ/abci_proxy"
+	abcicli "github.com/tendermint/abci/client"
+)
+
+// Replay implements the replay command: it feeds a record log to an
+// ABCI application and reports the first divergence.
+func Replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	logPath := fs.String("log", "", "ABCI record log to replay")
+	address := fs.String("app", "tcp://0.0.0.0:46658", "Address of the ABCI app to replay into")
+	transport := fs.String("abci", "socket", "socket | grpc")
+	fs.Parse(args)
+
+	if len(*logPath) == 0 {
+		return fmt.Errorf("replay requires a record log (-log)")
+	}
+	f, err := os.Open(*logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rr, err := abciproxy.NewRecordReader(f)
+	if err != nil {
+		return err
+	}
+
+	client, err := abcicli.NewClient(*address, *transport, true)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Start(); err != nil {
+		return err
+	}
+	defer client.Stop()
+
+	report, err := abciproxy.Replay(rr, client)
+	if err != nil {
+		return err
+	}
+	if report.Divergence != nil {
+		return fmt.Errorf("%s", report.Divergence)
+	}
+	fmt.Printf("Replayed %d entries without divergence\n", report.Entries)
+	return nil
+}
@@ -0,0 +1,318 @@
+package abciproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+)
+
+// ProposalStatus is the state of a validator change proposal in the
+// approval workflow
+type ProposalStatus string
+
+const (
+	ProposalPending  ProposalStatus = "pending"
+	ProposalApproved ProposalStatus = "approved"
+	ProposalRejected ProposalStatus = "rejected"
+	ProposalExpired  ProposalStatus = "expired"
+	// approved, but the change could not be scheduled
+	ProposalFailed ProposalStatus = "failed"
+)
+
+// proposals are forgotten this long after their deadline
+const proposalHistory = 24 * time.Hour
+
+// ApprovalPolicy describes who can approve a validator change, and
+// how many of them are required (M-of-N)
+type ApprovalPolicy struct {
+	Operators []crypto.PubKey
+	Threshold int
+	Timeout   time.Duration
+}
+
+type approvalPolicyFile struct {
+	Operators []crypto.PubKey `json:"operators"`
+	Threshold int             `json:"threshold"`
+	Timeout   string          `json:"timeout"`
+}
+
+// LoadApprovalPolicy reads an approval policy from a JSON file of the form
+// {"operators": [<pub_key>...], "threshold": 2, "timeout": "1h"}
+func LoadApprovalPolicy(path string) (*ApprovalPolicy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f approvalPolicyFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("Could not parse approval policy %s: %s", path, err)
+	}
+	res := &ApprovalPolicy{
+		Operators: f.Operators,
+		Threshold: f.Threshold,
+	}
+	// on-chain governance does not use any timeout
+	if len(f.Timeout) != 0 {
+		res.Timeout, err = time.ParseDuration(f.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid approval timeout %q: %s", f.Timeout, err)
+		}
+	}
+	return res, nil
+}
+
+// Validate checks that the policy can actually be satisfied
+func (p *ApprovalPolicy) Validate() error {
+	if len(p.Operators) == 0 {
+		return fmt.Errorf("Approval policy requires at least one operator")
+	}
+	if p.Threshold <= 0 || p.Threshold > len(p.Operators) {
+		return fmt.Errorf("Invalid approval threshold %d for %d operators", p.Threshold, len(p.Operators))
+	}
+	return nil
+}
+
+func (p *ApprovalPolicy) isOperator(pubKey crypto.PubKey) bool {
+	for _, o := range p.Operators {
+		if o.Equals(pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatorChangeProposal is a validator change waiting for operators
+// signatures before being scheduled
+type ValidatorChangeProposal struct {
+	ID              uint64
+	Validators      []*types.Validator
+	ScheduledHeight uint64
+	Deadline        time.Time
+	Status          ProposalStatus
+	// signatures are indexed by the operator KeyString()
+	Signatures map[string]crypto.Signature
+}
+
+func (p *ValidatorChangeProposal) actionBytes(action string) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(action)
+	binary.Write(buf, binary.BigEndian, p.ID)
+	binary.Write(buf, binary.BigEndian, p.ScheduledHeight)
+	for _, v := range p.Validators {
+		binary.Write(buf, binary.BigEndian, uint32(len(v.PubKey)))
+		buf.Write(v.PubKey)
+		binary.Write(buf, binary.BigEndian, v.Power)
+	}
+	return buf.Bytes()
+}
+
+// SignBytes are the bytes an operator should sign to approve the proposal
+func (p *ValidatorChangeProposal) SignBytes() []byte {
+	return p.actionBytes("approve")
+}
+
+// RejectBytes are the bytes an operator should sign to reject the proposal
+func (p *ValidatorChangeProposal) RejectBytes() []byte {
+	return p.actionBytes("reject")
+}
+
+func (p *ValidatorChangeProposal) copy() *ValidatorChangeProposal {
+	res := *p
+	res.Signatures = make(map[string]crypto.Signature, len(p.Signatures))
+	for k, s := range p.Signatures {
+		res.Signatures[k] = s
+	}
+	return &res
+}
+
+// approvalBook holds all the proposals made to a proxy
+type approvalBook struct {
+	mtx       sync.Mutex
+	policy    *ApprovalPolicy
+	nextID    uint64
+	proposals map[uint64]*ValidatorChangeProposal
+	now       func() time.Time
+}
+
+func newApprovalBook(policy *ApprovalPolicy) *approvalBook {
+	return &approvalBook{
+		policy:    policy,
+		nextID:    1,
+		proposals: make(map[uint64]*ValidatorChangeProposal),
+		now:       time.Now,
+	}
+}
+
+// expire marks all pending proposals past their deadline, and forgets
+// the ones which ended long ago. Lock should be held.
+func (b *approvalBook) expire() {
+	now := b.now()
+	for id, p := range b.proposals {
+		if p.Status == ProposalPending && now.After(p.Deadline) {
+			p.Status = ProposalExpired
+		}
+		if now.After(p.Deadline.Add(proposalHistory)) {
+			delete(b.proposals, id)
+		}
+	}
+}
+
+// pendingProposal returns the proposal id if it still can be acted
+// upon. Lock should be held.
+func (b *approvalBook) pendingProposal(id uint64) (*ValidatorChangeProposal, error) {
+	b.expire()
+	p, ok := b.proposals[id]
+	if ok == false {
+		return nil, fmt.Errorf("Unknown validator change proposal %d", id)
+	}
+	if p.Status != ProposalPending {
+		return nil, fmt.Errorf("Validator change proposal %d is %s", id, p.Status)
+	}
+	return p, nil
+}
+
+// EnableApproval requires all validator changes to go through the
+// multi-signature approval workflow defined by policy.
+func (app *ProxyApplication) EnableApproval(policy *ApprovalPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if policy.Timeout <= 0 {
+		return fmt.Errorf("Approval timeout should be positive, got %s", policy.Timeout)
+	}
+	if app.governance != nil {
+		return fmt.Errorf("Off-chain approval cannot be used in governance mode")
+	}
+	app.approvals = newApprovalBook(policy)
+	return nil
+}
+
+// RequiresApproval returns true if validator changes should be proposed
+// and signed instead of being directly scheduled.
+func (app *ProxyApplication) RequiresApproval() bool {
+	return app.approvals != nil
+}
+
+// ProposeValidatorChange registers a new validator change, that will
+// be scheduled once enough operators signed it.
+func (app *ProxyApplication) ProposeValidatorChange(newValidators []*types.Validator, targetHeight uint64) (*ValidatorChangeProposal, error) {
+	if app.approvals == nil {
+		return nil, fmt.Errorf("Validator change approval is not enabled")
+	}
+	if err := app.checkScheduledHeight(targetHeight); err != nil {
+		return nil, err
+	}
+
+	b := app.approvals
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.expire()
+
+	p := &ValidatorChangeProposal{
+		ID:              b.nextID,
+		Validators:      newValidators,
+		ScheduledHeight: targetHeight,
+		Deadline:        b.now().Add(b.policy.Timeout),
+		Status:          ProposalPending,
+		Signatures:      make(map[string]crypto.Signature),
+	}
+	b.nextID++
+	b.proposals[p.ID] = p
+
+	app.logger.Info("new validator change proposal",
+		"id", p.ID,
+		"targetHeight", targetHeight,
+		"deadline", p.Deadline)
+
+	return p.copy(), nil
+}
+
+// SignValidatorChange adds an operator signature to a proposal. Once
+// the threshold is reached, the change is scheduled.
+func (app *ProxyApplication) SignValidatorChange(id uint64, pubKey crypto.PubKey, sig crypto.Signature) (*ValidatorChangeProposal, error) {
+	if app.approvals == nil {
+		return nil, fmt.Errorf("Validator change approval is not enabled")
+	}
+	if pubKey.Empty() == true {
+		return nil, fmt.Errorf("Missing operator public key")
+	}
+	b := app.approvals
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	p, err := b.pendingProposal(id)
+	if err != nil {
+		return nil, err
+	}
+	if b.policy.isOperator(pubKey) == false {
+		return nil, fmt.Errorf("%s is not an approval operator", pubKey.KeyString())
+	}
+	if pubKey.VerifyBytes(p.SignBytes(), sig) == false {
+		return nil, fmt.Errorf("Invalid signature for proposal %d", id)
+	}
+	p.Signatures[pubKey.KeyString()] = sig
+
+	if len(p.Signatures) < b.policy.Threshold {
+		return p.copy(), nil
+	}
+
+	if err := app.ChangeValidators(p.Validators, p.ScheduledHeight); err != nil {
+		p.Status = ProposalFailed
+		app.logger.Error("could not schedule approved validator change proposal", "id", id, "error", err)
+		return p.copy(), err
+	}
+	p.Status = ProposalApproved
+	app.logger.Info("validator change proposal approved", "id", id)
+	return p.copy(), nil
+}
+
+// RejectValidatorChange discards a pending proposal. The rejection
+// should be signed by one of the operators.
+func (app *ProxyApplication) RejectValidatorChange(id uint64, pubKey crypto.PubKey, sig crypto.Signature) (*ValidatorChangeProposal, error) {
+	if app.approvals == nil {
+		return nil, fmt.Errorf("Validator change approval is not enabled")
+	}
+	if pubKey.Empty() == true {
+		return nil, fmt.Errorf("Missing operator public key")
+	}
+	b := app.approvals
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	p, err := b.pendingProposal(id)
+	if err != nil {
+		return nil, err
+	}
+	if b.policy.isOperator(pubKey) == false {
+		return nil, fmt.Errorf("%s is not an approval operator", pubKey.KeyString())
+	}
+	if pubKey.VerifyBytes(p.RejectBytes(), sig) == false {
+		return nil, fmt.Errorf("Invalid rejection signature for proposal %d", id)
+	}
+	p.Status = ProposalRejected
+	app.logger.Info("validator change proposal rejected", "id", id, "by", pubKey.KeyString())
+	return p.copy(), nil
+}
+
+// ValidatorChangeProposals lists all known proposals, ordered by ID
+func (app *ProxyApplication) ValidatorChangeProposals() []*ValidatorChangeProposal {
+	if app.approvals == nil {
+		return nil
+	}
+	b := app.approvals
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.expire()
+	res := make([]*ValidatorChangeProposal, 0, len(b.proposals))
+	for id := uint64(1); id < b.nextID; id++ {
+		if p, ok := b.proposals[id]; ok == true {
+			res = append(res, p.copy())
+		}
+	}
+	return res
+}
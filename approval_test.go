@@ -0,0 +1,173 @@
+package abciproxy
+
+import (
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type ApprovalSuite struct {
+	operators []crypto.PrivKey
+	app       *ProxyApplication
+}
+
+var _ = Suite(&ApprovalSuite{})
+
+func (s *ApprovalSuite) SetUpTest(c *C) {
+	s.operators = nil
+	policy := &ApprovalPolicy{
+		Threshold: 2,
+		Timeout:   time.Hour,
+	}
+	for i := 0; i < 3; i++ {
+		priv := crypto.GenPrivKeyEd25519().Wrap()
+		s.operators = append(s.operators, priv)
+		policy.Operators = append(policy.Operators, priv.PubKey())
+	}
+
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	// handshake
+	s.app.Info()
+	c.Assert(s.app.EnableApproval(policy), IsNil)
+}
+
+func (s *ApprovalSuite) propose(c *C) *ValidatorChangeProposal {
+	validators := []*types.Validator{
+		&types.Validator{
+			PubKey: s.operators[0].PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+	p, err := s.app.ProposeValidatorChange(validators, 10)
+	c.Assert(err, IsNil)
+	c.Assert(p.Status, Equals, ProposalPending)
+	return p
+}
+
+func (s *ApprovalSuite) TestPolicyValidation(c *C) {
+	policy := &ApprovalPolicy{Threshold: 1, Timeout: time.Hour}
+	c.Check(policy.Validate(), ErrorMatches, "Approval policy requires at least one operator")
+
+	policy.Operators = []crypto.PubKey{s.operators[0].PubKey()}
+	policy.Threshold = 2
+	c.Check(policy.Validate(), ErrorMatches, "Invalid approval threshold 2 for 1 operators")
+}
+
+func (s *ApprovalSuite) TestChangeIsScheduledAtThreshold(c *C) {
+	p := s.propose(c)
+
+	res, err := s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[0].Sign(p.SignBytes()))
+	c.Assert(err, IsNil)
+	c.Check(res.Status, Equals, ProposalPending)
+	c.Check(s.app.PendingValidatorChanges(), HasLen, 0)
+
+	// signing twice does not count
+	res, err = s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[0].Sign(p.SignBytes()))
+	c.Assert(err, IsNil)
+	c.Check(res.Status, Equals, ProposalPending)
+
+	res, err = s.app.SignValidatorChange(p.ID, s.operators[2].PubKey(), s.operators[2].Sign(p.SignBytes()))
+	c.Assert(err, IsNil)
+	c.Check(res.Status, Equals, ProposalApproved)
+
+	pending := s.app.PendingValidatorChanges()
+	c.Assert(pending, HasLen, 1)
+	c.Check(pending[0].ScheduledHeight, Equals, uint64(10))
+	c.Check(pending[0].Diffs, DeepEquals, p.Validators)
+
+	_, err = s.app.SignValidatorChange(p.ID, s.operators[1].PubKey(), s.operators[1].Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, "Validator change proposal 1 is approved")
+}
+
+func (s *ApprovalSuite) TestApprovedChangesCannotBeCancelledDirectly(c *C) {
+	p := s.propose(c)
+	for _, op := range s.operators[:2] {
+		_, err := s.app.SignValidatorChange(p.ID, op.PubKey(), op.Sign(p.SignBytes()))
+		c.Assert(err, IsNil)
+	}
+	pending := s.app.PendingValidatorChanges()
+	c.Assert(pending, HasLen, 1)
+	c.Assert(pending[0].IDs, HasLen, 1)
+
+	_, err := s.app.cancelRPCResult(pending[0].IDs[0], "")
+	c.Check(err, ErrorMatches, "Validator changes require approval, use propose_validator_change")
+	c.Check(s.app.PendingValidatorChanges(), HasLen, 1)
+}
+
+func (s *ApprovalSuite) TestRejectsInvalidSignatures(c *C) {
+	p := s.propose(c)
+
+	outsider := crypto.GenPrivKeyEd25519().Wrap()
+	_, err := s.app.SignValidatorChange(p.ID, outsider.PubKey(), outsider.Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, ".* is not an approval operator")
+
+	_, err = s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[1].Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, "Invalid signature for proposal 1")
+
+	_, err = s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[0].Sign(p.RejectBytes()))
+	c.Check(err, ErrorMatches, "Invalid signature for proposal 1")
+}
+
+func (s *ApprovalSuite) TestRequiresOperatorPublicKey(c *C) {
+	p := s.propose(c)
+
+	_, err := s.app.SignValidatorChange(p.ID, crypto.PubKey{}, s.operators[0].Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, "Missing operator public key")
+	_, err = s.app.RejectValidatorChange(p.ID, crypto.PubKey{}, s.operators[0].Sign(p.RejectBytes()))
+	c.Check(err, ErrorMatches, "Missing operator public key")
+}
+
+func (s *ApprovalSuite) TestCanRejectProposal(c *C) {
+	p := s.propose(c)
+
+	res, err := s.app.RejectValidatorChange(p.ID, s.operators[1].PubKey(), s.operators[1].Sign(p.RejectBytes()))
+	c.Assert(err, IsNil)
+	c.Check(res.Status, Equals, ProposalRejected)
+
+	_, err = s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[0].Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, "Validator change proposal 1 is rejected")
+}
+
+func (s *ApprovalSuite) TestProposalsExpire(c *C) {
+	p := s.propose(c)
+
+	s.app.approvals.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	proposals := s.app.ValidatorChangeProposals()
+	c.Assert(len(proposals), Equals, 1)
+	c.Check(proposals[0].Status, Equals, ProposalExpired)
+
+	_, err := s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[0].Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, "Validator change proposal 1 is expired")
+}
+
+func (s *ApprovalSuite) TestProposalFailsIfItCannotBeScheduled(c *C) {
+	p := s.propose(c)
+	// the height is reached before the proposal is approved
+	s.app.EndBlock(10)
+
+	_, err := s.app.SignValidatorChange(p.ID, s.operators[0].PubKey(), s.operators[0].Sign(p.SignBytes()))
+	c.Assert(err, IsNil)
+	res, err := s.app.SignValidatorChange(p.ID, s.operators[1].PubKey(), s.operators[1].Sign(p.SignBytes()))
+	c.Check(err, ErrorMatches, "Could not schedule for a block height back in time.*")
+	c.Check(res.Status, Equals, ProposalFailed)
+	c.Check(s.app.PendingValidatorChanges(), HasLen, 0)
+
+	proposals := s.app.ValidatorChangeProposals()
+	c.Assert(proposals, HasLen, 1)
+	c.Check(proposals[0].Status, Equals, ProposalFailed)
+}
+
+func (s *ApprovalSuite) TestEndedProposalsAreForgotten(c *C) {
+	s.propose(c)
+
+	s.app.approvals.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	c.Check(s.app.ValidatorChangeProposals(), HasLen, 1)
+
+	s.app.approvals.now = func() time.Time { return time.Now().Add(time.Hour + proposalHistory + time.Minute) }
+	c.Check(s.app.ValidatorChangeProposals(), HasLen, 0)
+}
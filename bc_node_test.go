@@ -9,7 +9,6 @@ import (
 	"syscall"
 	"time"
 
-	abcicli "github.com/tendermint/abci/client"
 	"github.com/tendermint/abci/server"
 	cmn "github.com/tendermint/tmlibs/common"
 	tmlog "github.com/tendermint/tmlibs/log"
@@ -32,8 +31,10 @@ type BCNode struct {
 	//proxy app management
 	proxy        *ProxyApplication
 	proxyService cmn.Service
-	appClient    abcicli.Client
+	appConns     Connections
 	proxyOutput  *bytes.Buffer
+	// changes of the genesis validators, if not nil
+	genesisConfig *GenesisConfig
 	// target app management
 
 	testApplication *TestApplication
@@ -99,20 +100,24 @@ func (n *BCNode) Start(peers []*BCNode) error {
 	time.Sleep(20 * time.Millisecond)
 
 	//start proxy
-	n.appClient = abcicli.NewSocketClient(fmt.Sprintf("tcp://127.0.0.1:%d", n.AppPort()), true)
-	if _, err := n.appClient.Start(); err != nil {
+	n.appConns, err = NewSocketConnections(fmt.Sprintf("tcp://127.0.0.1:%d", n.AppPort()))
+	if err != nil {
 		return err
 	}
 
-	n.proxy = NewProxyApp(n.appClient)
-	n.proxyService, err = server.NewServer(fmt.Sprintf("tcp://127.0.0.1:%d", n.ProxyAppPort()),
-		"socket",
-		n.proxy)
-	if err != nil {
+	proxyLogger := tmlog.NewTMLogger(tmlog.NewSyncWriter(n.proxyOutput))
+	n.proxy = NewProxyAppWithConnections(n.appConns, proxyLogger.With("module", "abci-proxy"))
+	if err := n.proxy.EnableDiffHistory(filepath.Join(n.wDir, "proxy_diffs.log")); err != nil {
 		return err
 	}
+	if n.genesisConfig != nil {
+		if err := n.proxy.SetGenesisConfig(n.genesisConfig); err != nil {
+			return err
+		}
+	}
+	n.proxyService = NewPipelinedServer(fmt.Sprintf("tcp://127.0.0.1:%d", n.ProxyAppPort()), n.proxy)
 
-	n.proxyService.SetLogger(tmlog.NewTMLogger(tmlog.NewSyncWriter(n.proxyOutput)).With("module", "abci-server"))
+	n.proxyService.SetLogger(proxyLogger.With("module", "abci-server"))
 	if _, err := n.proxyService.Start(); err != nil {
 		return err
 	}
@@ -168,8 +173,9 @@ func (n *BCNode) Stop() error {
 	if ok := n.proxyService.Stop(); ok == false {
 		return fmt.Errorf("Could not stop proxy service %d", n.ID)
 	}
-	if ok := n.appClient.Stop(); ok == false {
-		return fmt.Errorf("Could not close target app connection %d", n.ID)
+	n.appConns.Stop()
+	if err := n.proxy.CloseDiffHistory(); err != nil {
+		return fmt.Errorf("Could not close diff history %d: %s", n.ID, err)
 	}
 	//stop app
 	if ok := n.app.Stop(); ok == false {
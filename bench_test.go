@@ -0,0 +1,248 @@
+package abciproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/server"
+	"github.com/tendermint/abci/types"
+	cmn "github.com/tendermint/tmlibs/common"
+	tmlog "github.com/tendermint/tmlibs/log"
+)
+
+// The proxy overhead benchmarks are run with:
+//
+//	go test -run XXX -bench ProxyOverhead [-bench-json results.json]
+var benchJSON = flag.String("bench-json", "", "File to write the proxy overhead benchmark results to, as JSON")
+
+const BenchSocketPortStart int = 50520
+const BenchGRPCPortStart int = 50530
+
+// BenchmarkResult is the last run of a proxy overhead benchmark
+type BenchmarkResult struct {
+	Transport string  `json:"transport"`
+	Target    string  `json:"target"`
+	Method    string  `json:"method"`
+	N         int     `json:"n"`
+	NsPerOp   int64   `json:"ns_per_op"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+}
+
+// benchTarget is a client, either to the application or to a proxy in
+// front of it
+type benchTarget struct {
+	name   string
+	client abcicli.Client
+}
+
+// benchProxy is a proxy served in front of the benchmarked application
+type benchProxy struct {
+	name      string
+	pipelined bool
+}
+
+type benchEnv struct {
+	transport string
+	services  []cmn.Service
+	targets   []benchTarget
+}
+
+func (env *benchEnv) start(s cmn.Service) error {
+	if _, err := s.Start(); err != nil {
+		return err
+	}
+	env.services = append(env.services, s)
+	return nil
+}
+
+func (env *benchEnv) connect(port int) (abcicli.Client, error) {
+	client, err := abcicli.NewClient(fmt.Sprintf("tcp://127.0.0.1:%d", port), env.transport, true)
+	if err != nil {
+		return nil, err
+	}
+	return client, env.start(client)
+}
+
+func (env *benchEnv) stop() {
+	// stop clients before servers
+	for i := len(env.services) - 1; i >= 0; i-- {
+		env.services[i].Stop()
+	}
+}
+
+// newBenchEnv serves a TestApplication at portStart, and a
+// ProxyApplication in front of it at portStart+1. For sockets, a
+// pipelined proxy is also served at portStart+2.
+func newBenchEnv(transport string, portStart int) (*benchEnv, error) {
+	env := &benchEnv{transport: transport}
+	servers := []benchProxy{{"proxy", false}}
+	if transport == "socket" {
+		servers = append(servers, benchProxy{"pipelined_proxy", true})
+	}
+
+	appServer, err := server.NewServer(fmt.Sprintf("tcp://127.0.0.1:%d", portStart), transport, NewTestApplication(false))
+	if err != nil {
+		return nil, err
+	}
+	appServer.SetLogger(tmlog.NewNopLogger())
+	if err := env.start(appServer); err != nil {
+		return nil, err
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	for i, s := range servers {
+		next, err := env.connect(portStart)
+		if err != nil {
+			env.stop()
+			return nil, err
+		}
+		proxy := NewProxyApp(next)
+		address := fmt.Sprintf("tcp://127.0.0.1:%d", portStart+1+i)
+		var proxyServer cmn.Service
+		if s.pipelined == true {
+			proxyServer = NewPipelinedServer(address, proxy)
+		} else {
+			proxyServer, err = server.NewServer(address, transport, proxy)
+			if err != nil {
+				env.stop()
+				return nil, err
+			}
+		}
+		proxyServer.SetLogger(tmlog.NewNopLogger())
+		if err := env.start(proxyServer); err != nil {
+			env.stop()
+			return nil, err
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	direct, err := env.connect(portStart)
+	if err != nil {
+		env.stop()
+		return nil, err
+	}
+	env.targets = append(env.targets, benchTarget{"direct", direct})
+	for i, s := range servers {
+		client, err := env.connect(portStart + 1 + i)
+		if err != nil {
+			env.stop()
+			return nil, err
+		}
+		env.targets = append(env.targets, benchTarget{s.name, client})
+	}
+	return env, nil
+}
+
+// benchMethods are the measured calls. Latency is measured with
+// synchronous calls, throughput by sending transactions asynchronously
+// and flushing once.
+var benchMethods = []struct {
+	name string
+	run  func(b *testing.B, client abcicli.Client)
+}{
+	{"info", func(b *testing.B, client abcicli.Client) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.InfoSync(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}},
+	{"query", func(b *testing.B, client abcicli.Client) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.QuerySync(types.RequestQuery{Path: "tx"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}},
+	{"check_tx", func(b *testing.B, client abcicli.Client) {
+		tx := []byte{0x00}
+		for i := 0; i < b.N; i++ {
+			client.CheckTxSync(tx)
+		}
+	}},
+	{"deliver_tx", func(b *testing.B, client abcicli.Client) {
+		tx := []byte{0x00}
+		for i := 0; i < b.N; i++ {
+			client.DeliverTxSync(tx)
+		}
+	}},
+	{"commit", func(b *testing.B, client abcicli.Client) {
+		for i := 0; i < b.N; i++ {
+			client.CommitSync()
+		}
+	}},
+	{"deliver_tx_throughput", func(b *testing.B, client abcicli.Client) {
+		tx := []byte{0x00}
+		for i := 0; i < b.N; i++ {
+			client.DeliverTxAsync(tx)
+		}
+		if err := client.FlushSync(); err != nil {
+			b.Fatal(err)
+		}
+	}},
+}
+
+func benchmarkProxyOverhead(b *testing.B, transport string, portStart int) {
+	env, err := newBenchEnv(transport, portStart)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer env.stop()
+
+	var results []BenchmarkResult
+	for _, m := range benchMethods {
+		for _, t := range env.targets {
+			var last BenchmarkResult
+			method, target := m, t
+			b.Run(method.name+"/"+target.name, func(b *testing.B) {
+				start := time.Now()
+				method.run(b, target.client)
+				elapsed := time.Since(start)
+				last = BenchmarkResult{
+					Transport: transport,
+					Target:    target.name,
+					Method:    method.name,
+					N:         b.N,
+					NsPerOp:   elapsed.Nanoseconds() / int64(b.N),
+					OpsPerSec: float64(b.N) / elapsed.Seconds(),
+				}
+			})
+			results = append(results, last)
+		}
+	}
+	if err := writeBenchmarkResults(transport, results); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// writeBenchmarkResults adds results to the -bench-json file, if any
+func writeBenchmarkResults(transport string, results []BenchmarkResult) error {
+	if len(*benchJSON) == 0 {
+		return nil
+	}
+	all := make(map[string][]BenchmarkResult)
+	if data, err := ioutil.ReadFile(*benchJSON); err == nil {
+		if err := json.Unmarshal(data, &all); err != nil {
+			return fmt.Errorf("Could not read existing results in %s: %s", *benchJSON, err)
+		}
+	}
+	all[transport] = results
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*benchJSON, data, 0644)
+}
+
+func BenchmarkProxyOverheadSocket(b *testing.B) {
+	benchmarkProxyOverhead(b, "socket", BenchSocketPortStart)
+}
+
+func BenchmarkProxyOverheadGRPC(b *testing.B) {
+	benchmarkProxyOverhead(b, "grpc", BenchGRPCPortStart)
+}
@@ -0,0 +1,344 @@
+package abciproxy
+
+import (
+	"fmt"
+
+	"github.com/tendermint/abci/types"
+)
+
+type ChangeStatus string
+
+const (
+	ChangePending ChangeStatus = "pending"
+	ChangeApplied ChangeStatus = "applied"
+	// the change reached EndBlock after its scheduled height
+	ChangeExpired   ChangeStatus = "expired"
+	ChangeCancelled ChangeStatus = "cancelled"
+	// the operators refused the diffs of the scheduled height, see
+	// RefuseValidatorHeight
+	ChangeRefused ChangeStatus = "refused"
+	// a power decrease would have made a voting power negative
+	ChangeFailed ChangeStatus = "failed"
+)
+
+// number of blocks the applied and expired changes are remembered
+const changeStatusHistory = 1000
+
+// ValidatorChangeStatus follows a change scheduled with
+// ScheduleValidatorChange
+type ValidatorChangeStatus struct {
+	ID uint64
+	// optional key chosen by the caller. Unlike the ID, it does not
+	// depend on the order of the changes since the proxy started.
+	Key        string
+	Validators []*types.Validator
+	// operations of the validators, nil if they all set their power
+	Ops []PowerOp
+	// height asked for, and the effective one, which may have been
+	// bumped to respect the minimum lead
+	RequestedHeight uint64
+	ScheduledHeight uint64
+	Status          ChangeStatus
+	// height the change was applied or expired at
+	Height uint64
+}
+
+// ScheduleValidatorChange schedules newValidators at targetHeight, and
+// returns the status of the change, to follow it with
+// ValidatorChangeStatus.
+func (app *ProxyApplication) ScheduleValidatorChange(newValidators []*types.Validator, targetHeight uint64) (*ValidatorChangeStatus, error) {
+	return app.ScheduleValidatorPowerChanges(newValidators, nil, targetHeight)
+}
+
+// ScheduleValidatorPowerChanges is ScheduleValidatorChange with an
+// operation for each validator. Relative operations are resolved
+// against the validator set when the change is emitted; if a voting
+// power would become negative, the change fails.
+func (app *ProxyApplication) ScheduleValidatorPowerChanges(newValidators []*types.Validator, ops []PowerOp, targetHeight uint64) (*ValidatorChangeStatus, error) {
+	return app.ScheduleKeyedValidatorChange("", newValidators, ops, targetHeight)
+}
+
+// ScheduleKeyedValidatorChange is ScheduleValidatorPowerChanges for a
+// change identified by key, to cancel it with
+// CancelValidatorChangeByKey. A key is used by a single change.
+func (app *ProxyApplication) ScheduleKeyedValidatorChange(key string, newValidators []*types.Validator, ops []PowerOp, targetHeight uint64) (*ValidatorChangeStatus, error) {
+	app.logger.Debug("received new validator set",
+		"key", key,
+		"validators", newValidators,
+		"ops", ops,
+		"targetHeight", targetHeight)
+	if err := app.checkScheduledHeight(targetHeight); err != nil {
+		return nil, err
+	}
+	scheduledHeight, err := app.leadHeight(targetHeight)
+	if err != nil {
+		return nil, err
+	}
+	if relativeOps(ops) == false {
+		ops = nil
+	} else if _, err := resolveDiffs(app.projectedValidators(scheduledHeight), newValidators, ops); err != nil {
+		return nil, err
+	}
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	// EndBlock may have reached the height in the meantime
+	if scheduledHeight <= app.lastHeight {
+		return nil, fmt.Errorf("Could not schedule for a block height back in time (wanted:%d, current:%d)", scheduledHeight, app.lastHeight)
+	}
+	if app.refusedHeights[scheduledHeight] == true {
+		return nil, fmt.Errorf("Validator changes at height %d are refused", scheduledHeight)
+	}
+	if other := app.changeByKeyUnsafe(key); other != nil {
+		return nil, fmt.Errorf("Validator change key %s is already used by change %d", key, other.ID)
+	}
+	app.nextChangeID++
+	status := &ValidatorChangeStatus{
+		ID:              app.nextChangeID,
+		Key:             key,
+		Validators:      newValidators,
+		Ops:             ops,
+		RequestedHeight: targetHeight,
+		ScheduledHeight: scheduledHeight,
+		Status:          ChangePending,
+	}
+	app.changes[status.ID] = status
+	app.scheduleChangeUnsafe(ValidatorSetChange{
+		Diffs:           newValidators,
+		Ops:             ops,
+		ScheduledHeight: scheduledHeight,
+		IDs:             []uint64{status.ID},
+	})
+	res := *status
+	return &res, nil
+}
+
+// SetMinimumLead requires validator changes to be scheduled at least
+// lead blocks after the current height, as the next one is often
+// already being built. If autoBump is set, changes scheduled too early
+// are moved to the earliest allowed height instead of being refused.
+func (app *ProxyApplication) SetMinimumLead(lead uint64, autoBump bool) {
+	app.minLead = lead
+	app.autoBump = autoBump
+}
+
+// leadHeight returns the height a change asked for targetHeight is
+// scheduled at, according to the minimum lead.
+func (app *ProxyApplication) leadHeight(targetHeight uint64) (uint64, error) {
+	res, err := app.effectiveHeight(targetHeight)
+	if err == nil && res != targetHeight {
+		app.logger.Info("bumped validator change height to respect the minimum lead", "wanted", targetHeight, "height", res)
+	}
+	return res, err
+}
+
+// effectiveHeight is leadHeight without logging, for the calls which
+// do not schedule anything
+func (app *ProxyApplication) effectiveHeight(targetHeight uint64) (uint64, error) {
+	earliest := app.currentHeight() + app.minLead
+	if app.minLead == 0 || targetHeight >= earliest {
+		return targetHeight, nil
+	}
+	if app.autoBump == false {
+		return 0, fmt.Errorf("Validator changes must be scheduled at least %d blocks ahead (wanted:%d, earliest:%d)", app.minLead, targetHeight, earliest)
+	}
+	return earliest, nil
+}
+
+// ValidatorChangeStatus returns the status of the change id
+func (app *ProxyApplication) ValidatorChangeStatus(id uint64) (*ValidatorChangeStatus, error) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	status, ok := app.changes[id]
+	if ok == false {
+		return nil, fmt.Errorf("Unknown validator change %d", id)
+	}
+	res := *status
+	return &res, nil
+}
+
+// changeByKeyUnsafe returns the change scheduled with key, nil if none
+// or if key is empty. app.mtx should be held.
+func (app *ProxyApplication) changeByKeyUnsafe(key string) *ValidatorChangeStatus {
+	if len(key) == 0 {
+		return nil
+	}
+	for _, status := range app.changes {
+		if status.Key == key {
+			return status
+		}
+	}
+	return nil
+}
+
+// CancelValidatorChange cancels the change id, if it is still pending
+func (app *ProxyApplication) CancelValidatorChange(id uint64) (*ValidatorChangeStatus, error) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	status, ok := app.changes[id]
+	if ok == false {
+		return nil, fmt.Errorf("Unknown validator change %d", id)
+	}
+	return app.cancelChangeUnsafe(status)
+}
+
+// CancelValidatorChangeByKey cancels the change scheduled with key, if
+// it is still pending
+func (app *ProxyApplication) CancelValidatorChangeByKey(key string) (*ValidatorChangeStatus, error) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	status := app.changeByKeyUnsafe(key)
+	if status == nil {
+		return nil, fmt.Errorf("Unknown validator change key %s", key)
+	}
+	return app.cancelChangeUnsafe(status)
+}
+
+// cancelChangeUnsafe cancels the pending change of status. app.mtx
+// should be held.
+func (app *ProxyApplication) cancelChangeUnsafe(status *ValidatorChangeStatus) (*ValidatorChangeStatus, error) {
+	id := status.ID
+	if status.Status != ChangePending {
+		return nil, fmt.Errorf("Validator change %d is %s", id, status.Status)
+	}
+	status.Status = ChangeCancelled
+	status.Height = app.lastHeight
+
+	c, ok := app.diffs[status.ScheduledHeight]
+	if ok == false {
+		res := *status
+		return &res, nil
+	}
+	c = c.withoutChange(id)
+	if len(c.Diffs) == 0 {
+		delete(app.diffs, status.ScheduledHeight)
+	} else {
+		app.diffs[status.ScheduledHeight] = c
+	}
+	res := *status
+	return &res, nil
+}
+
+// changeDiffs are the diffs of a single change merged in a
+// ValidatorSetChange
+type changeDiffs struct {
+	// ID of the change, 0 for the changes scheduled without status
+	id    uint64
+	diffs []*types.Validator
+	ops   []PowerOp
+}
+
+// changeParts returns the diffs of each change merged in c. The changes
+// restored from a saved state have no parts, and are seen as a single
+// one.
+func (c ValidatorSetChange) changeParts() []changeDiffs {
+	if c.parts != nil || len(c.Diffs) == 0 {
+		return c.parts
+	}
+	part := changeDiffs{diffs: c.Diffs, ops: c.Ops}
+	if len(c.IDs) == 1 {
+		part.id = c.IDs[0]
+	}
+	return []changeDiffs{part}
+}
+
+// rebuilt returns c with its diffs, operations and IDs merged again
+// from its parts
+func (c ValidatorSetChange) rebuilt() ValidatorSetChange {
+	res := ValidatorSetChange{ScheduledHeight: c.ScheduledHeight, parts: c.changeParts()}
+	for _, p := range res.parts {
+		res.Ops = mergeOps(res.Ops, len(res.Diffs), p.ops, len(p.diffs))
+		res.Diffs = mergeValidatorDiffs(res.Diffs, p.diffs)
+		if p.id != 0 {
+			res.IDs = append(res.IDs, p.id)
+		}
+	}
+	return res
+}
+
+// withoutChange returns c without the diffs of the change id
+func (c ValidatorSetChange) withoutChange(id uint64) ValidatorSetChange {
+	parts := make([]changeDiffs, 0, len(c.changeParts()))
+	for _, p := range c.changeParts() {
+		if p.id != id {
+			parts = append(parts, p)
+		}
+	}
+	c.parts = parts
+	return c.rebuilt()
+}
+
+// changeAt returns the ID of the change holding the diff at index in
+// c.Diffs
+func (c ValidatorSetChange) changeAt(index int) uint64 {
+	for _, p := range c.changeParts() {
+		if index < len(p.diffs) {
+			return p.id
+		}
+		index -= len(p.diffs)
+	}
+	return 0
+}
+
+// withoutDiff returns c without its diff at index, for the changes
+// scheduled without status
+func (c ValidatorSetChange) withoutDiff(index int) ValidatorSetChange {
+	parts := make([]changeDiffs, 0, len(c.changeParts()))
+	for _, p := range c.changeParts() {
+		if index >= 0 && index < len(p.diffs) {
+			kept := changeDiffs{id: p.id}
+			for i, v := range p.diffs {
+				if i == index {
+					continue
+				}
+				kept.diffs = append(kept.diffs, v)
+				if relativeOps(p.ops) == true {
+					kept.ops = append(kept.ops, opAt(p.ops, i))
+				}
+			}
+			parts = append(parts, kept)
+		} else {
+			parts = append(parts, p)
+		}
+		index -= len(p.diffs)
+	}
+	c.parts = parts
+	return c.rebuilt()
+}
+
+// setChangesStatus marks the pending changes ids as applied or
+// expired at height. app.mtx should be held.
+func (app *ProxyApplication) setChangesStatus(ids []uint64, status ChangeStatus, height uint64) {
+	for _, id := range ids {
+		if c, ok := app.changes[id]; ok == true && c.Status == ChangePending {
+			c.Status = status
+			c.Height = height
+		}
+	}
+}
+
+// expireChanges drops the diffs which can no longer be emitted, and
+// forgets the changes which ended long ago. app.mtx should be held.
+func (app *ProxyApplication) expireChanges(height uint64) {
+	for h, c := range app.diffs {
+		if h >= height {
+			continue
+		}
+		app.logger.Error("dropping validator change scheduled in the past",
+			"currentHeight", height,
+			"targetHeight", h,
+			"diffs", c.Diffs)
+		app.setChangesStatus(c.IDs, ChangeExpired, height)
+		delete(app.diffs, h)
+	}
+	for h := range app.refusedHeights {
+		if h < height {
+			delete(app.refusedHeights, h)
+		}
+	}
+	for id, c := range app.changes {
+		if c.Status != ChangePending && c.Height+changeStatusHistory < height {
+			delete(app.changes, id)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package abciproxy
+
+import (
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type ChangesSuite struct {
+	app   *ProxyApplication
+	diffs []*types.Validator
+}
+
+var _ = Suite(&ChangesSuite{})
+
+func (s *ChangesSuite) SetUpTest(c *C) {
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	s.app.InitChain(nil)
+	s.diffs = []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+}
+
+func (s *ChangesSuite) status(c *C, id uint64) *ValidatorChangeStatus {
+	res, err := s.app.ValidatorChangeStatus(id)
+	c.Assert(err, IsNil)
+	return res
+}
+
+func (s *ChangesSuite) TestChangeIsAppliedAtItsHeight(c *C) {
+	status, err := s.app.ScheduleValidatorChange(s.diffs, 2)
+	c.Assert(err, IsNil)
+	c.Check(status.Status, Equals, ChangePending)
+
+	s.app.EndBlock(1)
+	c.Check(s.status(c, status.ID).Status, Equals, ChangePending)
+	c.Check(s.app.EndBlock(2).Diffs, DeepEquals, s.diffs)
+	applied := s.status(c, status.ID)
+	c.Check(applied.Status, Equals, ChangeApplied)
+	c.Check(applied.Height, Equals, uint64(2))
+}
+
+func (s *ChangesSuite) TestLateChangeExpires(c *C) {
+	status, err := s.app.ScheduleValidatorChange(s.diffs, 2)
+	c.Assert(err, IsNil)
+	// tendermint skipped ahead before the change could be consumed
+	c.Check(s.app.EndBlock(3).Diffs, HasLen, 0)
+
+	expired := s.status(c, status.ID)
+	c.Check(expired.Status, Equals, ChangeExpired)
+	c.Check(expired.Height, Equals, uint64(3))
+	c.Check(s.app.PendingValidatorChanges(), HasLen, 0)
+}
+
+func (s *ChangesSuite) TestEndedChangesAreForgotten(c *C) {
+	status, err := s.app.ScheduleValidatorChange(s.diffs, 1)
+	c.Assert(err, IsNil)
+	s.app.EndBlock(1)
+	c.Check(s.status(c, status.ID).Status, Equals, ChangeApplied)
+
+	s.app.EndBlock(1 + changeStatusHistory + 1)
+	_, err = s.app.ValidatorChangeStatus(status.ID)
+	c.Check(err, ErrorMatches, "Unknown validator change .*")
+}
+
+func (s *ChangesSuite) TestMinimumLead(c *C) {
+	s.app.SetMinimumLead(3, false)
+	s.app.EndBlock(1)
+
+	_, err := s.app.ScheduleValidatorChange(s.diffs, 3)
+	c.Check(err, ErrorMatches, "Validator changes must be scheduled at least 3 blocks ahead \\(wanted:3, earliest:4\\)")
+	status, err := s.app.ScheduleValidatorChange(s.diffs, 4)
+	c.Assert(err, IsNil)
+	c.Check(status.ScheduledHeight, Equals, uint64(4))
+}
+
+func (s *ChangesSuite) TestMinimumLeadAutoBump(c *C) {
+	s.app.SetMinimumLead(3, true)
+	s.app.EndBlock(1)
+
+	status, err := s.app.ScheduleValidatorChange(s.diffs, 2)
+	c.Assert(err, IsNil)
+	c.Check(status.RequestedHeight, Equals, uint64(2))
+	c.Check(status.ScheduledHeight, Equals, uint64(4))
+
+	// back in time is still an error
+	_, err = s.app.ScheduleValidatorChange(s.diffs, 1)
+	c.Check(err, ErrorMatches, "Could not schedule for a block height back in time.*")
+
+	s.app.EndBlock(2)
+	s.app.EndBlock(3)
+	c.Check(s.app.EndBlock(4).Diffs, DeepEquals, s.diffs)
+}
+
+func (s *ChangesSuite) TestCancelPendingChange(c *C) {
+	other := []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  5,
+		},
+	}
+	first, err := s.app.ScheduleValidatorChange(s.diffs, 3)
+	c.Assert(err, IsNil)
+	s.app.EndBlock(1)
+	second, err := s.app.ScheduleValidatorChange(other, 3)
+	c.Assert(err, IsNil)
+
+	// only the diffs of first are removed
+	cancelled, err := s.app.CancelValidatorChange(first.ID)
+	c.Assert(err, IsNil)
+	c.Check(cancelled.Status, Equals, ChangeCancelled)
+	_, err = s.app.CancelValidatorChange(first.ID)
+	c.Check(err, ErrorMatches, "Validator change .* is cancelled")
+
+	s.app.EndBlock(2)
+	c.Check(s.app.EndBlock(3).Diffs, DeepEquals, other)
+	c.Check(s.status(c, second.ID).Status, Equals, ChangeApplied)
+}
+
+func (s *ChangesSuite) TestCancelChangeSharingDiffs(c *C) {
+	first, err := s.app.ScheduleValidatorChange(s.diffs, 3)
+	c.Assert(err, IsNil)
+	second, err := s.app.ScheduleValidatorChange(s.diffs, 3)
+	c.Assert(err, IsNil)
+
+	// the diffs of second are the same values, and must be kept
+	_, err = s.app.CancelValidatorChange(first.ID)
+	c.Assert(err, IsNil)
+	pending := s.app.PendingValidatorChanges()
+	c.Assert(pending, HasLen, 1)
+	c.Check(pending[0].Diffs, DeepEquals, s.diffs)
+	c.Check(pending[0].IDs, DeepEquals, []uint64{second.ID})
+
+	s.app.EndBlock(2)
+	c.Check(s.app.EndBlock(3).Diffs, DeepEquals, s.diffs)
+	c.Check(s.status(c, second.ID).Status, Equals, ChangeApplied)
+}
@@ -0,0 +1,111 @@
+package abciproxy
+
+import (
+	abcicli "github.com/tendermint/abci/client"
+)
+
+// Connections are the clients to the target application, following
+// the three ABCI connections Tendermint opens: InitChain, BeginBlock,
+// DeliverTx, EndBlock and Commit go to Consensus, CheckTx to Mempool,
+// and Info, SetOption and Query to Query. A slow query then does not
+// delay the processing of blocks.
+type Connections struct {
+	Consensus abcicli.Client
+	Mempool   abcicli.Client
+	Query     abcicli.Client
+}
+
+// SharedConnections uses the same client for all the connections
+func SharedConnections(client abcicli.Client) Connections {
+	return Connections{
+		Consensus: client,
+		Mempool:   client,
+		Query:     client,
+	}
+}
+
+// NewSocketConnections opens the three connections to the application
+// listening at address.
+func NewSocketConnections(address string) (Connections, error) {
+	var started []abcicli.Client
+	for i := 0; i < 3; i++ {
+		client := abcicli.NewSocketClient(address, true)
+		if _, err := client.Start(); err != nil {
+			for _, c := range started {
+				c.Stop()
+			}
+			return Connections{}, err
+		}
+		started = append(started, client)
+	}
+	return Connections{
+		Consensus: started[0],
+		Mempool:   started[1],
+		Query:     started[2],
+	}, nil
+}
+
+// clients returns the distinct clients of conns
+func (conns Connections) clients() []abcicli.Client {
+	res := []abcicli.Client{conns.Consensus}
+	for _, c := range []abcicli.Client{conns.Mempool, conns.Query} {
+		found := false
+		for _, other := range res {
+			if other == c {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Stop stops all the clients
+func (conns Connections) Stop() {
+	for _, c := range conns.clients() {
+		c.Stop()
+	}
+}
+
+func (app *ProxyApplication) connections() Connections {
+	app.nextMtx.RLock()
+	defer app.nextMtx.RUnlock()
+	return app.next
+}
+
+// acquireConnections returns the connections to the target application
+// for a call which is not on the consensus connection. release should
+// be called once the call is answered: a switch of the target
+// application waits for it before stopping the connections.
+func (app *ProxyApplication) acquireConnections() (Connections, func()) {
+	app.nextMtx.RLock()
+	defer app.nextMtx.RUnlock()
+	inflight := app.inflight
+	inflight.Add(1)
+	return app.next, inflight.Done
+}
+
+// consensusClient is not acquired, as switches happen on the consensus
+// connection, between blocks
+func (app *ProxyApplication) consensusClient() abcicli.Client {
+	return app.connections().Consensus
+}
+
+func (app *ProxyApplication) mempoolClient() (abcicli.Client, func()) {
+	conns, release := app.acquireConnections()
+	return conns.Mempool, release
+}
+
+func (app *ProxyApplication) queryClient() (abcicli.Client, func()) {
+	conns, release := app.acquireConnections()
+	return conns.Query, release
+}
+
+// ConcurrentQueries tells the PipelinedServer that the query
+// connection methods can be called while a block is processed.
+func (app *ProxyApplication) ConcurrentQueries() bool {
+	return true
+}
@@ -0,0 +1,88 @@
+package abciproxy
+
+import (
+	"fmt"
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	cmn "github.com/tendermint/tmlibs/common"
+	tmlog "github.com/tendermint/tmlibs/log"
+
+	. "gopkg.in/check.v1"
+)
+
+// slowQueryApplication blocks all queries until released
+type slowQueryApplication struct {
+	*TestApplication
+	release chan struct{}
+}
+
+func (app *slowQueryApplication) Query(reqQuery types.RequestQuery) types.ResponseQuery {
+	<-app.release
+	return types.ResponseQuery{Value: []byte("slow")}
+}
+
+type ConnectionsSuite struct {
+	app       *slowQueryApplication
+	server    cmn.Service
+	consensus abcicli.Client
+	query     abcicli.Client
+}
+
+var _ = Suite(&ConnectionsSuite{})
+
+const ConnectionsProxyPort int = 50510
+
+func (s *ConnectionsSuite) SetUpTest(c *C) {
+	s.app = &slowQueryApplication{
+		TestApplication: NewTestApplication(false),
+		release:         make(chan struct{}),
+	}
+	// local clients do not share their mutex, like socket clients
+	// to an application serving each connection separately
+	proxy := NewProxyAppWithConnections(Connections{
+		Consensus: abcicli.NewLocalClient(nil, s.app),
+		Mempool:   abcicli.NewLocalClient(nil, s.app),
+		Query:     abcicli.NewLocalClient(nil, s.app),
+	}, tmlog.NewNopLogger())
+	s.server = NewPipelinedServer(fmt.Sprintf("tcp://127.0.0.1:%d", ConnectionsProxyPort), proxy)
+	_, err := s.server.Start()
+	c.Assert(err, IsNil)
+	time.Sleep(20 * time.Millisecond)
+
+	s.consensus = startSocketClient(c, ConnectionsProxyPort)
+	s.query = startSocketClient(c, ConnectionsProxyPort)
+}
+
+func (s *ConnectionsSuite) TearDownTest(c *C) {
+	s.consensus.Stop()
+	s.query.Stop()
+	s.server.Stop()
+}
+
+func (s *ConnectionsSuite) TestQueriesDoNotStallBlocks(c *C) {
+	reqRes := s.query.QueryAsync(types.RequestQuery{Path: "tx"})
+	s.query.FlushAsync()
+
+	done := make(chan struct{})
+	go func() {
+		s.consensus.BeginBlockSync(nil, &types.Header{Height: 1})
+		s.consensus.DeliverTxSync([]byte{0x00})
+		s.consensus.EndBlockSync(1)
+		s.consensus.CommitSync()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(s.app.release)
+		c.Fatal("block processing was stalled by a pending query")
+	}
+	c.Check(s.app.CommitCalls.Calls, HasLen, 1)
+
+	close(s.app.release)
+	reqRes.Wait()
+	c.Check(reqRes.Response.GetQuery().Value, DeepEquals, []byte("slow"))
+}
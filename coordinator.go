@@ -0,0 +1,243 @@
+package abciproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/tendermint/rpc/lib/client"
+)
+
+// PeerClient schedules validator changes on the proxy of another node.
+// Changes are identified by a key chosen by the caller, as the IDs
+// given by a peer are not kept when it restarts.
+type PeerClient interface {
+	ChangeValidators(validators []*ValidatorPowerChange, scheduledHeight uint64, key string) (*ChangeValidatorsResult, error)
+	CancelValidatorChange(key string) error
+	RefuseValidatorHeight(height uint64) error
+	ValidatorSchedule(fromHeight, toHeight uint64) (*ValidatorScheduleResult, error)
+}
+
+// PeerRefusal is the error of a PeerClient call the peer proxy answered
+// with an error, so that the call is known to have had no effect
+type PeerRefusal struct {
+	Msg string
+}
+
+func (e *PeerRefusal) Error() string {
+	return e.Msg
+}
+
+// rpcPeerClient is a PeerClient using the RPC of the peer proxy
+type rpcPeerClient struct {
+	client *rpcclient.JSONRPCClient
+}
+
+// NewRPCPeerClient returns a client to the peer proxy RPC listening at
+// address, like http://127.0.0.1:46660
+func NewRPCPeerClient(address string) PeerClient {
+	return &rpcPeerClient{client: rpcclient.NewJSONRPCClient(address)}
+}
+
+// rpcResponseError prefixes the errors returned by the peer RPC
+const rpcResponseError = "Response error: "
+
+// peerError tells the errors returned by the peer apart from the ones
+// of the transport, after which the outcome of the call is unknown
+func peerError(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), rpcResponseError) == true {
+		return &PeerRefusal{Msg: strings.TrimPrefix(err.Error(), rpcResponseError)}
+	}
+	return err
+}
+
+func (c *rpcPeerClient) ChangeValidators(validators []*ValidatorPowerChange, scheduledHeight uint64, key string) (*ChangeValidatorsResult, error) {
+	res := &ChangeValidatorsResult{}
+	_, err := c.client.Call("change_validators", map[string]interface{}{
+		"validators":       validators,
+		"scheduled_height": scheduledHeight,
+		"key":              key,
+	}, res)
+	return res, peerError(err)
+}
+
+func (c *rpcPeerClient) CancelValidatorChange(key string) error {
+	res := &ValidatorChangeStatusResult{}
+	_, err := c.client.Call("cancel_validator_change", map[string]interface{}{
+		"key": key,
+	}, res)
+	return peerError(err)
+}
+
+func (c *rpcPeerClient) RefuseValidatorHeight(height uint64) error {
+	res := &RefuseValidatorHeightResult{}
+	_, err := c.client.Call("refuse_validator_height", map[string]interface{}{
+		"height": height,
+	}, res)
+	return peerError(err)
+}
+
+func (c *rpcPeerClient) ValidatorSchedule(fromHeight, toHeight uint64) (*ValidatorScheduleResult, error) {
+	res := &ValidatorScheduleResult{}
+	_, err := c.client.Call("validator_schedule", map[string]interface{}{
+		"from_height": fromHeight,
+		"to_height":   toHeight,
+	}, res)
+	return res, err
+}
+
+// Peer is the proxy of another node, to which validator changes are
+// broadcasted
+type Peer struct {
+	Name   string
+	Client PeerClient
+}
+
+// PeerOutcome tells whether a peer scheduled a broadcasted change
+type PeerOutcome string
+
+const (
+	PeerAccepted PeerOutcome = "accepted"
+	PeerRefused  PeerOutcome = "refused"
+	// the peer could not be reached or did not answer, the change
+	// may be scheduled on it
+	PeerUnknown PeerOutcome = "unknown"
+)
+
+// PeerBroadcastStatus is the outcome of a broadcast on a peer
+type PeerBroadcastStatus struct {
+	Peer    string      `json:"peer"`
+	Outcome PeerOutcome `json:"outcome"`
+	// identifier of the change on the peer, if it was accepted
+	ID         uint64 `json:"id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolled_back"`
+	// error while cancelling the change on the peer
+	RollbackError string `json:"rollback_error,omitempty"`
+}
+
+// BroadcastResult is the outcome of BroadcastValidatorChange
+type BroadcastResult struct {
+	// identifier of the local change, and key of the change on all
+	// the proxies
+	ID              uint64                 `json:"id"`
+	Key             string                 `json:"key"`
+	ScheduledHeight uint64                 `json:"scheduled_height"`
+	Committed       bool                   `json:"committed"`
+	Peers           []*PeerBroadcastStatus `json:"peers"`
+	// names of the peers which refused the change, and of the ones
+	// whose outcome is unknown
+	Failed  []string `json:"failed"`
+	Unknown []string `json:"unknown"`
+}
+
+// newBroadcastKey returns a random key for a broadcasted change
+func newBroadcastKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// AddPeer adds a proxy to broadcast the validator changes to
+func (app *ProxyApplication) AddPeer(peer *Peer) {
+	app.peers = append(app.peers, peer)
+}
+
+// BroadcastValidatorChange schedules a validator change, with the
+// operations of ScheduleValidatorPowerChanges, on this proxy and all
+// the peers, under key, or a random one if empty. If any peer fails,
+// the change is cancelled by key everywhere it may be scheduled.
+func (app *ProxyApplication) BroadcastValidatorChange(key string, newValidators []*types.Validator, ops []PowerOp, targetHeight uint64) (*BroadcastResult, error) {
+	validators, err := toValidatorPowerChanges(newValidators)
+	if err != nil {
+		return nil, err
+	}
+	setPowerOps(validators, ops)
+	if len(key) == 0 {
+		if key, err = newBroadcastKey(); err != nil {
+			return nil, err
+		}
+	}
+	local, err := app.ScheduleKeyedValidatorChange(key, newValidators, ops, targetHeight)
+	if err != nil {
+		return nil, err
+	}
+	res := &BroadcastResult{
+		ID:              local.ID,
+		Key:             key,
+		ScheduledHeight: local.ScheduledHeight,
+		Peers:           make([]*PeerBroadcastStatus, len(app.peers)),
+		Failed:          make([]string, 0),
+		Unknown:         make([]string, 0),
+	}
+
+	// peers get the effective height, in case it was bumped
+	var wg sync.WaitGroup
+	for i, p := range app.peers {
+		res.Peers[i] = &PeerBroadcastStatus{Peer: p.Name}
+		wg.Add(1)
+		go func(p *Peer, status *PeerBroadcastStatus) {
+			defer wg.Done()
+			ack, err := p.Client.ChangeValidators(validators, local.ScheduledHeight, key)
+			if _, refused := err.(*PeerRefusal); refused == true {
+				status.Outcome = PeerRefused
+				status.Error = err.Error()
+				return
+			} else if err != nil {
+				status.Outcome = PeerUnknown
+				status.Error = err.Error()
+				return
+			}
+			status.Outcome = PeerAccepted
+			if ack.ScheduledHeight != local.ScheduledHeight {
+				status.Error = fmt.Sprintf("Scheduled at height %d instead of %d", ack.ScheduledHeight, local.ScheduledHeight)
+			}
+			status.ID = ack.ID
+		}(p, res.Peers[i])
+	}
+	wg.Wait()
+
+	for _, status := range res.Peers {
+		switch {
+		case status.Outcome == PeerUnknown:
+			res.Unknown = append(res.Unknown, status.Peer)
+		case len(status.Error) != 0:
+			res.Failed = append(res.Failed, status.Peer)
+		}
+	}
+	if len(res.Failed) == 0 && len(res.Unknown) == 0 {
+		res.Committed = true
+		return res, nil
+	}
+
+	app.logger.Error("validator change broadcast failed, rolling back",
+		"id", local.ID,
+		"key", key,
+		"failed", res.Failed,
+		"unknown", res.Unknown)
+	if _, err := app.CancelValidatorChange(local.ID); err != nil {
+		app.logger.Error("could not cancel the local validator change", "id", local.ID, "error", err)
+	}
+	for i, p := range app.peers {
+		status := res.Peers[i]
+		if status.Outcome == PeerRefused {
+			continue
+		}
+		wg.Add(1)
+		go func(p *Peer, status *PeerBroadcastStatus) {
+			defer wg.Done()
+			if err := p.Client.CancelValidatorChange(key); err != nil {
+				status.RollbackError = err.Error()
+				return
+			}
+			status.RolledBack = true
+		}(p, status)
+	}
+	wg.Wait()
+	return res, nil
+}
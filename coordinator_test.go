@@ -0,0 +1,170 @@
+package abciproxy
+
+import (
+	"fmt"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+// localPeer is a PeerClient calling directly another ProxyApplication
+type localPeer struct {
+	app  *ProxyApplication
+	fail bool
+	// the answer to ChangeValidators is lost after the change is
+	// scheduled
+	lost bool
+}
+
+func (p *localPeer) ChangeValidators(validators []*ValidatorPowerChange, scheduledHeight uint64, key string) (*ChangeValidatorsResult, error) {
+	if p.fail == true {
+		return nil, fmt.Errorf("peer is down")
+	}
+	resolved, ops, err := p.app.resolveValidators(validators)
+	if err != nil {
+		return nil, &PeerRefusal{Msg: err.Error()}
+	}
+	status, err := p.app.ScheduleKeyedValidatorChange(key, resolved, ops, scheduledHeight)
+	if err != nil {
+		return nil, &PeerRefusal{Msg: err.Error()}
+	}
+	if p.lost == true {
+		return nil, fmt.Errorf("timeout")
+	}
+	return &ChangeValidatorsResult{ID: status.ID, Key: status.Key, ScheduledHeight: status.ScheduledHeight}, nil
+}
+
+func (p *localPeer) CancelValidatorChange(key string) error {
+	if p.fail == true {
+		return fmt.Errorf("peer is down")
+	}
+	if _, err := p.app.CancelValidatorChangeByKey(key); err != nil {
+		return &PeerRefusal{Msg: err.Error()}
+	}
+	return nil
+}
+
+func (p *localPeer) RefuseValidatorHeight(height uint64) error {
+	if p.fail == true {
+		return fmt.Errorf("peer is down")
+	}
+	if _, err := p.app.RefuseValidatorHeight(height); err != nil {
+		return &PeerRefusal{Msg: err.Error()}
+	}
+	return nil
+}
+
+func (p *localPeer) ValidatorSchedule(fromHeight, toHeight uint64) (*ValidatorScheduleResult, error) {
+	if p.fail == true {
+		return nil, fmt.Errorf("peer is down")
+	}
+	return p.app.ValidatorSchedule(fromHeight, toHeight), nil
+}
+
+type CoordinatorSuite struct {
+	coordinator *ProxyApplication
+	peers       []*localPeer
+	diffs       []*types.Validator
+}
+
+var _ = Suite(&CoordinatorSuite{})
+
+func newStartedProxy() *ProxyApplication {
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	app.InitChain(nil)
+	return app
+}
+
+func (s *CoordinatorSuite) SetUpTest(c *C) {
+	s.coordinator = newStartedProxy()
+	s.peers = nil
+	for i := 0; i < 2; i++ {
+		p := &localPeer{app: newStartedProxy()}
+		s.peers = append(s.peers, p)
+		s.coordinator.AddPeer(&Peer{Name: fmt.Sprintf("peer%d", i), Client: p})
+	}
+	s.diffs = []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+}
+
+func (s *CoordinatorSuite) TestBroadcastsToAllPeers(c *C) {
+	res, err := s.coordinator.BroadcastValidatorChange("", s.diffs, nil, 2)
+	c.Assert(err, IsNil)
+	c.Check(res.Committed, Equals, true)
+	c.Assert(res.Peers, HasLen, 2)
+
+	for i, app := range []*ProxyApplication{s.coordinator, s.peers[0].app, s.peers[1].app} {
+		app.EndBlock(1)
+		c.Check(app.EndBlock(2).Diffs, DeepEquals, s.diffs, Commentf("node %d", i))
+	}
+}
+
+func (s *CoordinatorSuite) TestRollsBackIfAPeerFails(c *C) {
+	s.peers[1].fail = true
+	res, err := s.coordinator.BroadcastValidatorChange("", s.diffs, nil, 2)
+	c.Assert(err, IsNil)
+	c.Check(res.Committed, Equals, false)
+	c.Check(res.Peers[0].Outcome, Equals, PeerAccepted)
+	c.Check(res.Peers[0].RolledBack, Equals, true)
+	c.Check(res.Peers[1].Outcome, Equals, PeerUnknown)
+	c.Check(res.Peers[1].Error, Equals, "peer is down")
+	c.Check(res.Peers[1].RolledBack, Equals, false)
+	c.Check(res.Peers[1].RollbackError, Equals, "peer is down")
+	c.Check(res.Failed, HasLen, 0)
+	c.Check(res.Unknown, DeepEquals, []string{"peer1"})
+
+	status, err := s.coordinator.ValidatorChangeStatus(res.ID)
+	c.Assert(err, IsNil)
+	c.Check(status.Status, Equals, ChangeCancelled)
+
+	for i, app := range []*ProxyApplication{s.coordinator, s.peers[0].app, s.peers[1].app} {
+		app.EndBlock(1)
+		c.Check(app.EndBlock(2).Diffs, HasLen, 0, Commentf("node %d", i))
+	}
+}
+
+func (s *CoordinatorSuite) TestRollsBackPeersWithUnknownOutcome(c *C) {
+	s.peers[0].lost = true
+	// peer1 already used the key
+	_, err := s.peers[1].app.ScheduleKeyedValidatorChange("k1", s.diffs, nil, 3)
+	c.Assert(err, IsNil)
+
+	res, err := s.coordinator.BroadcastValidatorChange("k1", s.diffs, nil, 2)
+	c.Assert(err, IsNil)
+	c.Check(res.Committed, Equals, false)
+	c.Check(res.Key, Equals, "k1")
+	c.Check(res.Peers[0].Outcome, Equals, PeerUnknown)
+	c.Check(res.Peers[0].RolledBack, Equals, true)
+	c.Check(res.Peers[1].Outcome, Equals, PeerRefused)
+	c.Check(res.Peers[1].RolledBack, Equals, false)
+	c.Check(res.Failed, DeepEquals, []string{"peer1"})
+	c.Check(res.Unknown, DeepEquals, []string{"peer0"})
+
+	for i, app := range []*ProxyApplication{s.coordinator, s.peers[0].app} {
+		app.EndBlock(1)
+		c.Check(app.EndBlock(2).Diffs, HasLen, 0, Commentf("node %d", i))
+	}
+	// the change of peer1 with the same key is untouched
+	pending := s.peers[1].app.PendingValidatorChanges()
+	c.Assert(pending, HasLen, 1)
+	c.Check(pending[0].ScheduledHeight, Equals, uint64(3))
+}
+
+func (s *CoordinatorSuite) TestCancelsOnlyTheChangeOfTheKey(c *C) {
+	// a restarted peer gives the same IDs to other changes
+	restarted := newStartedProxy()
+	other, err := restarted.ScheduleValidatorChange(s.diffs, 3)
+	c.Assert(err, IsNil)
+	c.Check(other.ID, Equals, uint64(1))
+
+	_, err = restarted.CancelValidatorChangeByKey("k1")
+	c.Check(err, ErrorMatches, "Unknown validator change key k1")
+	c.Check(restarted.PendingValidatorChanges(), HasLen, 1)
+}
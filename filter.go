@@ -0,0 +1,337 @@
+package abciproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/tendermint/abci/types"
+)
+
+// TxFilter decides if a tx is admitted by CheckTx. It should return
+// types.OK to let the tx through.
+type TxFilter interface {
+	Name() string
+	Filter(tx []byte) types.Result
+}
+
+// MaxTxSizeFilter rejects txs bigger than a given size
+type MaxTxSizeFilter struct {
+	MaxSize int
+}
+
+func (f *MaxTxSizeFilter) Name() string {
+	return "max_tx_size"
+}
+
+func (f *MaxTxSizeFilter) Filter(tx []byte) types.Result {
+	if len(tx) > f.MaxSize {
+		return types.ErrEncodingError.SetLog(fmt.Sprintf("Max tx size is %d bytes, got %d", f.MaxSize, len(tx)))
+	}
+	return types.OK
+}
+
+// PrefixFilter rejects txs starting with a denied prefix. If Allow is
+// not empty, txs should also start with one of these.
+type PrefixFilter struct {
+	Allow [][]byte
+	Deny  [][]byte
+}
+
+func (f *PrefixFilter) Name() string {
+	return "prefix"
+}
+
+func (f *PrefixFilter) Filter(tx []byte) types.Result {
+	for _, p := range f.Deny {
+		if bytes.HasPrefix(tx, p) {
+			return types.ErrUnauthorized.SetLog(fmt.Sprintf("Tx prefix %q is denied", p))
+		}
+	}
+	if len(f.Allow) == 0 {
+		return types.OK
+	}
+	for _, p := range f.Allow {
+		if bytes.HasPrefix(tx, p) {
+			return types.OK
+		}
+	}
+	return types.ErrUnauthorized.SetLog("Tx prefix is not allowed")
+}
+
+// PatternFilter rejects txs matching any of the regular expressions
+// or containing any of the byte patterns
+type PatternFilter struct {
+	Regexps []*regexp.Regexp
+	Bytes   [][]byte
+}
+
+func (f *PatternFilter) Name() string {
+	return "pattern"
+}
+
+func (f *PatternFilter) Filter(tx []byte) types.Result {
+	for _, r := range f.Regexps {
+		if r.Match(tx) {
+			return types.ErrUnauthorized.SetLog(fmt.Sprintf("Tx matches denied pattern %q", r.String()))
+		}
+	}
+	for _, b := range f.Bytes {
+		if bytes.Contains(tx, b) {
+			return types.ErrUnauthorized.SetLog(fmt.Sprintf("Tx contains denied bytes %X", b))
+		}
+	}
+	return types.OK
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimitFilter rejects a tx seen more than Count times during
+// Period. Txs are identified by the hash of their content.
+type RateLimitFilter struct {
+	Count  int
+	Period time.Duration
+
+	mtx     sync.Mutex
+	windows map[[sha256.Size]byte]*rateWindow
+	// finished windows are pruned at most once per period
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewRateLimitFilter(count int, period time.Duration) *RateLimitFilter {
+	return &RateLimitFilter{
+		Count:   count,
+		Period:  period,
+		windows: make(map[[sha256.Size]byte]*rateWindow),
+		now:     time.Now,
+	}
+}
+
+func (f *RateLimitFilter) Name() string {
+	return "rate_limit"
+}
+
+func (f *RateLimitFilter) Filter(tx []byte) types.Result {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	now := f.now()
+	key := sha256.Sum256(tx)
+
+	if now.Sub(f.lastPrune) > f.Period {
+		f.prune(now)
+		f.lastPrune = now
+	}
+	w, ok := f.windows[key]
+	if ok == false || now.Sub(w.start) > f.Period {
+		w = &rateWindow{start: now}
+		f.windows[key] = w
+	}
+	w.count++
+	if w.count > f.Count {
+		return types.ErrUnauthorized.SetLog(fmt.Sprintf("Tx seen more than %d times in %s", f.Count, f.Period))
+	}
+	return types.OK
+}
+
+// prune removes all finished windows. Lock should be held.
+func (f *RateLimitFilter) prune(now time.Time) {
+	for k, w := range f.windows {
+		if now.Sub(w.start) > f.Period {
+			delete(f.windows, k)
+		}
+	}
+}
+
+type txFilterFile struct {
+	MaxTxSize     int      `json:"max_tx_size"`
+	AllowPrefixes []string `json:"allow_prefixes"`
+	DenyPrefixes  []string `json:"deny_prefixes"`
+	DenyPatterns  []string `json:"deny_patterns"`
+	DenyBytes     []string `json:"deny_bytes"`
+	RateLimit     *struct {
+		Count  int    `json:"count"`
+		Period string `json:"period"`
+	} `json:"rate_limit"`
+}
+
+// LoadTxFilters reads the tx filters from a JSON file (see README.md
+// for its format)
+func LoadTxFilters(path string) ([]TxFilter, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f txFilterFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("Could not parse tx filters %s: %s", path, err)
+	}
+
+	var res []TxFilter
+	if f.MaxTxSize > 0 {
+		res = append(res, &MaxTxSizeFilter{MaxSize: f.MaxTxSize})
+	}
+
+	if len(f.AllowPrefixes) != 0 || len(f.DenyPrefixes) != 0 {
+		pf := &PrefixFilter{}
+		for _, p := range f.AllowPrefixes {
+			pf.Allow = append(pf.Allow, []byte(p))
+		}
+		for _, p := range f.DenyPrefixes {
+			pf.Deny = append(pf.Deny, []byte(p))
+		}
+		res = append(res, pf)
+	}
+
+	if len(f.DenyPatterns) != 0 || len(f.DenyBytes) != 0 {
+		pf := &PatternFilter{}
+		for _, p := range f.DenyPatterns {
+			r, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid deny pattern %q: %s", p, err)
+			}
+			pf.Regexps = append(pf.Regexps, r)
+		}
+		for _, b := range f.DenyBytes {
+			decoded, err := hex.DecodeString(b)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid deny bytes %q: %s", b, err)
+			}
+			pf.Bytes = append(pf.Bytes, decoded)
+		}
+		res = append(res, pf)
+	}
+
+	if f.RateLimit != nil {
+		period, err := time.ParseDuration(f.RateLimit.Period)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rate limit period %q: %s", f.RateLimit.Period, err)
+		}
+		if f.RateLimit.Count <= 0 {
+			return nil, fmt.Errorf("Rate limit count should be positive, got %d", f.RateLimit.Count)
+		}
+		res = append(res, NewRateLimitFilter(f.RateLimit.Count, period))
+	}
+
+	return res, nil
+}
+
+// number of blocks an admitted tx is remembered without being checked
+// again. Tendermint rechecks the txs of its mempool after every block,
+// so the txs not rechecked since were evicted.
+const mempoolTxExpiry = 2
+
+// txFilterChain applies all filters in order, and counts rejections
+type txFilterChain struct {
+	mtx      sync.Mutex
+	filters  []TxFilter
+	checked  uint64
+	rejected map[string]uint64
+	// hashes of the txs admitted in the mempool and not delivered yet,
+	// with the height they were last checked at. Tendermint checks
+	// them again after every block: they already passed the filters,
+	// and should not count against the rate limit.
+	mempool map[[sha256.Size]byte]uint64
+	// height of the last block
+	height uint64
+}
+
+func newTxFilterChain() *txFilterChain {
+	return &txFilterChain{
+		rejected: make(map[string]uint64),
+		mempool:  make(map[[sha256.Size]byte]uint64),
+	}
+}
+
+func (ch *txFilterChain) add(f TxFilter) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	ch.filters = append(ch.filters, f)
+}
+
+func (ch *txFilterChain) filter(tx []byte) types.Result {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	if _, ok := ch.mempool[sha256.Sum256(tx)]; len(ch.filters) == 0 || ok == true {
+		return types.OK
+	}
+	ch.checked++
+	for _, f := range ch.filters {
+		if res := f.Filter(tx); res.IsErr() {
+			ch.rejected[f.Name()]++
+			return res
+		}
+	}
+	return types.OK
+}
+
+// checkedTx records the final CheckTx result of tx: the mempool only
+// keeps the admitted txs
+func (ch *txFilterChain) checkedTx(tx []byte, res types.Result) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	if len(ch.filters) == 0 {
+		return
+	}
+	if res.IsOK() {
+		ch.mempool[sha256.Sum256(tx)] = ch.height
+	} else {
+		delete(ch.mempool, sha256.Sum256(tx))
+	}
+}
+
+// delivered removes tx from the mempool
+func (ch *txFilterChain) delivered(tx []byte) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	delete(ch.mempool, sha256.Sum256(tx))
+}
+
+// endBlock forgets the txs which were not checked again during the
+// last blocks, as they are no longer in the mempool
+func (ch *txFilterChain) endBlock(height uint64) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	ch.height = height
+	for hash, checked := range ch.mempool {
+		if checked+mempoolTxExpiry < height {
+			delete(ch.mempool, hash)
+		}
+	}
+}
+
+// TxFilterStats are the CheckTx admission counters
+type TxFilterStats struct {
+	Checked  uint64            `json:"checked"`
+	Rejected map[string]uint64 `json:"rejected"`
+}
+
+// AddTxFilter appends f to the filters applied by CheckTx
+func (app *ProxyApplication) AddTxFilter(f TxFilter) {
+	app.txFilters.add(f)
+}
+
+// TxFilterStats returns how many txs were checked, and how many were
+// rejected by each filter
+func (app *ProxyApplication) TxFilterStats() TxFilterStats {
+	ch := app.txFilters
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	res := TxFilterStats{
+		Checked:  ch.checked,
+		Rejected: make(map[string]uint64, len(ch.rejected)),
+	}
+	for k, v := range ch.rejected {
+		res.Rejected[k] = v
+	}
+	return res
+}
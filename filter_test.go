@@ -0,0 +1,127 @@
+package abciproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type FilterSuite struct {
+	testApplication *TestApplication
+	app             *ProxyApplication
+}
+
+var _ = Suite(&FilterSuite{})
+
+const testTxFilters = `{
+	"max_tx_size": 16,
+	"allow_prefixes": ["app/", "other/"],
+	"deny_prefixes": ["other/"],
+	"deny_patterns": ["^app/spam[0-9]+$"],
+	"deny_bytes": ["ff00"],
+	"rate_limit": { "count": 2, "period": "1h" }
+}`
+
+func (s *FilterSuite) SetUpTest(c *C) {
+	f, err := ioutil.TempFile("", "abci_proxy_filters")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(testTxFilters)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	filters, err := LoadTxFilters(f.Name())
+	c.Assert(err, IsNil)
+	c.Assert(filters, HasLen, 4)
+
+	s.testApplication = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+	for _, f := range filters {
+		s.app.AddTxFilter(f)
+	}
+}
+
+func (s *FilterSuite) TestRejectedTxsDoNotReachTheApplication(c *C) {
+	c.Check(s.app.CheckTx([]byte("app/this is way too long")).Code, Equals, types.CodeType_EncodingError)
+	c.Check(s.app.CheckTx([]byte("nope/")).Code, Equals, types.CodeType_Unauthorized)
+	c.Check(s.app.CheckTx([]byte("other/")).Code, Equals, types.CodeType_Unauthorized)
+	c.Check(s.app.CheckTx([]byte("app/spam42")).Code, Equals, types.CodeType_Unauthorized)
+	c.Check(s.app.CheckTx([]byte("app/\xff\x00")).Code, Equals, types.CodeType_Unauthorized)
+	c.Check(s.testApplication.CheckTxCalls.Calls, HasLen, 0)
+
+	c.Check(s.app.CheckTx([]byte("app/ok")).IsOK(), Equals, true)
+	c.Check(s.testApplication.CheckTxCalls.Calls, HasLen, 1)
+
+	stats := s.app.TxFilterStats()
+	c.Check(stats.Checked, Equals, uint64(6))
+	c.Check(stats.Rejected, DeepEquals, map[string]uint64{
+		"max_tx_size": 1,
+		"prefix":      2,
+		"pattern":     2,
+	})
+}
+
+func (s *FilterSuite) TestRechecksAreNotRateLimited(c *C) {
+	tx := []byte("app/a")
+	// Tendermint rechecks the txs still in the mempool after each block
+	for i := 0; i < 3; i++ {
+		c.Check(s.app.CheckTx(tx).IsOK(), Equals, true)
+	}
+	c.Check(s.app.TxFilterStats().Checked, Equals, uint64(1))
+
+	s.app.DeliverTx(tx)
+	c.Check(s.app.CheckTx(tx).IsOK(), Equals, true)
+	s.app.DeliverTx(tx)
+	c.Check(s.app.CheckTx(tx).Code, Equals, types.CodeType_Unauthorized)
+	c.Check(s.app.TxFilterStats().Rejected["rate_limit"], Equals, uint64(1))
+}
+
+func (s *FilterSuite) TestEvictedTxsAreFilteredAgain(c *C) {
+	tx := []byte("app/a")
+	c.Check(s.app.CheckTx(tx).IsOK(), Equals, true)
+	s.app.EndBlock(1)
+	// rechecked after block 1, then evicted from the mempool
+	c.Check(s.app.CheckTx(tx).IsOK(), Equals, true)
+	for h := uint64(2); h <= 4; h++ {
+		s.app.EndBlock(h)
+	}
+	c.Check(s.app.txFilters.mempool, HasLen, 0)
+
+	c.Check(s.app.CheckTx(tx).IsOK(), Equals, true)
+	c.Check(s.app.TxFilterStats().Checked, Equals, uint64(2))
+}
+
+func (s *FilterSuite) TestRateLimit(c *C) {
+	f := NewRateLimitFilter(2, time.Minute)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	c.Check(f.Filter([]byte("a")).IsOK(), Equals, true)
+	c.Check(f.Filter([]byte("a")).IsOK(), Equals, true)
+	c.Check(f.Filter([]byte("b")).IsOK(), Equals, true)
+	c.Check(f.Filter([]byte("a")).Code, Equals, types.CodeType_Unauthorized)
+
+	now = now.Add(2 * time.Minute)
+	c.Check(f.Filter([]byte("a")).IsOK(), Equals, true)
+	// "b" window was pruned
+	c.Check(f.windows, HasLen, 1)
+
+	// finished windows are only pruned once per period
+	now = now.Add(30 * time.Second)
+	c.Check(f.Filter([]byte("c")).IsOK(), Equals, true)
+	now = now.Add(31 * time.Second)
+	c.Check(f.Filter([]byte("d")).IsOK(), Equals, true)
+	c.Check(f.windows, HasLen, 2)
+	now = now.Add(40 * time.Second)
+	c.Check(f.Filter([]byte("e")).IsOK(), Equals, true)
+	// "c" window is finished, but kept until the next prune
+	c.Check(f.windows, HasLen, 3)
+	now = now.Add(30 * time.Second)
+	c.Check(f.Filter([]byte("f")).IsOK(), Equals, true)
+	c.Check(f.windows, HasLen, 2)
+}
@@ -0,0 +1,141 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/tendermint/abci/types"
+)
+
+// GenesisMode tells how the genesis validators are combined with the
+// ones of a GenesisConfig
+type GenesisMode string
+
+const (
+	// the genesis validators are replaced
+	GenesisOverride GenesisMode = "override"
+	// the configured validators are added to the genesis ones, or
+	// change their power
+	GenesisAugment GenesisMode = "augment"
+)
+
+// GenesisConfig changes the initial validator set given to InitChain.
+// A validator with a power of 0 is an observer: it is not part of the
+// initial set, and can be promoted later with a validator change.
+type GenesisConfig struct {
+	Mode       GenesisMode             `json:"mode"`
+	Validators []*ValidatorPowerChange `json:"validators"`
+}
+
+// LoadGenesisConfig reads a genesis configuration from a JSON file of
+// the form {"mode": "override", "validators": [{"pub_key": <pub_key>,
+// "power": 10}...]}
+func LoadGenesisConfig(path string) (*GenesisConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := &GenesisConfig{}
+	if err := json.Unmarshal(content, res); err != nil {
+		return nil, fmt.Errorf("Could not parse genesis configuration %s: %s", path, err)
+	}
+	return res, nil
+}
+
+// Validate checks the mode and the validators of the configuration
+func (cfg *GenesisConfig) Validate() error {
+	if cfg.Mode != GenesisOverride && cfg.Mode != GenesisAugment {
+		return fmt.Errorf("Unknown genesis mode %q, expected %s or %s", cfg.Mode, GenesisOverride, GenesisAugment)
+	}
+	seen := make(map[string]bool)
+	for _, v := range cfg.Validators {
+		if v.PubKey.Empty() == true {
+			return fmt.Errorf("Genesis validators require a public key")
+		}
+		key := hex.EncodeToString(v.PubKey.Bytes())
+		if seen[key] == true {
+			return fmt.Errorf("Genesis validator %X is listed twice", v.PubKey.Bytes())
+		}
+		seen[key] = true
+	}
+	if cfg.Mode == GenesisOverride && len(cfg.apply(nil)) == 0 {
+		return fmt.Errorf("The genesis validator set would have no voting power")
+	}
+	return nil
+}
+
+// apply returns the initial validator set resulting from the genesis
+// validators, ordered by public key
+func (cfg *GenesisConfig) apply(genesis []*types.Validator) []*types.Validator {
+	vs := newValidatorSet()
+	if cfg.Mode == GenesisAugment {
+		vs.reset(genesis)
+	}
+	vs.apply(toABCIValidators(cfg.Validators))
+	return vs.list()
+}
+
+// genesisDiffs returns the diffs moving tendermint from the genesis
+// validators to the initial set
+func genesisDiffs(genesis, initial []*types.Validator) []*types.Validator {
+	powers := make(map[string]uint64, len(genesis))
+	for _, v := range genesis {
+		powers[hex.EncodeToString(v.PubKey)] = v.Power
+	}
+	var res []*types.Validator
+	for _, v := range initial {
+		key := hex.EncodeToString(v.PubKey)
+		if powers[key] != v.Power {
+			res = append(res, v)
+		}
+		delete(powers, key)
+	}
+	removed := make([]string, 0, len(powers))
+	for key, power := range powers {
+		if power != 0 {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		pubKey, _ := hex.DecodeString(key)
+		res = append(res, &types.Validator{PubKey: pubKey, Power: 0})
+	}
+	return res
+}
+
+// SetGenesisConfig makes InitChain change the genesis validators
+// according to cfg. The target application gets the resulting set,
+// and as tendermint still starts with the genesis one, the difference
+// is emitted by the EndBlock of the first block.
+func (app *ProxyApplication) SetGenesisConfig(cfg *GenesisConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	app.genesis = cfg
+	return nil
+}
+
+// initialValidators returns the validator set the chain starts with,
+// and schedules the diffs tendermint needs to reach it.
+func (app *ProxyApplication) initialValidators(genesis []*types.Validator) []*types.Validator {
+	if app.genesis == nil {
+		return genesis
+	}
+	initial := app.genesis.apply(genesis)
+	diffs := genesisDiffs(genesis, initial)
+	if len(diffs) != 0 {
+		app.logger.Info("changed the genesis validators",
+			"mode", app.genesis.Mode,
+			"genesis", len(genesis),
+			"validators", len(initial))
+		app.scheduleChange(ValidatorSetChange{
+			Diffs:           diffs,
+			ScheduledHeight: 1,
+		})
+	}
+	return initial
+}
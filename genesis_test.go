@@ -0,0 +1,111 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type GenesisSuite struct {
+	testApplication *TestApplication
+	app             *ProxyApplication
+	keys            []crypto.PubKey
+}
+
+var _ = Suite(&GenesisSuite{})
+
+func (s *GenesisSuite) SetUpTest(c *C) {
+	s.testApplication = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+	s.keys = nil
+	for i := 0; i < 3; i++ {
+		s.keys = append(s.keys, crypto.GenPrivKeyEd25519().Wrap().PubKey())
+	}
+}
+
+func (s *GenesisSuite) validator(i int, power uint64) *types.Validator {
+	return &types.Validator{PubKey: s.keys[i].Bytes(), Power: power}
+}
+
+// powers indexes the voting powers of validators by public key
+func powers(validators []*types.Validator) map[string]uint64 {
+	res := make(map[string]uint64, len(validators))
+	for _, v := range validators {
+		res[hex.EncodeToString(v.PubKey)] = v.Power
+	}
+	return res
+}
+
+func (s *GenesisSuite) TestOverridesGenesisValidators(c *C) {
+	c.Assert(s.app.SetGenesisConfig(&GenesisConfig{
+		Mode: GenesisOverride,
+		Validators: []*ValidatorPowerChange{
+			{PubKey: s.keys[0], Power: 5},
+			{PubKey: s.keys[2], Power: 10},
+		},
+	}), IsNil)
+	s.app.InitChain([]*types.Validator{s.validator(0, 10), s.validator(1, 10)})
+
+	initial := powers([]*types.Validator{s.validator(0, 5), s.validator(2, 10)})
+	c.Check(powers(s.app.Validators()), DeepEquals, initial)
+	c.Assert(s.testApplication.InitChainCalls.Calls, HasLen, 1)
+	forwarded := s.testApplication.InitChainCalls.Calls[0][0].([]*types.Validator)
+	c.Check(powers(forwarded), DeepEquals, initial)
+
+	// tendermint catches up with the first block
+	diffs := s.app.EndBlock(1).Diffs
+	c.Check(powers(diffs), DeepEquals, powers([]*types.Validator{
+		s.validator(0, 5), s.validator(1, 0), s.validator(2, 10),
+	}))
+	c.Check(powers(s.app.Validators()), DeepEquals, initial)
+}
+
+func (s *GenesisSuite) TestAugmentsGenesisValidators(c *C) {
+	c.Assert(s.app.SetGenesisConfig(&GenesisConfig{
+		Mode: GenesisAugment,
+		Validators: []*ValidatorPowerChange{
+			// an observer, to promote later
+			{PubKey: s.keys[1], Power: 0},
+			{PubKey: s.keys[2], Power: 3},
+		},
+	}), IsNil)
+	s.app.InitChain([]*types.Validator{s.validator(0, 10), s.validator(1, 10)})
+
+	c.Check(powers(s.app.Validators()), DeepEquals, powers([]*types.Validator{
+		s.validator(0, 10), s.validator(2, 3),
+	}))
+	c.Check(powers(s.app.EndBlock(1).Diffs), DeepEquals, powers([]*types.Validator{
+		s.validator(1, 0), s.validator(2, 3),
+	}))
+}
+
+func (s *GenesisSuite) TestGenesisIsKeptWithoutConfig(c *C) {
+	genesis := []*types.Validator{s.validator(0, 10)}
+	s.app.InitChain(genesis)
+	c.Check(s.testApplication.InitChainCalls.Calls[0][0], DeepEquals, genesis)
+	c.Check(s.app.EndBlock(1).Diffs, HasLen, 0)
+}
+
+func (s *GenesisSuite) TestValidatesConfig(c *C) {
+	err := s.app.SetGenesisConfig(&GenesisConfig{Mode: "replace"})
+	c.Check(err, ErrorMatches, "Unknown genesis mode \"replace\".*")
+
+	err = s.app.SetGenesisConfig(&GenesisConfig{
+		Mode:       GenesisOverride,
+		Validators: []*ValidatorPowerChange{{PubKey: s.keys[0], Power: 0}},
+	})
+	c.Check(err, ErrorMatches, "The genesis validator set would have no voting power")
+
+	err = s.app.SetGenesisConfig(&GenesisConfig{
+		Mode: GenesisAugment,
+		Validators: []*ValidatorPowerChange{
+			{PubKey: s.keys[0], Power: 1},
+			{PubKey: s.keys[0], Power: 2},
+		},
+	})
+	c.Check(err, ErrorMatches, "Genesis validator .* is listed twice")
+}
@@ -0,0 +1,391 @@
+package abciproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+)
+
+const (
+	GovernanceTxPropose = "propose"
+	GovernanceTxVote    = "vote"
+)
+
+// GovernanceTx is the payload, following the governance prefix, of a
+// transaction proposing or voting for a validator change. A proposal
+// counts as the vote of its author. Signature is always made on the
+// proposal GovernanceSignBytes.
+type GovernanceTx struct {
+	Type string `json:"type"`
+	// for proposals
+	Validators      []*ValidatorPowerChange `json:"validators,omitempty"`
+	ScheduledHeight uint64                  `json:"scheduled_height,omitempty"`
+	// for votes, the hex hash of the proposal
+	Proposal string `json:"proposal,omitempty"`
+
+	PubKey    crypto.PubKey    `json:"pub_key"`
+	Signature crypto.Signature `json:"signature"`
+}
+
+// GovernanceProposal is a validator change decided on-chain
+type GovernanceProposal struct {
+	Hash            []byte
+	Validators      []*types.Validator
+	ScheduledHeight uint64
+	Status          ProposalStatus
+	// KeyString() of the voters, in the order of their vote
+	Voters []string
+}
+
+// GovernanceSignBytes are the bytes operators should sign to propose
+// or vote for a validator change on-chain
+func GovernanceSignBytes(validators []*types.Validator, scheduledHeight uint64) []byte {
+	p := ValidatorChangeProposal{
+		Validators:      validators,
+		ScheduledHeight: scheduledHeight,
+	}
+	return p.actionBytes("governance")
+}
+
+// GovernanceProposalHash identifies a validator change on-chain
+func GovernanceProposalHash(validators []*types.Validator, scheduledHeight uint64) []byte {
+	h := sha256.Sum256(GovernanceSignBytes(validators, scheduledHeight))
+	return h[:]
+}
+
+func (p *GovernanceProposal) hasVoted(pubKey crypto.PubKey) bool {
+	for _, v := range p.Voters {
+		if v == pubKey.KeyString() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *GovernanceProposal) copy() *GovernanceProposal {
+	res := *p
+	res.Voters = append([]string{}, p.Voters...)
+	return &res
+}
+
+// governance holds the state of on-chain validator changes. It is only
+// modified by DeliverTx and EndBlock, so all nodes processing the same
+// blocks reach the same state.
+type governance struct {
+	mtx    sync.Mutex
+	app    *ProxyApplication
+	policy *ApprovalPolicy
+	// indexed by hex hash, order keeps their order of appearance
+	proposals map[string]*GovernanceProposal
+	order     []string
+
+	// file the state is saved in at every Commit, empty if disabled
+	path string
+	// states saved at the last two commits
+	states []*governanceState
+}
+
+// governanceState is the governance state after the commit of a block
+type governanceState struct {
+	Height    uint64                `json:"height"`
+	Proposals []*GovernanceProposal `json:"proposals"`
+	// validator changes scheduled but not emitted yet
+	Changes []ValidatorSetChange `json:"changes"`
+}
+
+// governanceStateFile keeps the states of the last two commits: if the
+// target application did not commit the last block before a crash,
+// Tendermint replays it from the previous state.
+type governanceStateFile struct {
+	States []*governanceState `json:"states"`
+}
+
+// EnableGovernance makes the proxy decide validator changes from
+// transactions starting with prefix, signed by the operators of
+// policy. Scheduling validator changes through the RPC is then
+// disabled.
+func (app *ProxyApplication) EnableGovernance(prefix []byte, policy *ApprovalPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	if app.approvals != nil {
+		return fmt.Errorf("Governance mode cannot be used with off-chain approval")
+	}
+	g := &governance{
+		app:       app,
+		policy:    policy,
+		proposals: make(map[string]*GovernanceProposal),
+	}
+	if err := app.RegisterTxHandler(prefix, g); err != nil {
+		return err
+	}
+	app.governance = g
+	return nil
+}
+
+// resolve decodes tx payload and checks its signature. It returns the
+// (possibly new, in which case it is not yet registered) proposal the
+// tx refers to. Lock should be held.
+func (g *governance) resolve(tx []byte) (*GovernanceProposal, *GovernanceTx, types.Result) {
+	gtx := &GovernanceTx{}
+	if err := json.Unmarshal(tx, gtx); err != nil {
+		return nil, nil, types.ErrEncodingError.SetLog(fmt.Sprintf("Could not decode governance tx: %s", err))
+	}
+	if gtx.PubKey.Empty() == true {
+		return nil, nil, types.ErrEncodingError.SetLog("Governance txs require the public key of their signer")
+	}
+	for _, v := range gtx.Validators {
+		if v.PubKey.Empty() == true {
+			return nil, nil, types.ErrEncodingError.SetLog("Governance proposal validators require a public key")
+		}
+	}
+
+	var p *GovernanceProposal
+	switch gtx.Type {
+	case GovernanceTxPropose:
+		for _, v := range gtx.Validators {
+			if len(v.Op) != 0 && v.Op != PowerSet {
+				return nil, nil, types.ErrEncodingError.SetLog(fmt.Sprintf("Governance proposals only support absolute voting powers, got %s", v.Op))
+			}
+		}
+		validators := toABCIValidators(gtx.Validators)
+		hash := GovernanceProposalHash(validators, gtx.ScheduledHeight)
+		if existing, ok := g.proposals[hex.EncodeToString(hash)]; ok == true {
+			p = existing
+		} else {
+			p = &GovernanceProposal{
+				Hash:            hash,
+				Validators:      validators,
+				ScheduledHeight: gtx.ScheduledHeight,
+				Status:          ProposalPending,
+			}
+		}
+	case GovernanceTxVote:
+		existing, ok := g.proposals[gtx.Proposal]
+		if ok == false {
+			return nil, nil, types.ErrUnknownRequest.SetLog(fmt.Sprintf("Unknown governance proposal %s", gtx.Proposal))
+		}
+		p = existing
+	default:
+		return nil, nil, types.ErrUnknownRequest.SetLog(fmt.Sprintf("Unknown governance tx type %q", gtx.Type))
+	}
+
+	if g.policy.isOperator(gtx.PubKey) == false {
+		return nil, nil, types.ErrUnauthorized.SetLog(fmt.Sprintf("%s is not a governance operator", gtx.PubKey.KeyString()))
+	}
+	if gtx.PubKey.VerifyBytes(GovernanceSignBytes(p.Validators, p.ScheduledHeight), gtx.Signature) == false {
+		return nil, nil, types.ErrUnauthorized.SetLog("Invalid governance tx signature")
+	}
+	if p.Status != ProposalPending {
+		return nil, nil, types.ErrUnauthorized.SetLog(fmt.Sprintf("Governance proposal %X is %s", p.Hash, p.Status))
+	}
+	if p.hasVoted(gtx.PubKey) {
+		return nil, nil, types.ErrUnauthorized.SetLog(fmt.Sprintf("%s already voted for %X", gtx.PubKey.KeyString(), p.Hash))
+	}
+	return p, gtx, types.OK
+}
+
+func (g *governance) CheckTx(tx []byte) types.Result {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	p, _, res := g.resolve(tx)
+	if res.IsErr() {
+		return res
+	}
+	return types.NewResultOK(p.Hash, "")
+}
+
+func (g *governance) DeliverTx(tx []byte) types.Result {
+	app := g.app
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	p, gtx, res := g.resolve(tx)
+	if res.IsErr() {
+		return res
+	}
+
+	height := app.currentBlockHeight()
+	key := hex.EncodeToString(p.Hash)
+	if _, ok := g.proposals[key]; ok == false {
+		if p.ScheduledHeight <= height {
+			return types.ErrUnauthorized.SetLog(fmt.Sprintf("Could not schedule for a block height back in time (wanted:%d, current:%d)", p.ScheduledHeight, height))
+		}
+		g.proposals[key] = p
+		g.order = append(g.order, key)
+		app.logger.Info("new governance proposal", "hash", key, "targetHeight", p.ScheduledHeight)
+	}
+	p.Voters = append(p.Voters, gtx.PubKey.KeyString())
+
+	if len(p.Voters) < g.policy.Threshold {
+		return types.NewResultOK(p.Hash, fmt.Sprintf("vote recorded (%d/%d)", len(p.Voters), g.policy.Threshold))
+	}
+
+	if p.ScheduledHeight <= height {
+		p.Status = ProposalExpired
+		return types.ErrUnauthorized.SetLog(fmt.Sprintf("Governance proposal %X reached quorum too late (wanted:%d, current:%d)", p.Hash, p.ScheduledHeight, height))
+	}
+	p.Status = ProposalApproved
+	app.scheduleChange(ValidatorSetChange{
+		Diffs:           p.Validators,
+		ScheduledHeight: p.ScheduledHeight,
+	})
+	app.logger.Info("governance proposal approved", "hash", key, "targetHeight", p.ScheduledHeight)
+	return types.NewResultOK(p.Hash, "proposal approved")
+}
+
+// expireGovernanceProposals expires all pending proposals which could
+// not be applied after height
+func (app *ProxyApplication) expireGovernanceProposals(height uint64) {
+	g := app.governance
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for _, key := range g.order {
+		p := g.proposals[key]
+		if p.Status == ProposalPending && p.ScheduledHeight <= height {
+			p.Status = ProposalExpired
+		}
+	}
+}
+
+// GovernanceProposals returns all the proposals seen on-chain, in
+// their order of appearance
+func (app *ProxyApplication) GovernanceProposals() []*GovernanceProposal {
+	if app.governance == nil {
+		return nil
+	}
+	g := app.governance
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	res := make([]*GovernanceProposal, 0, len(g.order))
+	for _, key := range g.order {
+		res = append(res, g.proposals[key].copy())
+	}
+	return res
+}
+
+// EnableGovernanceState saves the governance proposals, and the changes
+// they scheduled, in path at every Commit. They are restored from it
+// when the proxy restarts, as the blocks with the governance txs are
+// not replayed by Tendermint.
+func (app *ProxyApplication) EnableGovernanceState(path string) error {
+	g := app.governance
+	if g == nil {
+		return fmt.Errorf("Governance mode is not enabled")
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	var f governanceStateFile
+	if err == nil {
+		if err := json.Unmarshal(content, &f); err != nil {
+			return fmt.Errorf("Could not parse governance state %s: %s", path, err)
+		}
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.path = path
+	g.states = f.States
+	return nil
+}
+
+// saveGovernanceState saves the state after the commit of height. It
+// panics on error: the votes of the block would be lost on restart,
+// and the proxy would no longer emit the same diffs as the others.
+func (app *ProxyApplication) saveGovernanceState(height uint64) {
+	g := app.governance
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if len(g.path) == 0 {
+		return
+	}
+	state := &governanceState{
+		Height:    height,
+		Proposals: make([]*GovernanceProposal, 0, len(g.order)),
+		Changes:   app.PendingValidatorChanges(),
+	}
+	for _, key := range g.order {
+		state.Proposals = append(state.Proposals, g.proposals[key].copy())
+	}
+	states := []*governanceState{state}
+	for i := len(g.states) - 1; i >= 0; i-- {
+		if g.states[i].Height < height {
+			states = []*governanceState{g.states[i], state}
+			break
+		}
+	}
+	if err := writeGovernanceState(g.path, states); err != nil {
+		panic(fmt.Sprintf("Could not save the governance state of height %d in %s: %s", height, g.path, err))
+	}
+	g.states = states
+}
+
+// writeGovernanceState replaces the file at path, without ever leaving
+// a half written one
+func writeGovernanceState(path string, states []*governanceState) error {
+	bz, err := json.Marshal(governanceStateFile{States: states})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bz); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreGovernanceState restores the state saved after the commit of
+// height, the last height of the target application.
+func (app *ProxyApplication) restoreGovernanceState(height uint64) {
+	g := app.governance
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if len(g.states) == 0 {
+		return
+	}
+	var state *governanceState
+	for _, st := range g.states {
+		if st.Height == height {
+			state = st
+		}
+	}
+	if state == nil {
+		app.logger.Error("no saved governance state for the height of the target application",
+			"height", height,
+			"saved", g.states[len(g.states)-1].Height)
+		return
+	}
+	g.proposals = make(map[string]*GovernanceProposal, len(state.Proposals))
+	g.order = make([]string, 0, len(state.Proposals))
+	for _, p := range state.Proposals {
+		key := hex.EncodeToString(p.Hash)
+		g.proposals[key] = p.copy()
+		g.order = append(g.order, key)
+	}
+	app.mtx.Lock()
+	app.diffs = make(map[uint64]ValidatorSetChange, len(state.Changes))
+	for _, c := range state.Changes {
+		app.diffs[c.ScheduledHeight] = c
+	}
+	app.mtx.Unlock()
+	app.logger.Info("restored governance state", "height", height, "proposals", len(state.Proposals), "changes", len(state.Changes))
+}
@@ -0,0 +1,241 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type GovernanceSuite struct {
+	operators       []crypto.PrivKey
+	policy          *ApprovalPolicy
+	testApplication *TestApplication
+	app             *ProxyApplication
+}
+
+var _ = Suite(&GovernanceSuite{})
+
+var governancePrefix = []byte("proxy/gov:")
+
+func (s *GovernanceSuite) SetUpTest(c *C) {
+	s.operators = nil
+	policy := &ApprovalPolicy{Threshold: 2}
+	for i := 0; i < 3; i++ {
+		priv := crypto.GenPrivKeyEd25519().Wrap()
+		s.operators = append(s.operators, priv)
+		policy.Operators = append(policy.Operators, priv.PubKey())
+	}
+
+	s.policy = policy
+	s.testApplication = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+	c.Assert(s.app.EnableGovernance(governancePrefix, policy), IsNil)
+}
+
+// restart creates a new proxy in front of the same target application,
+// restoring the governance state saved in path
+func (s *GovernanceSuite) restart(c *C, path string) *ProxyApplication {
+	app := NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+	c.Assert(app.EnableGovernance(governancePrefix, s.policy), IsNil)
+	c.Assert(app.EnableGovernanceState(path), IsNil)
+	// handshake
+	app.Info()
+	return app
+}
+
+func (s *GovernanceSuite) encode(c *C, gtx *GovernanceTx) []byte {
+	payload, err := json.Marshal(gtx)
+	c.Assert(err, IsNil)
+	return append(append([]byte{}, governancePrefix...), payload...)
+}
+
+func (s *GovernanceSuite) proposalTx(c *C, signer crypto.PrivKey, validators []*types.Validator, height uint64) []byte {
+	changes, err := toValidatorPowerChanges(validators)
+	c.Assert(err, IsNil)
+	return s.encode(c, &GovernanceTx{
+		Type:            GovernanceTxPropose,
+		Validators:      changes,
+		ScheduledHeight: height,
+		PubKey:          signer.PubKey(),
+		Signature:       signer.Sign(GovernanceSignBytes(validators, height)),
+	})
+}
+
+func (s *GovernanceSuite) voteTx(c *C, signer crypto.PrivKey, validators []*types.Validator, height uint64) []byte {
+	return s.encode(c, &GovernanceTx{
+		Type:      GovernanceTxVote,
+		Proposal:  hex.EncodeToString(GovernanceProposalHash(validators, height)),
+		PubKey:    signer.PubKey(),
+		Signature: signer.Sign(GovernanceSignBytes(validators, height)),
+	})
+}
+
+func (s *GovernanceSuite) newValidators() []*types.Validator {
+	return []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+}
+
+func (s *GovernanceSuite) TestChangeIsScheduledOnQuorum(c *C) {
+	validators := s.newValidators()
+
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+	res := s.app.CheckTx(s.proposalTx(c, s.operators[0], validators, 3))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	res = s.app.DeliverTx(s.proposalTx(c, s.operators[0], validators, 3))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	c.Check(s.app.EndBlock(1).Diffs, HasLen, 0)
+
+	s.app.BeginBlock(nil, &types.Header{Height: 2})
+	res = s.app.DeliverTx(s.voteTx(c, s.operators[0], validators, 3))
+	c.Check(res.IsErr(), Equals, true)
+	c.Check(res.Log, Matches, ".* already voted for .*")
+	res = s.app.DeliverTx(s.voteTx(c, s.operators[2], validators, 3))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	c.Check(s.app.EndBlock(2).Diffs, HasLen, 0)
+
+	s.app.BeginBlock(nil, &types.Header{Height: 3})
+	c.Check(s.app.EndBlock(3).Diffs, DeepEquals, validators)
+
+	proposals := s.app.GovernanceProposals()
+	c.Assert(proposals, HasLen, 1)
+	c.Check(proposals[0].Status, Equals, ProposalApproved)
+
+	// the target application never saw the governance txs
+	c.Check(s.testApplication.DeliverTxCalls.Calls, HasLen, 0)
+}
+
+func (s *GovernanceSuite) TestRejectsInvalidTxs(c *C) {
+	validators := s.newValidators()
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+
+	res := s.app.DeliverTx(append(append([]byte{}, governancePrefix...), []byte("not json")...))
+	c.Check(res.Code, Equals, types.CodeType_EncodingError)
+
+	outsider := crypto.GenPrivKeyEd25519().Wrap()
+	res = s.app.DeliverTx(s.proposalTx(c, outsider, validators, 3))
+	c.Check(res.Code, Equals, types.CodeType_Unauthorized)
+
+	res = s.app.DeliverTx(s.voteTx(c, s.operators[0], validators, 3))
+	c.Check(res.Code, Equals, types.CodeType_UnknownRequest)
+
+	res = s.app.DeliverTx(s.proposalTx(c, s.operators[0], validators, 1))
+	c.Check(res.Code, Equals, types.CodeType_Unauthorized)
+	c.Check(res.Log, Matches, "Could not schedule for a block height back in time.*")
+
+	// other txs are still forwarded
+	res = s.app.DeliverTx([]byte("hello"))
+	c.Check(res.IsOK(), Equals, true)
+	c.Check(s.testApplication.DeliverTxCalls.Calls, HasLen, 1)
+}
+
+func (s *GovernanceSuite) TestRejectsTxsWithoutPublicKeys(c *C) {
+	signer, err := json.Marshal(s.operators[0].PubKey())
+	c.Assert(err, IsNil)
+	tx := func(payload string) []byte {
+		return append(append([]byte{}, governancePrefix...), []byte(payload)...)
+	}
+
+	// a proposed validator without public key
+	res := s.app.CheckTx(tx(`{"type":"propose","validators":[{"power":10}],"scheduled_height":3,"pub_key":` + string(signer) + `}`))
+	c.Check(res.Code, Equals, types.CodeType_EncodingError)
+	c.Check(res.Log, Equals, "Governance proposal validators require a public key")
+
+	// a vote without the public key of its signer
+	res = s.app.CheckTx(tx(`{"type":"vote","proposal":"00"}`))
+	c.Check(res.Code, Equals, types.CodeType_EncodingError)
+	c.Check(res.Log, Equals, "Governance txs require the public key of their signer")
+}
+
+func (s *GovernanceSuite) TestProposalsExpire(c *C) {
+	validators := s.newValidators()
+
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+	res := s.app.DeliverTx(s.proposalTx(c, s.operators[0], validators, 2))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	s.app.EndBlock(1)
+	s.app.BeginBlock(nil, &types.Header{Height: 2})
+	s.app.EndBlock(2)
+
+	proposals := s.app.GovernanceProposals()
+	c.Assert(proposals, HasLen, 1)
+	c.Check(proposals[0].Status, Equals, ProposalExpired)
+
+	s.app.BeginBlock(nil, &types.Header{Height: 3})
+	res = s.app.DeliverTx(s.voteTx(c, s.operators[1], validators, 2))
+	c.Check(res.Code, Equals, types.CodeType_Unauthorized)
+}
+
+func (s *GovernanceSuite) TestStateIsRestoredAfterRestart(c *C) {
+	testHome, err := ioutil.TempDir("", "abci_proxy_governance")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(testHome)
+	path := filepath.Join(testHome, "governance.json")
+	c.Assert(s.app.EnableGovernanceState(path), IsNil)
+	validators := s.newValidators()
+
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+	res := s.app.DeliverTx(s.proposalTx(c, s.operators[0], validators, 4))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	s.app.EndBlock(1)
+	s.app.Commit()
+	s.app.BeginBlock(nil, &types.Header{Height: 2})
+	res = s.app.DeliverTx(s.voteTx(c, s.operators[1], validators, 4))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	s.app.EndBlock(2)
+	s.app.Commit()
+
+	app := s.restart(c, path)
+	proposals := app.GovernanceProposals()
+	c.Assert(proposals, HasLen, 1)
+	c.Check(proposals[0].Status, Equals, ProposalApproved)
+	c.Check(proposals[0].Voters, HasLen, 2)
+
+	app.BeginBlock(nil, &types.Header{Height: 3})
+	c.Check(app.EndBlock(3).Diffs, HasLen, 0)
+	app.BeginBlock(nil, &types.Header{Height: 4})
+	c.Check(app.EndBlock(4).Diffs, DeepEquals, validators)
+}
+
+func (s *GovernanceSuite) TestStateOfUncommittedBlockIsNotRestored(c *C) {
+	testHome, err := ioutil.TempDir("", "abci_proxy_governance")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(testHome)
+	path := filepath.Join(testHome, "governance.json")
+	c.Assert(s.app.EnableGovernanceState(path), IsNil)
+	validators := s.newValidators()
+
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+	s.app.DeliverTx(s.proposalTx(c, s.operators[0], validators, 4))
+	s.app.EndBlock(1)
+	s.app.Commit()
+	s.app.BeginBlock(nil, &types.Header{Height: 2})
+	s.app.DeliverTx(s.voteTx(c, s.operators[1], validators, 4))
+	s.app.EndBlock(2)
+	// crashed after saving the state, before the target application
+	// committed
+	s.app.saveGovernanceState(2)
+
+	app := s.restart(c, path)
+	proposals := app.GovernanceProposals()
+	c.Assert(proposals, HasLen, 1)
+	c.Check(proposals[0].Status, Equals, ProposalPending)
+	c.Check(app.PendingValidatorChanges(), HasLen, 0)
+
+	// Tendermint replays the block
+	app.BeginBlock(nil, &types.Header{Height: 2})
+	res := app.DeliverTx(s.voteTx(c, s.operators[1], validators, 4))
+	c.Check(res.IsOK(), Equals, true, Commentf("%s", res.Log))
+	c.Check(app.PendingValidatorChanges(), HasLen, 1)
+}
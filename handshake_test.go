@@ -0,0 +1,52 @@
+package abciproxy
+
+import (
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type HandshakeSuite struct {
+	testApplication *TestApplication
+	app             *ProxyApplication
+}
+
+var _ = Suite(&HandshakeSuite{})
+
+func (s *HandshakeSuite) SetUpTest(c *C) {
+	s.testApplication = NewTestApplication(false)
+	// the target application already committed 5 blocks before the
+	// proxy (re)started
+	for h := uint64(1); h <= 5; h++ {
+		s.testApplication.BeginBlock(nil, &types.Header{Height: h})
+		s.testApplication.EndBlock(h)
+		s.testApplication.Commit()
+	}
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+}
+
+func (s *HandshakeSuite) TestRefusesSchedulingUntilHandshake(c *C) {
+	err := s.app.ChangeValidators(nil, 3)
+	c.Check(err, ErrorMatches, "The current block height is not known yet.*")
+	_, err = s.app.SimulateValidatorChange(nil, 3)
+	c.Check(err, ErrorMatches, "The current block height is not known yet.*")
+
+	res := s.app.Query(types.RequestQuery{Path: "/proxy/height"})
+	c.Check(res.Code, Equals, types.CodeType_InternalError)
+}
+
+func (s *HandshakeSuite) TestRecoversHeightFromInfo(c *C) {
+	s.app.Info()
+	c.Check(s.app.currentHeight(), Equals, uint64(5))
+
+	err := s.app.ChangeValidators(nil, 5)
+	c.Check(err, ErrorMatches, "Could not schedule for a block height back in time \\(wanted:5, current:5\\)")
+	c.Check(s.app.ChangeValidators(nil, 6), IsNil)
+}
+
+func (s *HandshakeSuite) TestHeightIsKnownOnNewChain(c *C) {
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	app.InitChain(nil)
+	c.Check(app.ChangeValidators(nil, 1), IsNil)
+}
@@ -0,0 +1,223 @@
+package abciproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+)
+
+// historyMagic starts every diff history file
+const historyMagic = "ABCIDIF1"
+
+// diffHistory remembers the validator diffs emitted by each EndBlock,
+// so that the blocks Tendermint replays after a crash get exactly the
+// same ones. If a file is set, every EndBlock is appended to it as the
+// uvarint height followed by the length prefixed ResponseEndBlock. The
+// initial validator set given by InitChain is recorded as height 0, so
+// that the tracked validator set can be rebuilt after a restart.
+// Only the emitted diffs are recorded: the changes scheduled for later
+// heights are persisted by the governance state, if enabled, and are
+// lost on restart otherwise.
+type diffHistory struct {
+	mtx sync.Mutex
+	// highest height processed
+	height uint64
+	// non empty diffs, by height
+	diffs map[uint64][]*types.Validator
+	// true if the initial validator set was recorded
+	genesis bool
+
+	file *os.File
+	buf  []byte
+}
+
+func newDiffHistory() *diffHistory {
+	return &diffHistory{
+		diffs: make(map[uint64][]*types.Validator),
+	}
+}
+
+// openDiffHistory loads the history persisted at path, or creates it.
+// An entry truncated by a crash is dropped.
+func openDiffHistory(path string) (*diffHistory, error) {
+	h := newDiffHistory()
+	h.buf = make([]byte, binary.MaxVarintLen64)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && os.IsNotExist(err) == false {
+		return nil, err
+	}
+	valid := int64(0)
+	if len(data) > 0 {
+		valid, err = h.load(data)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load diff history %s: %s", path, err)
+		}
+	}
+
+	h.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if valid == 0 {
+		if err := h.file.Truncate(0); err != nil {
+			h.file.Close()
+			return nil, err
+		}
+		if _, err := h.file.WriteString(historyMagic); err != nil {
+			h.file.Close()
+			return nil, err
+		}
+	} else if err := h.file.Truncate(valid); err != nil {
+		h.file.Close()
+		return nil, err
+	}
+	if _, err := h.file.Seek(0, io.SeekEnd); err != nil {
+		h.file.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the entries of data, and returns the length of its valid
+// part.
+func (h *diffHistory) load(data []byte) (int64, error) {
+	if len(data) < len(historyMagic) {
+		// crashed while creating it
+		return 0, nil
+	}
+	if string(data[:len(historyMagic)]) != historyMagic {
+		return 0, fmt.Errorf("Not a diff history file")
+	}
+	r := bytes.NewReader(data[len(historyMagic):])
+	valid := int64(len(historyMagic))
+	for {
+		height, err := binary.ReadUvarint(r)
+		if err != nil {
+			return valid, nil
+		}
+		res := &types.ResponseEndBlock{}
+		if err := types.ReadMessage(r, res); err != nil {
+			return valid, nil
+		}
+		h.set(height, res.Diffs)
+		valid = int64(len(data)) - int64(r.Len())
+	}
+}
+
+func (h *diffHistory) set(height uint64, diffs []*types.Validator) {
+	if height == 0 {
+		h.genesis = true
+	}
+	if height > h.height {
+		h.height = height
+	}
+	if len(diffs) > 0 {
+		h.diffs[height] = diffs
+	}
+}
+
+// lastHeight returns the highest height processed
+func (h *diffHistory) lastHeight() uint64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.height
+}
+
+// get returns the diffs emitted at height, and false if height was
+// never processed.
+func (h *diffHistory) get(height uint64) ([]*types.Validator, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if height > h.height {
+		return nil, false
+	}
+	return h.diffs[height], true
+}
+
+// add records the diffs emitted at height, and syncs them to the file
+// before they are returned to Tendermint.
+func (h *diffHistory) add(height uint64, diffs []*types.Validator) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.set(height, diffs)
+	if h.file == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	n := binary.PutUvarint(h.buf, height)
+	buf.Write(h.buf[:n])
+	if err := types.WriteMessage(&types.ResponseEndBlock{Diffs: diffs}, &buf); err != nil {
+		return err
+	}
+	if _, err := h.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return h.file.Sync()
+}
+
+// rebuildValidators resets vs to the initial validator set, updated by
+// all the diffs recorded, in order. It returns false if the initial set
+// was not recorded.
+func (h *diffHistory) rebuildValidators(vs *validatorSet) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.genesis == false {
+		return false
+	}
+	heights := make([]uint64, 0, len(h.diffs))
+	for height := range h.diffs {
+		if height > 0 {
+			heights = append(heights, height)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	vs.reset(h.diffs[0])
+	for _, height := range heights {
+		vs.apply(h.diffs[height])
+	}
+	return true
+}
+
+func (h *diffHistory) close() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// EnableDiffHistory persists the validator diffs emitted at each height
+// in path, to re-emit them if Tendermint replays blocks after a crash.
+// The history already in path is loaded, and the tracked validator set
+// is rebuilt from it, as the relative power operations are resolved
+// against it. The blocks Tendermint replays emit their recorded
+// absolute diffs again, in order, which leaves the set unchanged.
+func (app *ProxyApplication) EnableDiffHistory(path string) error {
+	h, err := openDiffHistory(path)
+	if err != nil {
+		return err
+	}
+	app.history = h
+	if h.rebuildValidators(app.validators) == true {
+		app.logger.Info("rebuilt validator set from the diff history", "height", h.lastHeight(), "validators", len(app.validators.list()))
+	} else if h.lastHeight() > 0 {
+		app.logger.Error("the diff history has no initial validator set, the validator set is unknown until InitChain", "path", path)
+	}
+	return nil
+}
+
+// CloseDiffHistory closes the file of the diff history, if any
+func (app *ProxyApplication) CloseDiffHistory() error {
+	return app.history.close()
+}
@@ -0,0 +1,132 @@
+package abciproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type HistorySuite struct {
+	testHome string
+	path     string
+	diffs    []*types.Validator
+}
+
+var _ = Suite(&HistorySuite{})
+
+func (s *HistorySuite) SetUpTest(c *C) {
+	var err error
+	s.testHome, err = ioutil.TempDir("", "abci_proxy_history")
+	c.Assert(err, IsNil)
+	s.path = filepath.Join(s.testHome, "diffs.log")
+	s.diffs = []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+
+	app := s.newApp(c)
+	c.Assert(app.ChangeValidators(s.diffs, 2), IsNil)
+	for h := uint64(1); h <= 3; h++ {
+		app.EndBlock(h)
+	}
+	c.Assert(app.CloseDiffHistory(), IsNil)
+}
+
+func (s *HistorySuite) TearDownTest(c *C) {
+	c.Check(os.RemoveAll(s.testHome), IsNil)
+}
+
+func (s *HistorySuite) newApp(c *C) *ProxyApplication {
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	c.Assert(app.EnableDiffHistory(s.path), IsNil)
+	app.InitChain(nil)
+	return app
+}
+
+func (s *HistorySuite) TestReplayedBlocksGetTheSameDiffs(c *C) {
+	app := s.newApp(c)
+	defer app.CloseDiffHistory()
+
+	c.Check(app.EndBlock(1).Diffs, HasLen, 0)
+	c.Check(app.EndBlock(2).Diffs, DeepEquals, s.diffs)
+	c.Check(app.EndBlock(3).Diffs, HasLen, 0)
+	c.Check(app.EndBlock(4).Diffs, HasLen, 0)
+	c.Check(app.Validators(), DeepEquals, s.diffs)
+}
+
+func (s *HistorySuite) TestCannotScheduleInReplayedBlocks(c *C) {
+	app := s.newApp(c)
+	defer app.CloseDiffHistory()
+
+	c.Check(app.ChangeValidators(s.diffs, 3), ErrorMatches, "Could not schedule for a block height back in time \\(wanted:3, current:3\\)")
+	c.Check(app.ChangeValidators(s.diffs, 4), IsNil)
+}
+
+func (s *HistorySuite) TestEndBlockPanicsIfDiffsCannotBePersisted(c *C) {
+	app := s.newApp(c)
+	defer app.CloseDiffHistory()
+	// make every write fail
+	c.Assert(app.history.file.Close(), IsNil)
+
+	c.Check(func() { app.EndBlock(4) }, PanicMatches, "Could not persist the validator diffs of height 4: .*")
+}
+
+func (s *HistorySuite) TestIgnoresTruncatedEntry(c *C) {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	// height 4, and half of a message
+	_, err = f.Write([]byte{0x04, 0x10, 0x01})
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	app := s.newApp(c)
+	c.Check(app.EndBlock(2).Diffs, DeepEquals, s.diffs)
+	c.Check(app.history.lastHeight(), Equals, uint64(3))
+	app.EndBlock(4)
+	c.Assert(app.CloseDiffHistory(), IsNil)
+
+	app = s.newApp(c)
+	defer app.CloseDiffHistory()
+	c.Check(app.history.lastHeight(), Equals, uint64(4))
+}
+
+func (s *HistorySuite) TestValidatorSetIsRebuiltAfterRestart(c *C) {
+	path := filepath.Join(s.testHome, "restart.log")
+	genesis := []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	c.Assert(app.EnableDiffHistory(path), IsNil)
+	app.InitChain(genesis)
+	c.Assert(app.ChangeValidators(s.diffs, 2), IsNil)
+	app.EndBlock(1)
+	app.EndBlock(2)
+	c.Assert(app.CloseDiffHistory(), IsNil)
+
+	// Tendermint does not call InitChain again
+	restarted := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	c.Assert(restarted.EnableDiffHistory(path), IsNil)
+	defer restarted.CloseDiffHistory()
+	c.Check(restarted.Validators(), DeepEquals, app.Validators())
+	restarted.Info()
+
+	_, err := restarted.ScheduleValidatorPowerChanges([]*types.Validator{
+		&types.Validator{PubKey: genesis[0].PubKey, Power: 5},
+	}, []PowerOp{PowerIncrease}, 4)
+	c.Assert(err, IsNil)
+	restarted.EndBlock(3)
+	c.Check(restarted.EndBlock(4).Diffs, DeepEquals, []*types.Validator{
+		&types.Validator{PubKey: genesis[0].PubKey, Power: 15},
+	})
+}
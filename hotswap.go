@@ -0,0 +1,196 @@
+package abciproxy
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tendermint/abci/types"
+)
+
+// maximum time the old target application is kept after a switch, for
+// the calls it is answering
+const switchDrainTimeout = 10 * time.Second
+
+// interval between the Info calls checking whether the new target
+// application reached the switch height
+const switchPollInterval = 100 * time.Millisecond
+
+type AppSwitchStatus string
+
+const (
+	AppSwitchScheduled AppSwitchStatus = "scheduled"
+	AppSwitchDone      AppSwitchStatus = "done"
+	AppSwitchAborted   AppSwitchStatus = "aborted"
+	AppSwitchCancelled AppSwitchStatus = "cancelled"
+)
+
+// AppSwitch is a scheduled replacement of the target application. The
+// switch happens right after the Commit of Height, if the new
+// application Info reported the same height and app hash before.
+type AppSwitch struct {
+	Address string          `json:"address"`
+	Height  uint64          `json:"height"`
+	Status  AppSwitchStatus `json:"status"`
+	// true once the new application reported Height
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+
+	conns Connections
+	// app hash reported by the new application at Height
+	appHash []byte
+}
+
+// ScheduleAppSwitch replaces the target application by conns, already
+// connected to address, right after the Commit of height.
+func (app *ProxyApplication) ScheduleAppSwitch(address string, conns Connections, height uint64) error {
+	if err := app.checkScheduledHeight(height); err != nil {
+		return err
+	}
+	app.switchMtx.Lock()
+	defer app.switchMtx.Unlock()
+	if app.appSwitch != nil && app.appSwitch.Status == AppSwitchScheduled {
+		return fmt.Errorf("A switch to %s is already scheduled at height %d", app.appSwitch.Address, app.appSwitch.Height)
+	}
+	s := &AppSwitch{
+		Address: address,
+		Height:  height,
+		Status:  AppSwitchScheduled,
+		conns:   conns,
+	}
+	app.appSwitch = s
+	app.logger.Info("scheduled target application switch", "address", address, "height", height)
+	go app.pollAppSwitch(s)
+	return nil
+}
+
+// pollAppSwitch waits for the new application of s to reach the switch
+// height, and keeps its app hash, so that the Commit of the height only
+// has to compare it.
+func (app *ProxyApplication) pollAppSwitch(s *AppSwitch) {
+	for {
+		app.switchMtx.Lock()
+		scheduled := s.Status == AppSwitchScheduled
+		app.switchMtx.Unlock()
+		if scheduled == false {
+			return
+		}
+		info, err := s.conns.Query.InfoSync()
+		if err != nil {
+			app.logger.Debug("could not get new application info", "address", s.Address, "error", err)
+		} else if info.LastBlockHeight >= s.Height {
+			app.switchMtx.Lock()
+			defer app.switchMtx.Unlock()
+			if s.Status != AppSwitchScheduled {
+				return
+			}
+			if info.LastBlockHeight != s.Height {
+				app.abortAppSwitch("new application is at height %d", info.LastBlockHeight)
+				return
+			}
+			s.Ready = true
+			s.appHash = info.LastBlockAppHash
+			app.logger.Info("new target application reached the switch height", "address", s.Address, "height", s.Height)
+			return
+		}
+		time.Sleep(switchPollInterval)
+	}
+}
+
+// CancelAppSwitch cancels the scheduled switch, if any
+func (app *ProxyApplication) CancelAppSwitch() error {
+	app.switchMtx.Lock()
+	defer app.switchMtx.Unlock()
+	if app.appSwitch == nil || app.appSwitch.Status != AppSwitchScheduled {
+		return fmt.Errorf("No target application switch is scheduled")
+	}
+	app.appSwitch.conns.Stop()
+	app.appSwitch.Status = AppSwitchCancelled
+	return nil
+}
+
+// AppSwitchStatus returns the last scheduled switch, or nil
+func (app *ProxyApplication) AppSwitchStatus() *AppSwitch {
+	app.switchMtx.Lock()
+	defer app.switchMtx.Unlock()
+	if app.appSwitch == nil {
+		return nil
+	}
+	res := *app.appSwitch
+	return &res
+}
+
+// abortAppSwitch gives up the switch. switchMtx should be held.
+func (app *ProxyApplication) abortAppSwitch(format string, args ...interface{}) {
+	s := app.appSwitch
+	s.Error = fmt.Sprintf(format, args...)
+	s.Status = AppSwitchAborted
+	s.conns.Stop()
+	app.logger.Error("aborted target application switch", "address", s.Address, "height", s.Height, "error", s.Error)
+}
+
+// maybeSwitchApp performs the scheduled switch, if commit is the one
+// of its height. It is called by Commit, so the new application must
+// already be verified: a Tendermint block is not delayed by a switch.
+func (app *ProxyApplication) maybeSwitchApp(commit types.Result) {
+	app.switchMtx.Lock()
+	defer app.switchMtx.Unlock()
+	s := app.appSwitch
+	height, _ := app.knownHeight()
+	if s == nil || s.Status != AppSwitchScheduled || height < s.Height {
+		return
+	}
+	if height > s.Height {
+		app.abortAppSwitch("missed the switch height, current height is %d", height)
+		return
+	}
+	if commit.IsErr() {
+		app.abortAppSwitch("target application commit failed: %s", commit.Log)
+		return
+	}
+	if s.Ready == false {
+		app.abortAppSwitch("new application did not reach height %d before its commit", s.Height)
+		return
+	}
+	if bytes.Equal(s.appHash, commit.Data) == false {
+		app.abortAppSwitch("new application hash is %X, expected %X", s.appHash, []byte(commit.Data))
+		return
+	}
+
+	app.nextMtx.Lock()
+	old := app.next
+	inflight := app.inflight
+	app.next = s.conns
+	app.inflight = &sync.WaitGroup{}
+	app.nextMtx.Unlock()
+	go app.stopOldApp(old, inflight)
+
+	s.Status = AppSwitchDone
+	app.logger.Info("switched target application", "address", s.Address, "height", s.Height)
+}
+
+// stopOldApp stops the connections to the old target application once
+// the mempool and query calls still waiting for it are answered
+func (app *ProxyApplication) stopOldApp(old Connections, inflight *sync.WaitGroup) {
+	if waitGroupTimeout(inflight, switchDrainTimeout) == false {
+		app.logger.Error("stopping the old target application with calls still in flight", "timeout", switchDrainTimeout)
+	}
+	old.Stop()
+}
+
+// waitGroupTimeout waits for wg at most timeout, and returns false if
+// it timed out
+func waitGroupTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
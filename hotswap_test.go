@@ -0,0 +1,141 @@
+package abciproxy
+
+import (
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type HotSwapSuite struct {
+	current, replacement *TestApplication
+	app                  *ProxyApplication
+}
+
+var _ = Suite(&HotSwapSuite{})
+
+func (s *HotSwapSuite) SetUpTest(c *C) {
+	s.current = NewTestApplication(false)
+	s.replacement = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.current))
+	// handshake
+	s.app.Info()
+}
+
+func (s *HotSwapSuite) runBlock(height uint64, txs ...[]byte) {
+	s.app.BeginBlock(nil, &types.Header{Height: height})
+	for _, tx := range txs {
+		s.app.DeliverTx(tx)
+	}
+	s.app.EndBlock(height)
+	s.app.Commit()
+}
+
+// syncReplacement brings the replacement application to the same state
+// than the current one would be after the same block. It is called
+// before scheduling the switch, which polls the replacement.
+func (s *HotSwapSuite) syncReplacement(height uint64, txs ...[]byte) {
+	s.replacement.BeginBlock(nil, &types.Header{Height: height})
+	for _, tx := range txs {
+		s.replacement.DeliverTx(tx)
+	}
+	s.replacement.EndBlock(height)
+	s.replacement.Commit()
+}
+
+// waitReady waits for the switch to see the replacement application at
+// the switch height
+func (s *HotSwapSuite) waitReady(c *C) {
+	for i := 0; i < 100; i++ {
+		if s.app.AppSwitchStatus().Ready == true {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("the replacement application was not seen at the switch height")
+}
+
+func (s *HotSwapSuite) TestSwitchesAfterCommit(c *C) {
+	s.syncReplacement(1, []byte("a"))
+	s.syncReplacement(2, []byte("b"))
+	c.Assert(s.app.ScheduleAppSwitch("replacement", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 2), IsNil)
+	c.Check(s.app.ScheduleAppSwitch("other", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 3), ErrorMatches, "A switch to replacement is already scheduled at height 2")
+	s.waitReady(c)
+	s.runBlock(1, []byte("a"))
+	c.Check(s.app.AppSwitchStatus().Status, Equals, AppSwitchScheduled)
+	s.runBlock(2, []byte("b"))
+	c.Check(s.app.AppSwitchStatus().Status, Equals, AppSwitchDone)
+
+	s.runBlock(3, []byte("c"))
+	c.Check(s.current.DeliverTxCalls.Calls, HasLen, 2)
+	c.Check(s.replacement.DeliverTxCalls.Calls, HasLen, 3)
+}
+
+func (s *HotSwapSuite) TestAbortsIfStateDiffers(c *C) {
+	s.syncReplacement(1)
+	c.Assert(s.app.ScheduleAppSwitch("replacement", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 1), IsNil)
+	s.waitReady(c)
+	s.runBlock(1, []byte("a"))
+
+	status := s.app.AppSwitchStatus()
+	c.Check(status.Status, Equals, AppSwitchAborted)
+	c.Check(status.Error, Matches, "new application hash is .*")
+
+	s.runBlock(2, []byte("b"))
+	c.Check(s.current.DeliverTxCalls.Calls, HasLen, 2)
+	c.Check(s.replacement.DeliverTxCalls.Calls, HasLen, 0)
+}
+
+func (s *HotSwapSuite) TestOldAppIsStoppedAfterCallsInFlight(c *C) {
+	current := abcicli.NewLocalClient(nil, s.current)
+	_, err := current.Start()
+	c.Assert(err, IsNil)
+	s.app = NewProxyApp(current)
+	s.app.Info()
+	s.syncReplacement(1)
+	c.Assert(s.app.ScheduleAppSwitch("replacement", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 1), IsNil)
+	s.waitReady(c)
+
+	// a query still waiting for the current application does not
+	// delay the commit
+	_, release := s.app.queryClient()
+	s.runBlock(1)
+	c.Check(s.app.AppSwitchStatus().Status, Equals, AppSwitchDone)
+	time.Sleep(50 * time.Millisecond)
+	c.Check(current.IsRunning(), Equals, true)
+
+	release()
+	for i := 0; i < 100 && current.IsRunning() == true; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(current.IsRunning(), Equals, false)
+}
+
+func (s *HotSwapSuite) TestAbortsIfNotReadyAtCommit(c *C) {
+	c.Assert(s.app.ScheduleAppSwitch("replacement", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 1), IsNil)
+
+	s.runBlock(1, []byte("a"))
+	status := s.app.AppSwitchStatus()
+	c.Check(status.Status, Equals, AppSwitchAborted)
+	c.Check(status.Error, Equals, "new application did not reach height 1 before its commit")
+}
+
+func (s *HotSwapSuite) TestAbortsIfPastTheHeight(c *C) {
+	s.syncReplacement(1)
+	s.syncReplacement(2)
+	c.Assert(s.app.ScheduleAppSwitch("replacement", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 1), IsNil)
+
+	for i := 0; i < 100 && s.app.AppSwitchStatus().Status == AppSwitchScheduled; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := s.app.AppSwitchStatus()
+	c.Check(status.Status, Equals, AppSwitchAborted)
+	c.Check(status.Error, Equals, "new application is at height 2")
+}
+
+func (s *HotSwapSuite) TestCannotScheduleInThePast(c *C) {
+	s.runBlock(1)
+	c.Check(s.app.ScheduleAppSwitch("replacement", SharedConnections(abcicli.NewLocalClient(nil, s.replacement)), 1), ErrorMatches, "Could not schedule for a block height back in time.*")
+}
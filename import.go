@@ -0,0 +1,164 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+	tmtypes "github.com/tendermint/tendermint/types"
+)
+
+// ImportedValidator is a validator key read from a Tendermint file
+type ImportedValidator struct {
+	Name   string        `json:"name"`
+	PubKey crypto.PubKey `json:"pub_key"`
+	Power  uint64        `json:"power"`
+}
+
+// privValidatorPublic is the public part of a priv_validator.json file.
+// The private key is never read.
+type privValidatorPublic struct {
+	Address string        `json:"address"`
+	PubKey  crypto.PubKey `json:"pub_key"`
+}
+
+// checkValidatorPubKey returns an error if pubKey cannot be the key of
+// a Tendermint validator
+func checkValidatorPubKey(pubKey crypto.PubKey) error {
+	if pubKey.Empty() == true {
+		return fmt.Errorf("Missing validator public key")
+	}
+	if _, ok := pubKey.Unwrap().(crypto.PubKeyEd25519); ok == false {
+		return fmt.Errorf("Validator public key %X is not an ed25519 key", pubKey.Bytes())
+	}
+	return nil
+}
+
+// ParseGenesisValidators reads the validators of a Tendermint
+// genesis.json file, with their name and voting power.
+func ParseGenesisValidators(data []byte) ([]*ImportedValidator, error) {
+	doc, err := tmtypes.GenesisDocFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse genesis document: %s", err)
+	}
+	if len(doc.Validators) == 0 {
+		return nil, fmt.Errorf("The genesis document has no validators")
+	}
+	res := make([]*ImportedValidator, 0, len(doc.Validators))
+	for _, v := range doc.Validators {
+		if err := checkValidatorPubKey(v.PubKey); err != nil {
+			return nil, err
+		}
+		if v.Amount < 0 {
+			return nil, fmt.Errorf("Genesis validator %X has a negative power %d", v.PubKey.Bytes(), v.Amount)
+		}
+		res = append(res, &ImportedValidator{
+			Name:   v.Name,
+			PubKey: v.PubKey,
+			Power:  uint64(v.Amount),
+		})
+	}
+	return res, nil
+}
+
+// ParsePrivValidatorKey reads the public key of a Tendermint
+// priv_validator.json file, only its public part is required. The
+// address, if present, must be the one of the key.
+func ParsePrivValidatorKey(data []byte) (crypto.PubKey, error) {
+	var pv privValidatorPublic
+	if err := json.Unmarshal(data, &pv); err != nil {
+		return crypto.PubKey{}, fmt.Errorf("Could not parse priv validator file: %s", err)
+	}
+	if err := checkValidatorPubKey(pv.PubKey); err != nil {
+		return crypto.PubKey{}, err
+	}
+	address := hex.EncodeToString(pv.PubKey.Address())
+	if len(pv.Address) != 0 && strings.EqualFold(pv.Address, address) == false {
+		return crypto.PubKey{}, fmt.Errorf("Priv validator address %s is not the one of its public key (%s)", pv.Address, strings.ToUpper(address))
+	}
+	return pv.PubKey, nil
+}
+
+// PrivValidatorPublicPart returns the public part of a Tendermint
+// priv_validator.json file, with its address and public key, so that
+// the private key never leaves the node.
+func PrivValidatorPublicPart(data []byte) ([]byte, error) {
+	pubKey, err := ParsePrivValidatorKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(privValidatorPublic{
+		Address: strings.ToUpper(hex.EncodeToString(pubKey.Address())),
+		PubKey:  pubKey,
+	})
+}
+
+// ImportValidators registers the names of validators if register is
+// set, and schedules them at their power if scheduledHeight is not 0.
+// All validators, their names and the scheduled height are checked
+// before anything is changed.
+func (app *ProxyApplication) ImportValidators(validators []*ImportedValidator, register bool, scheduledHeight uint64) (*ValidatorChangeStatus, error) {
+	if register == false && scheduledHeight == 0 {
+		return nil, fmt.Errorf("Nothing to do, the validators should be registered or scheduled")
+	}
+	seen := make(map[string]bool)
+	seenKeys := make(map[string]bool)
+	keys := make([]*ValidatorKey, 0, len(validators))
+	for _, v := range validators {
+		if err := checkValidatorPubKey(v.PubKey); err != nil {
+			return nil, err
+		}
+		key := hex.EncodeToString(v.PubKey.Bytes())
+		if seenKeys[key] == true {
+			return nil, fmt.Errorf("Validator %X is listed twice", v.PubKey.Bytes())
+		}
+		seenKeys[key] = true
+		if register == true && len(v.Name) == 0 {
+			return nil, fmt.Errorf("Validator %X has no name to register", v.PubKey.Bytes())
+		}
+		if register == true && seen[v.Name] == true {
+			return nil, fmt.Errorf("Validator name %s is used twice", v.Name)
+		}
+		seen[v.Name] = true
+		keys = append(keys, &ValidatorKey{Name: v.Name, PubKey: v.PubKey})
+	}
+	if register == true {
+		if err := app.keys.checkAll(keys); err != nil {
+			return nil, err
+		}
+	}
+	if scheduledHeight != 0 {
+		if err := app.checkScheduledHeight(scheduledHeight); err != nil {
+			return nil, err
+		}
+		if _, err := app.effectiveHeight(scheduledHeight); err != nil {
+			return nil, err
+		}
+	}
+
+	if register == true {
+		for _, k := range keys {
+			if old, ok := app.keys.get(k.Name); ok == true && old.PubKey.Equals(k.PubKey) == true {
+				// keep its metadata
+				continue
+			}
+			if err := app.RegisterValidatorKey(k, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if scheduledHeight == 0 {
+		return nil, nil
+	}
+	diffs := make([]*types.Validator, 0, len(validators))
+	for _, v := range validators {
+		diffs = append(diffs, &types.Validator{
+			PubKey: v.PubKey.Bytes(),
+			Power:  v.Power,
+		})
+	}
+	return app.ScheduleValidatorChange(diffs, scheduledHeight)
+}
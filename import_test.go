@@ -0,0 +1,169 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+	tmtypes "github.com/tendermint/tendermint/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type ImportSuite struct {
+	app  *ProxyApplication
+	keys []crypto.PrivKey
+}
+
+var _ = Suite(&ImportSuite{})
+
+func (s *ImportSuite) SetUpTest(c *C) {
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	s.app.InitChain(nil)
+	s.keys = nil
+	for i := 0; i < 2; i++ {
+		s.keys = append(s.keys, crypto.GenPrivKeyEd25519().Wrap())
+	}
+}
+
+func (s *ImportSuite) genesis(c *C, amounts ...int64) []byte {
+	doc := tmtypes.GenesisDoc{ChainID: "test-chain"}
+	for i, a := range amounts {
+		doc.Validators = append(doc.Validators, tmtypes.GenesisValidator{
+			PubKey: s.keys[i].PubKey(),
+			Amount: a,
+			Name:   fmt.Sprintf("node%d", i),
+		})
+	}
+	bz, err := json.Marshal(doc)
+	c.Assert(err, IsNil)
+	return bz
+}
+
+func (s *ImportSuite) privValidator(c *C, address string, pubKey crypto.PubKey) []byte {
+	bz, err := json.Marshal(map[string]interface{}{
+		"address": address,
+		"pub_key": pubKey,
+		// never read, but present in the files of the nodes
+		"priv_key":    s.keys[0],
+		"last_height": 0,
+	})
+	c.Assert(err, IsNil)
+	return bz
+}
+
+func (s *ImportSuite) TestParsesGenesis(c *C) {
+	validators, err := ParseGenesisValidators(s.genesis(c, 10, 5))
+	c.Assert(err, IsNil)
+	c.Check(validators, DeepEquals, []*ImportedValidator{
+		{Name: "node0", PubKey: s.keys[0].PubKey(), Power: 10},
+		{Name: "node1", PubKey: s.keys[1].PubKey(), Power: 5},
+	})
+
+	_, err = ParseGenesisValidators(s.genesis(c))
+	c.Check(err, ErrorMatches, "The genesis document has no validators")
+	_, err = ParseGenesisValidators(s.genesis(c, -1))
+	c.Check(err, ErrorMatches, "Genesis validator .* has a negative power -1")
+	_, err = ParseGenesisValidators([]byte("{"))
+	c.Check(err, ErrorMatches, "Could not parse genesis document.*")
+}
+
+func (s *ImportSuite) TestParsesPrivValidator(c *C) {
+	pubKey := s.keys[0].PubKey()
+	address := hex.EncodeToString(pubKey.Address())
+
+	res, err := ParsePrivValidatorKey(s.privValidator(c, address, pubKey))
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, pubKey)
+
+	_, err = ParsePrivValidatorKey(s.privValidator(c, address, s.keys[1].PubKey()))
+	c.Check(err, ErrorMatches, "Priv validator address .* is not the one of its public key .*")
+
+	secp := crypto.GenPrivKeySecp256k1().Wrap().PubKey()
+	_, err = ParsePrivValidatorKey(s.privValidator(c, "", secp))
+	c.Check(err, ErrorMatches, "Validator public key .* is not an ed25519 key")
+
+	_, err = ParsePrivValidatorKey([]byte(`{"address": ""}`))
+	c.Check(err, ErrorMatches, "Missing validator public key")
+}
+
+func (s *ImportSuite) TestRegistersAndSchedules(c *C) {
+	validators, err := ParseGenesisValidators(s.genesis(c, 10, 5))
+	c.Assert(err, IsNil)
+
+	status, err := s.app.ImportValidators(validators, true, 2)
+	c.Assert(err, IsNil)
+	c.Check(status.ScheduledHeight, Equals, uint64(2))
+	c.Check(s.app.ValidatorKeys(), HasLen, 2)
+	c.Check(s.app.keys.name(s.keys[1].PubKey().Bytes()), Equals, "node1")
+
+	s.app.EndBlock(1)
+	c.Check(s.app.EndBlock(2).Diffs, DeepEquals, []*types.Validator{
+		{PubKey: s.keys[0].PubKey().Bytes(), Power: 10},
+		{PubKey: s.keys[1].PubKey().Bytes(), Power: 5},
+	})
+}
+
+func (s *ImportSuite) TestKeepsRegisteredMetadata(c *C) {
+	key := &ValidatorKey{Name: "node0", PubKey: s.keys[0].PubKey(), Contact: "ops@example.com"}
+	c.Assert(s.app.RegisterValidatorKey(key, false), IsNil)
+
+	validators, err := ParseGenesisValidators(s.genesis(c, 10))
+	c.Assert(err, IsNil)
+	status, err := s.app.ImportValidators(validators, true, 0)
+	c.Assert(err, IsNil)
+	c.Check(status, IsNil)
+	c.Check(s.app.ValidatorKeys(), DeepEquals, []*ValidatorKey{key})
+}
+
+func (s *ImportSuite) TestChecksBeforeImporting(c *C) {
+	validators := []*ImportedValidator{
+		{Name: "node0", PubKey: s.keys[0].PubKey(), Power: 10},
+		{PubKey: s.keys[1].PubKey(), Power: 10},
+	}
+	_, err := s.app.ImportValidators(validators, true, 2)
+	c.Check(err, ErrorMatches, "Validator .* has no name to register")
+	_, err = s.app.ImportValidators(validators, false, 0)
+	c.Check(err, ErrorMatches, "Nothing to do.*")
+	c.Check(s.app.ValidatorKeys(), HasLen, 0)
+	c.Check(s.app.PendingValidatorChanges(), HasLen, 0)
+}
+
+func (s *ImportSuite) TestPublicPartOfPrivValidator(c *C) {
+	pubKey := s.keys[0].PubKey()
+	bz, err := PrivValidatorPublicPart(s.privValidator(c, "", pubKey))
+	c.Assert(err, IsNil)
+
+	var fields map[string]interface{}
+	c.Assert(json.Unmarshal(bz, &fields), IsNil)
+	c.Check(fields, HasLen, 2)
+	c.Check(fields["priv_key"], IsNil)
+	res, err := ParsePrivValidatorKey(bz)
+	c.Assert(err, IsNil)
+	c.Check(res, Equals, pubKey)
+}
+
+func (s *ImportSuite) TestChecksNamesBeforeRegistering(c *C) {
+	other := crypto.GenPrivKeyEd25519().Wrap().PubKey()
+	c.Assert(s.app.RegisterValidatorKey(&ValidatorKey{Name: "node1", PubKey: other}, false), IsNil)
+
+	// node0 is fine, but node1 is registered with another key
+	validators, err := ParseGenesisValidators(s.genesis(c, 10, 5))
+	c.Assert(err, IsNil)
+	_, err = s.app.ImportValidators(validators, true, 2)
+	c.Check(err, ErrorMatches, "Validator node1 is already registered with public key .*")
+	c.Check(s.app.ValidatorKeys(), HasLen, 1)
+	c.Check(s.app.PendingValidatorChanges(), HasLen, 0)
+}
+
+func (s *ImportSuite) TestChecksScheduleBeforeRegistering(c *C) {
+	s.app.SetMinimumLead(5, false)
+	validators, err := ParseGenesisValidators(s.genesis(c, 10, 5))
+	c.Assert(err, IsNil)
+	_, err = s.app.ImportValidators(validators, true, 2)
+	c.Check(err, ErrorMatches, "Validator changes must be scheduled at least 5 blocks ahead.*")
+	c.Check(s.app.ValidatorKeys(), HasLen, 0)
+}
@@ -0,0 +1,50 @@
+package abciproxy
+
+import (
+	"encoding/json"
+
+	"github.com/tendermint/abci/types"
+)
+
+// ProxyInfo is the proxy metadata added to the Info response
+type ProxyInfo struct {
+	BuildInfo
+	PendingChanges int `json:"pending_changes"`
+}
+
+// wrappedInfoData is the Info Data when metadata is enabled. The
+// target application data is kept verbatim in Data.
+type wrappedInfoData struct {
+	Data  string    `json:"data"`
+	Proxy ProxyInfo `json:"proxy"`
+}
+
+// EnableInfoMetadata makes Info wrap the target application
+// response with the proxy metadata: Data becomes
+// {"data":<app data>,"proxy":{...}} and Version gets a
+// "+abci-proxy.<version>" build suffix. LastBlockHeight and
+// LastBlockAppHash are kept untouched.
+func (app *ProxyApplication) EnableInfoMetadata() {
+	app.infoMetadata = true
+}
+
+func (app *ProxyApplication) proxyInfo() ProxyInfo {
+	return ProxyInfo{
+		BuildInfo:      NewBuildInfo(),
+		PendingChanges: len(app.PendingValidatorChanges()),
+	}
+}
+
+func (app *ProxyApplication) wrapInfo(info types.ResponseInfo) types.ResponseInfo {
+	bz, err := json.Marshal(wrappedInfoData{
+		Data:  info.Data,
+		Proxy: app.proxyInfo(),
+	})
+	if err != nil {
+		app.logger.Error("could not encode info metadata", "error", err)
+		return info
+	}
+	info.Data = string(bz)
+	info.Version = info.Version + "+abci-proxy." + Version
+	return info
+}
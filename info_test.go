@@ -0,0 +1,40 @@
+package abciproxy
+
+import (
+	"encoding/json"
+
+	abcicli "github.com/tendermint/abci/client"
+
+	. "gopkg.in/check.v1"
+)
+
+type InfoSuite struct {
+	testApplication *TestApplication
+	app             *ProxyApplication
+}
+
+var _ = Suite(&InfoSuite{})
+
+func (s *InfoSuite) SetUpTest(c *C) {
+	s.testApplication = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+}
+
+func (s *InfoSuite) TestInfoIsVerbatimByDefault(c *C) {
+	c.Check(s.app.Info(), DeepEquals, s.testApplication.Info())
+}
+
+func (s *InfoSuite) TestInfoCanBeWrapped(c *C) {
+	s.app.EnableInfoMetadata()
+	expected := s.testApplication.Info()
+
+	res := s.app.Info()
+	c.Check(res.Version, Equals, expected.Version+"+abci-proxy."+Version)
+	c.Check(res.LastBlockHeight, Equals, expected.LastBlockHeight)
+
+	data := wrappedInfoData{}
+	c.Assert(json.Unmarshal([]byte(res.Data), &data), IsNil)
+	c.Check(data.Data, Equals, expected.Data)
+	c.Check(data.Proxy.Version, Equals, Version)
+	c.Check(data.Proxy.PendingChanges, Equals, 0)
+}
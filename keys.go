@@ -0,0 +1,296 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+)
+
+// ValidatorKey is a validator public key registered under a name, as
+// operators do not identify nodes by their public keys
+type ValidatorKey struct {
+	Name        string        `json:"name"`
+	PubKey      crypto.PubKey `json:"pub_key"`
+	Moniker     string        `json:"moniker,omitempty"`
+	Contact     string        `json:"contact,omitempty"`
+	NodeAddress string        `json:"node_address,omitempty"`
+}
+
+type keyRegistryFile struct {
+	Keys []*ValidatorKey `json:"keys"`
+}
+
+// keyRegistry maps names to validator public keys. If path is set, it
+// is saved there on every change.
+type keyRegistry struct {
+	mtx    sync.RWMutex
+	path   string
+	byName map[string]*ValidatorKey
+	// names indexed by hex encoded public key
+	names map[string]string
+}
+
+func newKeyRegistry() *keyRegistry {
+	return &keyRegistry{
+		byName: make(map[string]*ValidatorKey),
+		names:  make(map[string]string),
+	}
+}
+
+// openKeyRegistry loads the registry saved at path, if it exists
+func openKeyRegistry(path string) (*keyRegistry, error) {
+	r := newKeyRegistry()
+	r.path = path
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) == true {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f keyRegistryFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("Could not parse key registry %s: %s", path, err)
+	}
+	for _, k := range f.Keys {
+		if err := r.check(k, false); err != nil {
+			return nil, fmt.Errorf("Invalid key registry %s: %s", path, err)
+		}
+		r.set(k)
+	}
+	return r, nil
+}
+
+// check returns an error if k cannot be registered. A name registered
+// with another public key is only rebound if replace is set. r.mtx
+// should be held.
+func (r *keyRegistry) check(k *ValidatorKey, replace bool) error {
+	if len(k.Name) == 0 {
+		return fmt.Errorf("Validator keys require a name")
+	}
+	if k.PubKey.Empty() == true {
+		return fmt.Errorf("Validator key %s requires a public key", k.Name)
+	}
+	if name, ok := r.names[hex.EncodeToString(k.PubKey.Bytes())]; ok == true && name != k.Name {
+		return fmt.Errorf("Public key %X is already registered as %s", k.PubKey.Bytes(), name)
+	}
+	if old, ok := r.byName[k.Name]; ok == true && old.PubKey.Equals(k.PubKey) == false && replace == false {
+		return fmt.Errorf("Validator %s is already registered with public key %X, it is only replaced on request", k.Name, old.PubKey.Bytes())
+	}
+	return nil
+}
+
+// set registers k, replacing the key of the same name. r.mtx should be
+// held.
+func (r *keyRegistry) set(k *ValidatorKey) {
+	if old, ok := r.byName[k.Name]; ok == true {
+		delete(r.names, hex.EncodeToString(old.PubKey.Bytes()))
+	}
+	r.byName[k.Name] = k
+	r.names[hex.EncodeToString(k.PubKey.Bytes())] = k.Name
+}
+
+// save writes the registry to its file, if any. r.mtx should be held.
+func (r *keyRegistry) save() error {
+	if len(r.path) == 0 {
+		return nil
+	}
+	bz, err := json.MarshalIndent(keyRegistryFile{Keys: r.listUnsafe()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// never leave a half written registry
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bz, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// checkAll returns an error if any of keys cannot be registered
+func (r *keyRegistry) checkAll(keys []*ValidatorKey) error {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for _, k := range keys {
+		if err := r.check(k, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// register registers k, see check. It returns the key k replaced, if
+// its public key was different.
+func (r *keyRegistry) register(k *ValidatorKey, replace bool) (*ValidatorKey, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.check(k, replace); err != nil {
+		return nil, err
+	}
+	old, ok := r.byName[k.Name]
+	if ok == false || old.PubKey.Equals(k.PubKey) == true {
+		old = nil
+	}
+	r.set(k)
+	return old, r.save()
+}
+
+func (r *keyRegistry) remove(name string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	k, ok := r.byName[name]
+	if ok == false {
+		return fmt.Errorf("Unknown validator %s", name)
+	}
+	delete(r.byName, name)
+	delete(r.names, hex.EncodeToString(k.PubKey.Bytes()))
+	return r.save()
+}
+
+func (r *keyRegistry) get(name string) (*ValidatorKey, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	k, ok := r.byName[name]
+	return k, ok
+}
+
+// name returns the name pubKey is registered with, if any
+func (r *keyRegistry) name(pubKey []byte) string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.names[hex.EncodeToString(pubKey)]
+}
+
+// list returns the registered keys ordered by name
+func (r *keyRegistry) list() []*ValidatorKey {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.listUnsafe()
+}
+
+func (r *keyRegistry) listUnsafe() []*ValidatorKey {
+	res := make([]*ValidatorKey, 0, len(r.byName))
+	for _, k := range r.byName {
+		res = append(res, k)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// EnableKeyRegistry loads the validator names registered in path, and
+// saves there every change of the registry.
+func (app *ProxyApplication) EnableKeyRegistry(path string) error {
+	r, err := openKeyRegistry(path)
+	if err != nil {
+		return err
+	}
+	app.keys = r
+	return nil
+}
+
+// RegisterValidatorKey registers key under its name, or updates the
+// metadata of the key already registered with this name. A name is
+// only rebound to another public key if replace is set. A public key
+// has a single name.
+func (app *ProxyApplication) RegisterValidatorKey(key *ValidatorKey, replace bool) error {
+	old, err := app.keys.register(key, replace)
+	if old != nil {
+		app.logger.Info("replaced validator public key",
+			"name", key.Name,
+			"old", fmt.Sprintf("%X", old.PubKey.Bytes()),
+			"new", fmt.Sprintf("%X", key.PubKey.Bytes()))
+	}
+	return err
+}
+
+// RemoveValidatorKey removes the key registered as name
+func (app *ProxyApplication) RemoveValidatorKey(name string) error {
+	return app.keys.remove(name)
+}
+
+// ValidatorKeys returns the registered keys, ordered by name
+func (app *ProxyApplication) ValidatorKeys() []*ValidatorKey {
+	return app.keys.list()
+}
+
+// resolveValidators converts the validators given to the RPC to ABCI
+// ones, looking up the public keys of the validators given by name. It
+// also returns their power operations, nil if they all set their power.
+func (app *ProxyApplication) resolveValidators(validators []*ValidatorPowerChange) ([]*types.Validator, []PowerOp, error) {
+	res := make([]*types.Validator, 0, len(validators))
+	ops := make([]PowerOp, 0, len(validators))
+	for _, vpc := range validators {
+		pubKey := vpc.PubKey
+		if len(vpc.Name) != 0 {
+			k, ok := app.keys.get(vpc.Name)
+			if ok == false && pubKey.Empty() == true {
+				return nil, nil, fmt.Errorf("Unknown validator %s", vpc.Name)
+			}
+			if ok == true && pubKey.Empty() == false && pubKey.Equals(k.PubKey) == false {
+				return nil, nil, fmt.Errorf("Public key %X is not the one of validator %s", pubKey.Bytes(), vpc.Name)
+			}
+			if ok == true {
+				pubKey = k.PubKey
+			}
+		}
+		if pubKey.Empty() == true {
+			return nil, nil, fmt.Errorf("Validators require a public key or a registered name")
+		}
+		power := vpc.Power
+		op := vpc.Op
+		switch op {
+		case "", PowerSet:
+			op = PowerSet
+		case PowerIncrease, PowerDecrease:
+		case PowerRemove:
+			op = PowerSet
+			power = 0
+		default:
+			return nil, nil, fmt.Errorf("Unknown power operation %q, expected set, increase, decrease or remove", vpc.Op)
+		}
+		res = append(res, &types.Validator{
+			PubKey: pubKey.Bytes(),
+			Power:  power,
+		})
+		ops = append(ops, op)
+	}
+	if relativeOps(ops) == false {
+		ops = nil
+	}
+	return res, ops, nil
+}
+
+// resolveAbsoluteValidators is resolveValidators for the calls which
+// only support absolute voting powers
+func (app *ProxyApplication) resolveAbsoluteValidators(validators []*ValidatorPowerChange) ([]*types.Validator, error) {
+	res, ops, err := app.resolveValidators(validators)
+	if err != nil {
+		return nil, err
+	}
+	if ops != nil {
+		return nil, fmt.Errorf("Only the set and remove power operations are supported here")
+	}
+	return res, nil
+}
+
+// validatorPowerChanges converts validators for the RPC, with their
+// registered names
+func (app *ProxyApplication) validatorPowerChanges(validators []*types.Validator) ([]*ValidatorPowerChange, error) {
+	res, err := toValidatorPowerChanges(validators)
+	if err != nil {
+		return nil, err
+	}
+	for _, vpc := range res {
+		vpc.Name = app.keys.name(vpc.PubKey.Bytes())
+	}
+	return res, nil
+}
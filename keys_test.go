@@ -0,0 +1,113 @@
+package abciproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type KeysSuite struct {
+	testHome string
+	path     string
+	app      *ProxyApplication
+	key      *ValidatorKey
+}
+
+var _ = Suite(&KeysSuite{})
+
+func (s *KeysSuite) SetUpTest(c *C) {
+	var err error
+	s.testHome, err = ioutil.TempDir("", "abci_proxy_keys")
+	c.Assert(err, IsNil)
+	s.path = filepath.Join(s.testHome, "keys.json")
+	s.app = s.newApp(c)
+	s.key = &ValidatorKey{
+		Name:        "alice",
+		PubKey:      crypto.GenPrivKeyEd25519().Wrap().PubKey(),
+		Moniker:     "alice-node",
+		Contact:     "alice@example.com",
+		NodeAddress: "10.0.0.1:46656",
+	}
+	c.Assert(s.app.RegisterValidatorKey(s.key, false), IsNil)
+}
+
+func (s *KeysSuite) TearDownTest(c *C) {
+	c.Check(os.RemoveAll(s.testHome), IsNil)
+}
+
+func (s *KeysSuite) newApp(c *C) *ProxyApplication {
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	c.Assert(app.EnableKeyRegistry(s.path), IsNil)
+	app.InitChain(nil)
+	return app
+}
+
+func (s *KeysSuite) TestRegistryIsPersisted(c *C) {
+	app := s.newApp(c)
+	c.Check(app.ValidatorKeys(), DeepEquals, []*ValidatorKey{s.key})
+
+	c.Assert(app.RemoveValidatorKey("alice"), IsNil)
+	c.Check(s.newApp(c).ValidatorKeys(), HasLen, 0)
+	c.Check(app.RemoveValidatorKey("alice"), ErrorMatches, "Unknown validator alice")
+}
+
+func (s *KeysSuite) TestKeysHaveASingleName(c *C) {
+	err := s.app.RegisterValidatorKey(&ValidatorKey{Name: "bob", PubKey: s.key.PubKey}, false)
+	c.Check(err, ErrorMatches, "Public key .* is already registered as alice")
+	err = s.app.RegisterValidatorKey(&ValidatorKey{Name: "bob"}, false)
+	c.Check(err, ErrorMatches, "Validator key bob requires a public key")
+
+	// the key of a name is only changed on request
+	other := crypto.GenPrivKeyEd25519().Wrap().PubKey()
+	err = s.app.RegisterValidatorKey(&ValidatorKey{Name: "alice", PubKey: other}, false)
+	c.Check(err, ErrorMatches, "Validator alice is already registered with public key .*, it is only replaced on request")
+	c.Check(s.app.ValidatorKeys(), DeepEquals, []*ValidatorKey{s.key})
+	c.Assert(s.app.RegisterValidatorKey(&ValidatorKey{Name: "alice", PubKey: other}, true), IsNil)
+	c.Check(s.app.RegisterValidatorKey(&ValidatorKey{Name: "bob", PubKey: s.key.PubKey}, false), IsNil)
+}
+
+func (s *KeysSuite) TestMetadataCanBeUpdated(c *C) {
+	updated := *s.key
+	updated.Moniker = "alice-node-2"
+	c.Assert(s.app.RegisterValidatorKey(&updated, false), IsNil)
+	c.Check(s.app.ValidatorKeys(), DeepEquals, []*ValidatorKey{&updated})
+}
+
+func (s *KeysSuite) TestResolvesNames(c *C) {
+	other := crypto.GenPrivKeyEd25519().Wrap().PubKey()
+	validators, ops, err := s.app.resolveValidators([]*ValidatorPowerChange{
+		{Name: "alice", Power: 10},
+		{PubKey: other, Power: 5},
+		// unknown names are fine with a public key, like on peers
+		{Name: "carol", PubKey: other, Power: 5},
+	})
+	c.Assert(err, IsNil)
+	c.Check(ops, IsNil)
+	c.Check(validators, DeepEquals, []*types.Validator{
+		{PubKey: s.key.PubKey.Bytes(), Power: 10},
+		{PubKey: other.Bytes(), Power: 5},
+		{PubKey: other.Bytes(), Power: 5},
+	})
+
+	_, _, err = s.app.resolveValidators([]*ValidatorPowerChange{{Name: "carol", Power: 10}})
+	c.Check(err, ErrorMatches, "Unknown validator carol")
+	_, _, err = s.app.resolveValidators([]*ValidatorPowerChange{{Name: "alice", PubKey: other, Power: 10}})
+	c.Check(err, ErrorMatches, "Public key .* is not the one of validator alice")
+}
+
+func (s *KeysSuite) TestResultsHaveNames(c *C) {
+	other := crypto.GenPrivKeyEd25519().Wrap().PubKey()
+	res, err := s.app.validatorPowerChanges([]*types.Validator{
+		{PubKey: s.key.PubKey.Bytes(), Power: 10},
+		{PubKey: other.Bytes(), Power: 5},
+	})
+	c.Assert(err, IsNil)
+	c.Check(res[0].Name, Equals, "alice")
+	c.Check(res[1].Name, Equals, "")
+}
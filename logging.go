@@ -0,0 +1,222 @@
+package abciproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/tendermint/abci/types"
+	tmlog "github.com/tendermint/tmlibs/log"
+)
+
+// LogLevel is the verbosity of a log
+type LogLevel int
+
+const (
+	LogNone LogLevel = iota
+	LogError
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = map[string]LogLevel{
+	"none":  LogNone,
+	"error": LogError,
+	"info":  LogInfo,
+	"debug": LogDebug,
+}
+
+// abciMethod identifies the logged ABCI calls without any stack
+// introspection
+type abciMethod int
+
+const (
+	methodInfo abciMethod = iota
+	methodSetOption
+	methodDeliverTx
+	methodCheckTx
+	methodCommit
+	methodQuery
+	methodInitChain
+	methodBeginBlock
+	methodEndBlock
+	numMethods
+)
+
+var methodNames = [numMethods]string{
+	"info",
+	"set_option",
+	"deliver_tx",
+	"check_tx",
+	"commit",
+	"query",
+	"init_chain",
+	"begin_block",
+	"end_block",
+}
+
+func methodByName(name string) (abciMethod, bool) {
+	for i, n := range methodNames {
+		if n == name {
+			return abciMethod(i), true
+		}
+	}
+	return 0, false
+}
+
+// LogConfig is the verbosity of the logs. For ABCI methods, the level
+// is the one their calls are logged at (debug by default). For
+// modules, it is the most verbose level shown (Default if not set).
+type LogConfig struct {
+	Default LogLevel
+	Methods map[string]LogLevel
+	Modules map[string]LogLevel
+}
+
+// ParseLogConfig parses a comma separated list of method:level or
+// module:level, like "deliver_tx:none,end_block:info,rpc:error". The
+// default level is set with *:level.
+func ParseLogConfig(s string) (*LogConfig, error) {
+	res := &LogConfig{
+		Default: LogInfo,
+		Methods: make(map[string]LogLevel),
+		Modules: make(map[string]LogLevel),
+	}
+	if len(strings.TrimSpace(s)) == 0 {
+		return res, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.Split(strings.TrimSpace(item), ":")
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("Invalid log setting %q, expected <method or module>:<level>", item)
+		}
+		level, ok := logLevelNames[kv[1]]
+		if ok == false {
+			return nil, fmt.Errorf("Unknown log level %q, expected none, error, info or debug", kv[1])
+		}
+		if kv[0] == "*" {
+			res.Default = level
+		} else if _, ok := methodByName(kv[0]); ok == true {
+			res.Methods[kv[0]] = level
+		} else {
+			res.Modules[kv[0]] = level
+		}
+	}
+	return res, nil
+}
+
+// ModuleLevel returns the most verbose level shown for module
+func (cfg *LogConfig) ModuleLevel(module string) LogLevel {
+	if l, ok := cfg.Modules[module]; ok == true {
+		return l
+	}
+	return cfg.Default
+}
+
+func levelOption(l LogLevel) tmlog.Option {
+	switch l {
+	case LogNone:
+		return tmlog.AllowNone()
+	case LogError:
+		return tmlog.AllowError()
+	case LogInfo:
+		return tmlog.AllowInfo()
+	default:
+		return tmlog.AllowDebug()
+	}
+}
+
+func moduleOption(module string, l LogLevel) tmlog.Option {
+	switch l {
+	case LogNone:
+		return tmlog.AllowNoneWith("module", module)
+	case LogError:
+		return tmlog.AllowErrorWith("module", module)
+	case LogInfo:
+		return tmlog.AllowInfoWith("module", module)
+	default:
+		return tmlog.AllowDebugWith("module", module)
+	}
+}
+
+// Filter filters the logs of logger according to the module levels
+func (cfg *LogConfig) Filter(logger tmlog.Logger) tmlog.Logger {
+	options := []tmlog.Option{levelOption(cfg.Default)}
+	for module, l := range cfg.Modules {
+		options = append(options, moduleOption(module, l))
+	}
+	return tmlog.NewFilter(logger, options...)
+}
+
+// callLogger logs the ABCI calls received by the proxy
+type callLogger struct {
+	logger tmlog.Logger
+	levels [numMethods]LogLevel
+}
+
+func newCallLogger(logger tmlog.Logger) *callLogger {
+	res := &callLogger{logger: logger}
+	for i := range res.levels {
+		res.levels[i] = LogDebug
+	}
+	return res
+}
+
+// configure sets the level of each method from cfg. Calls which
+// would be filtered out by the level of module are not logged at all.
+func (l *callLogger) configure(cfg *LogConfig, module string) {
+	max := cfg.ModuleLevel(module)
+	for i, name := range methodNames {
+		level, ok := cfg.Methods[name]
+		if ok == false {
+			level = LogDebug
+		}
+		if level > max {
+			level = LogNone
+		}
+		l.levels[i] = level
+	}
+}
+
+func (l *callLogger) enabled(m abciMethod) bool {
+	return l.levels[m] != LogNone
+}
+
+func (l *callLogger) log(m abciMethod, keyvals ...interface{}) {
+	switch l.levels[m] {
+	case LogDebug:
+		l.logger.Debug(methodNames[m], keyvals...)
+	case LogInfo:
+		l.logger.Info(methodNames[m], keyvals...)
+	case LogError:
+		l.logger.Error(methodNames[m], keyvals...)
+	}
+}
+
+// tx logs a call on tx with its hash and size, instead of its bytes
+func (l *callLogger) tx(m abciMethod, tx []byte) {
+	if l.enabled(m) == false {
+		return
+	}
+	l.log(m, "tx_hash", TxHash(tx), "tx_size", len(tx))
+}
+
+func (l *callLogger) query(req types.RequestQuery) {
+	if l.enabled(methodQuery) == false {
+		return
+	}
+	l.log(methodQuery, "path", req.Path, "height", req.Height, "data_size", len(req.Data), "prove", req.Prove)
+}
+
+// TxHash is the short hex hash identifying tx in the logs
+func TxHash(tx []byte) string {
+	h := sha256.Sum256(tx)
+	return strings.ToUpper(hex.EncodeToString(h[:10]))
+}
+
+// ConfigureLogs sets the level of the logs of each ABCI call
+// received, with module the one of the proxy logger.
+func (app *ProxyApplication) ConfigureLogs(cfg *LogConfig, module string) {
+	app.calls.configure(cfg, module)
+}
@@ -0,0 +1,81 @@
+package abciproxy
+
+import (
+	"bytes"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	tmlog "github.com/tendermint/tmlibs/log"
+
+	. "gopkg.in/check.v1"
+)
+
+type LoggingSuite struct {
+	output *bytes.Buffer
+	app    *ProxyApplication
+}
+
+var _ = Suite(&LoggingSuite{})
+
+func (s *LoggingSuite) SetUpTest(c *C) {
+	s.output = &bytes.Buffer{}
+	logger := tmlog.NewTMLogger(s.output).With("module", "abci-proxy")
+	s.app = NewProxyAppWithLogger(abcicli.NewLocalClient(nil, NewTestApplication(false)), logger)
+}
+
+func (s *LoggingSuite) configure(c *C, config string) {
+	cfg, err := ParseLogConfig(config)
+	c.Assert(err, IsNil)
+	s.app.ConfigureLogs(cfg, "abci-proxy")
+}
+
+func (s *LoggingSuite) TestParseLogConfig(c *C) {
+	cfg, err := ParseLogConfig("deliver_tx:none, end_block:info,rpc:error,*:debug")
+	c.Assert(err, IsNil)
+	c.Check(cfg.Default, Equals, LogDebug)
+	c.Check(cfg.Methods, DeepEquals, map[string]LogLevel{"deliver_tx": LogNone, "end_block": LogInfo})
+	c.Check(cfg.Modules, DeepEquals, map[string]LogLevel{"rpc": LogError})
+	c.Check(cfg.ModuleLevel("rpc"), Equals, LogError)
+	c.Check(cfg.ModuleLevel("abci-server"), Equals, LogDebug)
+
+	cfg, err = ParseLogConfig("")
+	c.Assert(err, IsNil)
+	c.Check(cfg.Default, Equals, LogInfo)
+
+	_, err = ParseLogConfig("deliver_tx")
+	c.Check(err, ErrorMatches, "Invalid log setting .*")
+	_, err = ParseLogConfig("deliver_tx:verbose")
+	c.Check(err, ErrorMatches, "Unknown log level \"verbose\".*")
+}
+
+func (s *LoggingSuite) TestLogsTxHashAndSize(c *C) {
+	s.configure(c, "*:debug")
+	tx := []byte("some-secret-payload")
+	s.app.DeliverTx(tx)
+
+	out := s.output.String()
+	c.Check(out, Matches, "(?s).*deliver_tx.*")
+	c.Check(out, Matches, "(?s).*tx_hash="+TxHash(tx)+".*")
+	c.Check(out, Matches, "(?s).*tx_size=19.*")
+	c.Check(bytes.Contains(s.output.Bytes(), tx), Equals, false)
+}
+
+func (s *LoggingSuite) TestPerMethodLevels(c *C) {
+	s.configure(c, "deliver_tx:none,end_block:info")
+	s.app.DeliverTx([]byte{0x00})
+	s.app.EndBlock(1)
+	s.app.Commit()
+
+	out := s.output.String()
+	c.Check(out, Not(Matches), "(?s).*deliver_tx.*")
+	// commit is logged at debug, filtered out by the default info level
+	c.Check(out, Not(Matches), "(?s).*commit.*")
+	c.Check(out, Matches, "(?s)I\\[.*end_block.*height=1.*")
+}
+
+func (s *LoggingSuite) TestModuleLevelDisablesCalls(c *C) {
+	s.configure(c, "end_block:info,abci-proxy:error")
+	s.app.EndBlock(1)
+	s.app.Query(types.RequestQuery{Path: "tx"})
+	c.Check(s.output.String(), Equals, "")
+}
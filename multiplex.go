@@ -0,0 +1,240 @@
+package abciproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/tmlibs/merkle"
+)
+
+// Downstream is one of the applications a MultiplexApplication fans
+// out to. Txs and queries are forwarded unmodified.
+type Downstream struct {
+	Name string
+	// the consensus, mempool and query calls use separate connections,
+	// like for the target application of a ProxyApplication
+	Conns Connections
+	// txs starting with TxPrefix are sent to this application. The
+	// longest prefix wins, an empty one matches all txs.
+	TxPrefix []byte
+	// queries with a path starting with QueryPrefix are sent to this
+	// application. The longest prefix wins, an empty one matches all
+	// paths.
+	QueryPrefix string
+}
+
+// DownstreamConfig is the JSON description of a Downstream
+type DownstreamConfig struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	TxPrefix    string `json:"tx_prefix"`
+	QueryPrefix string `json:"query_prefix"`
+}
+
+// LoadDownstreamConfigs reads a JSON list of DownstreamConfig
+func LoadDownstreamConfigs(path string) ([]DownstreamConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res []DownstreamConfig
+	if err := json.Unmarshal(content, &res); err != nil {
+		return nil, fmt.Errorf("Could not parse downstream applications %s: %s", path, err)
+	}
+	return res, nil
+}
+
+// MultiplexApplication splits a single chain state across several
+// applications. DeliverTx/CheckTx are routed by tx prefix, Query by
+// path prefix, all other calls are broadcast in order. The app hash is
+// the merkle root of all the applications hashes, in order.
+//
+// It is meant to be used as the next application of a
+// ProxyApplication, through the Connections method.
+type MultiplexApplication struct {
+	types.BaseApplication
+	downstreams []*Downstream
+}
+
+var _ types.Application = &MultiplexApplication{}
+
+func NewMultiplexApplication(downstreams []*Downstream) (*MultiplexApplication, error) {
+	if len(downstreams) == 0 {
+		return nil, fmt.Errorf("Multiplexing requires at least one downstream application")
+	}
+	names := make(map[string]bool)
+	for _, d := range downstreams {
+		if names[d.Name] == true {
+			return nil, fmt.Errorf("Duplicate downstream application name %q", d.Name)
+		}
+		names[d.Name] = true
+	}
+	return &MultiplexApplication{downstreams: downstreams}, nil
+}
+
+// Connections returns a separate local client to app for each ABCI
+// connection. They do not share their mutex, so that a slow query does
+// not stall the consensus calls.
+func (app *MultiplexApplication) Connections() Connections {
+	return Connections{
+		Consensus: abcicli.NewLocalClient(nil, app),
+		Mempool:   abcicli.NewLocalClient(nil, app),
+		Query:     abcicli.NewLocalClient(nil, app),
+	}
+}
+
+func (app *MultiplexApplication) txDownstream(tx []byte) *Downstream {
+	var best *Downstream
+	for _, d := range app.downstreams {
+		if bytes.HasPrefix(tx, d.TxPrefix) == false {
+			continue
+		}
+		if best == nil || len(d.TxPrefix) > len(best.TxPrefix) {
+			best = d
+		}
+	}
+	return best
+}
+
+func (app *MultiplexApplication) queryDownstream(path string) *Downstream {
+	var best *Downstream
+	for _, d := range app.downstreams {
+		if strings.HasPrefix(path, d.QueryPrefix) == false {
+			continue
+		}
+		if best == nil || len(d.QueryPrefix) > len(best.QueryPrefix) {
+			best = d
+		}
+	}
+	return best
+}
+
+func combineHashes(hashes [][]byte) []byte {
+	return merkle.SimpleHashFromByteslices(hashes)
+}
+
+func (app *MultiplexApplication) Info() types.ResponseInfo {
+	res, err := app.CheckInfo()
+	if err != nil {
+		// Info cannot return an error, and the replay of the blocks
+		// some applications already committed would corrupt them
+		panic(err.Error())
+	}
+	return res
+}
+
+// CheckInfo returns the combined Info of the applications, or an error
+// if one of them cannot answer, or if they are not all at the same
+// height: they cannot be recovered by replaying the same blocks.
+func (app *MultiplexApplication) CheckInfo() (types.ResponseInfo, error) {
+	data := make(map[string]string, len(app.downstreams))
+	hashes := make([][]byte, 0, len(app.downstreams))
+	var res types.ResponseInfo
+	for i, d := range app.downstreams {
+		info, err := d.Conns.Query.InfoSync()
+		if err != nil {
+			return res, fmt.Errorf("Could not get the info of downstream application %s: %s", d.Name, err)
+		}
+		if i != 0 && info.LastBlockHeight != res.LastBlockHeight {
+			return res, fmt.Errorf("Downstream application %s is at height %d, %s is at height %d", d.Name, info.LastBlockHeight, app.downstreams[0].Name, res.LastBlockHeight)
+		}
+		data[d.Name] = info.Data
+		hashes = append(hashes, info.LastBlockAppHash)
+		res.LastBlockHeight = info.LastBlockHeight
+	}
+	bz, _ := json.Marshal(data)
+	res.Data = string(bz)
+	res.LastBlockAppHash = combineHashes(hashes)
+	return res, nil
+}
+
+func (app *MultiplexApplication) SetOption(key string, value string) (log string) {
+	logs := make([]string, 0, len(app.downstreams))
+	for _, d := range app.downstreams {
+		res := d.Conns.Query.SetOptionSync(key, value)
+		if len(res.Log) != 0 {
+			logs = append(logs, d.Name+": "+res.Log)
+		}
+	}
+	return strings.Join(logs, "; ")
+}
+
+func (app *MultiplexApplication) DeliverTx(tx []byte) types.Result {
+	d := app.txDownstream(tx)
+	if d == nil {
+		return types.ErrUnknownRequest.SetLog("No downstream application for tx")
+	}
+	return d.Conns.Consensus.DeliverTxSync(tx)
+}
+
+func (app *MultiplexApplication) CheckTx(tx []byte) types.Result {
+	d := app.txDownstream(tx)
+	if d == nil {
+		return types.ErrUnknownRequest.SetLog("No downstream application for tx")
+	}
+	return d.Conns.Mempool.CheckTxSync(tx)
+}
+
+// Commit commits all the applications, even if one fails, so that
+// they stay at the same height
+func (app *MultiplexApplication) Commit() types.Result {
+	hashes := make([][]byte, 0, len(app.downstreams))
+	var failed *types.Result
+	var logs []string
+	for _, d := range app.downstreams {
+		res := d.Conns.Consensus.CommitSync()
+		if res.IsErr() {
+			if failed == nil {
+				failed = &res
+			}
+			logs = append(logs, fmt.Sprintf("%s: %s", d.Name, res.Log))
+		}
+		hashes = append(hashes, res.Data)
+	}
+	if failed != nil {
+		return failed.SetLog(strings.Join(logs, "; "))
+	}
+	return types.NewResultOK(combineHashes(hashes), "")
+}
+
+func (app *MultiplexApplication) Query(reqQuery types.RequestQuery) types.ResponseQuery {
+	d := app.queryDownstream(reqQuery.Path)
+	if d == nil {
+		return types.ResponseQuery{
+			Code: types.CodeType_UnknownRequest,
+			Log:  fmt.Sprintf("No downstream application for path %s", reqQuery.Path),
+		}
+	}
+	// TODO: better error handling!
+	res, _ := d.Conns.Query.QuerySync(reqQuery)
+	return res
+}
+
+func (app *MultiplexApplication) InitChain(validators []*types.Validator) {
+	for _, d := range app.downstreams {
+		// TODO: better error handling!
+		_ = d.Conns.Consensus.InitChainSync(validators)
+	}
+}
+
+func (app *MultiplexApplication) BeginBlock(hash []byte, header *types.Header) {
+	for _, d := range app.downstreams {
+		// TODO: better error handling!
+		_ = d.Conns.Consensus.BeginBlockSync(hash, header)
+	}
+}
+
+func (app *MultiplexApplication) EndBlock(height uint64) types.ResponseEndBlock {
+	var res types.ResponseEndBlock
+	for _, d := range app.downstreams {
+		// TODO: better error handling!
+		r, _ := d.Conns.Consensus.EndBlockSync(height)
+		res.Diffs = mergeValidatorDiffs(res.Diffs, r.Diffs)
+	}
+	return res
+}
@@ -0,0 +1,185 @@
+package abciproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	tmlog "github.com/tendermint/tmlibs/log"
+
+	. "gopkg.in/check.v1"
+)
+
+type MultiplexSuite struct {
+	bank, store *TestApplication
+	mux         *MultiplexApplication
+	app         *ProxyApplication
+}
+
+var _ = Suite(&MultiplexSuite{})
+
+func (s *MultiplexSuite) SetUpTest(c *C) {
+	s.bank = NewTestApplication(false)
+	s.store = NewTestApplication(false)
+	var err error
+	s.mux, err = NewMultiplexApplication([]*Downstream{
+		&Downstream{
+			Name:        "bank",
+			Conns:       SharedConnections(abcicli.NewLocalClient(nil, s.bank)),
+			TxPrefix:    []byte("bank/"),
+			QueryPrefix: "/bank",
+		},
+		&Downstream{
+			Name:  "store",
+			Conns: SharedConnections(abcicli.NewLocalClient(nil, s.store)),
+		},
+	})
+	c.Assert(err, IsNil)
+	s.app = NewProxyAppWithConnections(s.mux.Connections(), tmlog.NewNopLogger())
+}
+
+func (s *MultiplexSuite) TestTxsAreRoutedByPrefix(c *C) {
+	s.app.CheckTx([]byte("bank/send"))
+	s.app.DeliverTx([]byte("bank/send"))
+	s.app.DeliverTx([]byte("something"))
+	s.app.DeliverTx([]byte("other"))
+
+	c.Check(s.bank.CheckTxCalls.Calls, HasLen, 1)
+	c.Check(s.bank.DeliverTxCalls.Calls, HasLen, 1)
+	c.Check(s.store.CheckTxCalls.Calls, HasLen, 0)
+	c.Check(s.store.DeliverTxCalls.Calls, HasLen, 2)
+}
+
+func (s *MultiplexSuite) TestQueriesAreRoutedByPath(c *C) {
+	s.app.Query(types.RequestQuery{Path: "/bank/balance"})
+	s.app.Query(types.RequestQuery{Path: "tx"})
+	c.Check(s.bank.QueryCalls.Calls, HasLen, 1)
+	c.Check(s.store.QueryCalls.Calls, HasLen, 1)
+}
+
+func (s *MultiplexSuite) TestCommitCombinesHashes(c *C) {
+	s.app.DeliverTx([]byte("bank/send"))
+	s.app.DeliverTx([]byte("a"))
+	s.app.DeliverTx([]byte("b"))
+
+	res := s.app.Commit()
+	c.Assert(res.IsOK(), Equals, true)
+
+	bankHash := make([]byte, 8)
+	binary.BigEndian.PutUint64(bankHash, 1)
+	storeHash := make([]byte, 8)
+	binary.BigEndian.PutUint64(storeHash, 2)
+	c.Check([]byte(res.Data), DeepEquals, combineHashes([][]byte{bankHash, storeHash}))
+	c.Check(s.bank.CommitCalls.Calls, HasLen, 1)
+	c.Check(s.store.CommitCalls.Calls, HasLen, 1)
+}
+
+func (s *MultiplexSuite) TestBlockCallsAreBroadcast(c *C) {
+	s.app.InitChain(nil)
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+	s.app.EndBlock(1)
+	c.Check(s.bank.EndBlockCalls.Calls, HasLen, 1)
+	c.Check(s.store.EndBlockCalls.Calls, HasLen, 1)
+
+	info := s.app.Info()
+	data := make(map[string]string)
+	c.Assert(json.Unmarshal([]byte(info.Data), &data), IsNil)
+	c.Check(data, HasLen, 2)
+	c.Check(s.bank.InfoCalls.Calls, HasLen, 1)
+	c.Check(s.store.InfoCalls.Calls, HasLen, 1)
+}
+
+func (s *MultiplexSuite) TestInfoFailsOnDifferentHeights(c *C) {
+	_, err := s.mux.CheckInfo()
+	c.Check(err, IsNil)
+
+	// only bank committed the block
+	s.bank.EndBlock(1)
+	s.bank.Commit()
+	_, err = s.mux.CheckInfo()
+	c.Check(err, ErrorMatches, "Downstream application store is at height 0, bank is at height 1")
+	c.Check(func() { s.mux.Info() }, PanicMatches, "Downstream application store is at height 0, bank is at height 1")
+}
+
+// failingCommitApplication is a TestApplication whose commits fail
+type failingCommitApplication struct {
+	*TestApplication
+}
+
+func (app failingCommitApplication) Commit() types.Result {
+	app.CommitCalls.Notify()
+	return types.ErrInternalError.SetLog("disk full")
+}
+
+func (s *MultiplexSuite) TestCommitsAllApplicationsBeforeFailing(c *C) {
+	mux, err := NewMultiplexApplication([]*Downstream{
+		&Downstream{
+			Name:  "bank",
+			Conns: SharedConnections(abcicli.NewLocalClient(nil, failingCommitApplication{s.bank})),
+		},
+		&Downstream{
+			Name:  "store",
+			Conns: SharedConnections(abcicli.NewLocalClient(nil, s.store)),
+		},
+	})
+	c.Assert(err, IsNil)
+
+	res := mux.Commit()
+	c.Check(res.Code, Equals, types.CodeType_InternalError)
+	c.Check(res.Log, Equals, "bank: disk full")
+	c.Check(s.bank.CommitCalls.Calls, HasLen, 1)
+	c.Check(s.store.CommitCalls.Calls, HasLen, 1)
+}
+
+func (s *MultiplexSuite) TestNamesShouldBeUnique(c *C) {
+	_, err := NewMultiplexApplication([]*Downstream{
+		&Downstream{Name: "a"},
+		&Downstream{Name: "a"},
+	})
+	c.Check(err, ErrorMatches, "Duplicate downstream application name \"a\"")
+}
+
+func (s *MultiplexSuite) TestQueriesDoNotStallBlocks(c *C) {
+	slow := &slowQueryApplication{
+		TestApplication: NewTestApplication(false),
+		release:         make(chan struct{}),
+	}
+	mux, err := NewMultiplexApplication([]*Downstream{
+		&Downstream{
+			Name: "slow",
+			Conns: Connections{
+				Consensus: abcicli.NewLocalClient(nil, slow),
+				Mempool:   abcicli.NewLocalClient(nil, slow),
+				Query:     abcicli.NewLocalClient(nil, slow),
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	app := NewProxyAppWithConnections(mux.Connections(), tmlog.NewNopLogger())
+
+	queried := make(chan types.ResponseQuery)
+	go func() {
+		queried <- app.Query(types.RequestQuery{Path: "tx"})
+	}()
+	done := make(chan struct{})
+	go func() {
+		app.BeginBlock(nil, &types.Header{Height: 1})
+		app.DeliverTx([]byte{0x00})
+		app.EndBlock(1)
+		app.Commit()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(slow.release)
+		c.Fatal("block processing was stalled by a pending query")
+	}
+	c.Check(slow.CommitCalls.Calls, HasLen, 1)
+
+	close(slow.release)
+	c.Check((<-queried).Value, DeepEquals, []byte("slow"))
+}
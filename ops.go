@@ -0,0 +1,130 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/tendermint/abci/types"
+)
+
+// PowerOp tells how the power of a validator change applies to the
+// voting power the validator has when the change is emitted
+type PowerOp string
+
+const (
+	// the power is the new voting power
+	PowerSet PowerOp = "set"
+	// the power is added to, or removed from, the current one
+	PowerIncrease PowerOp = "increase"
+	PowerDecrease PowerOp = "decrease"
+	// the validator is removed, whatever its power
+	PowerRemove PowerOp = "remove"
+)
+
+// powerOpError is an operation which cannot be applied to the
+// validator set
+type powerOpError struct {
+	// index of the diff in its change
+	index int
+	msg   string
+}
+
+func (e *powerOpError) Error() string {
+	return e.msg
+}
+
+// opAt returns the operation of the diff i, diffs without operation
+// set their power
+func opAt(ops []PowerOp, i int) PowerOp {
+	if i < len(ops) && len(ops[i]) != 0 {
+		return ops[i]
+	}
+	return PowerSet
+}
+
+// relativeOps returns true if some diffs are relative to the current
+// voting power
+func relativeOps(ops []PowerOp) bool {
+	for i := range ops {
+		if opAt(ops, i) != PowerSet {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeOps returns the operations of the diffs of two changes merged
+// by mergeValidatorDiffs
+func mergeOps(ops []PowerOp, n int, newOps []PowerOp, newN int) []PowerOp {
+	if relativeOps(ops) == false && relativeOps(newOps) == false {
+		return nil
+	}
+	res := make([]PowerOp, 0, n+newN)
+	for i := 0; i < n; i++ {
+		res = append(res, opAt(ops, i))
+	}
+	for i := 0; i < newN; i++ {
+		res = append(res, opAt(newOps, i))
+	}
+	return res
+}
+
+// resolveDiffs applies in order the operations of diffs to the voting
+// powers of vs, which is left untouched, and returns the resulting
+// absolute diffs.
+func resolveDiffs(vs *validatorSet, diffs []*types.Validator, ops []PowerOp) ([]*types.Validator, error) {
+	if relativeOps(ops) == false {
+		return diffs, nil
+	}
+	// powers already changed by previous diffs
+	changed := make(map[string]uint64)
+	res := make([]*types.Validator, 0, len(diffs))
+	for i, v := range diffs {
+		key := hex.EncodeToString(v.PubKey)
+		current, ok := changed[key]
+		if ok == false {
+			current = vs.power(v.PubKey)
+		}
+		power := v.Power
+		switch opAt(ops, i) {
+		case PowerIncrease:
+			power = current + v.Power
+		case PowerDecrease:
+			if v.Power > current {
+				return nil, &powerOpError{
+					index: i,
+					msg:   fmt.Sprintf("Decreasing the power of validator %X by %d would make it negative (power:%d)", v.PubKey, v.Power, current),
+				}
+			}
+			power = current - v.Power
+		}
+		changed[key] = power
+		res = append(res, &types.Validator{PubKey: v.PubKey, Power: power})
+	}
+	return res, nil
+}
+
+// resolveScheduledChange returns the diffs to emit for c, resolved
+// against the tracked validator set. The changes which cannot be
+// resolved anymore are marked failed and left out. app.mtx should be
+// held.
+func (app *ProxyApplication) resolveScheduledChange(c ValidatorSetChange, height uint64) []*types.Validator {
+	for {
+		diffs, err := resolveDiffs(app.validators, c.Diffs, c.Ops)
+		if err == nil {
+			return diffs
+		}
+		app.logger.Error("dropping validator change which cannot be applied", "height", height, "error", err)
+		index := err.(*powerOpError).index
+		id := c.changeAt(index)
+		if id == 0 {
+			c = c.withoutDiff(index)
+			continue
+		}
+		if status, ok := app.changes[id]; ok == true {
+			status.Status = ChangeFailed
+			status.Height = height
+		}
+		c = c.withoutChange(id)
+	}
+}
@@ -0,0 +1,97 @@
+package abciproxy
+
+import (
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type OpsSuite struct {
+	app  *ProxyApplication
+	keys []crypto.PubKey
+}
+
+var _ = Suite(&OpsSuite{})
+
+func (s *OpsSuite) SetUpTest(c *C) {
+	s.keys = nil
+	for i := 0; i < 2; i++ {
+		s.keys = append(s.keys, crypto.GenPrivKeyEd25519().Wrap().PubKey())
+	}
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	s.app.InitChain([]*types.Validator{s.validator(0, 10)})
+}
+
+func (s *OpsSuite) validator(i int, power uint64) *types.Validator {
+	return &types.Validator{PubKey: s.keys[i].Bytes(), Power: power}
+}
+
+func (s *OpsSuite) schedule(c *C, v *types.Validator, op PowerOp, height uint64) uint64 {
+	status, err := s.app.ScheduleValidatorPowerChanges([]*types.Validator{v}, []PowerOp{op}, height)
+	c.Assert(err, IsNil)
+	return status.ID
+}
+
+func (s *OpsSuite) TestResolvesAtEndBlock(c *C) {
+	s.schedule(c, s.validator(0, 5), PowerIncrease, 2)
+	s.app.EndBlock(1)
+	s.schedule(c, s.validator(0, 12), PowerDecrease, 3)
+	c.Check(s.app.EndBlock(2).Diffs, DeepEquals, []*types.Validator{s.validator(0, 15)})
+	c.Check(s.app.EndBlock(3).Diffs, DeepEquals, []*types.Validator{s.validator(0, 3)})
+	c.Check(s.app.Validators(), DeepEquals, []*types.Validator{s.validator(0, 3)})
+}
+
+func (s *OpsSuite) TestOperationsOfAHeightApplyInOrder(c *C) {
+	_, err := s.app.ScheduleValidatorPowerChanges(
+		[]*types.Validator{s.validator(0, 4), s.validator(0, 10), s.validator(1, 2)},
+		[]PowerOp{PowerDecrease, PowerIncrease, PowerIncrease}, 2)
+	c.Assert(err, IsNil)
+	s.app.EndBlock(1)
+	c.Check(s.app.EndBlock(2).Diffs, DeepEquals, []*types.Validator{
+		s.validator(0, 6), s.validator(0, 16), s.validator(1, 2),
+	})
+}
+
+func (s *OpsSuite) TestRefusesNegativePower(c *C) {
+	_, err := s.app.ScheduleValidatorPowerChanges([]*types.Validator{s.validator(0, 11)}, []PowerOp{PowerDecrease}, 2)
+	c.Check(err, ErrorMatches, "Decreasing the power of validator .* by 11 would make it negative \\(power:10\\)")
+
+	_, err = s.app.SimulateValidatorPowerChanges([]*types.Validator{s.validator(1, 1)}, []PowerOp{PowerDecrease}, 2)
+	c.Check(err, ErrorMatches, "Decreasing the power of validator .* by 1 would make it negative \\(power:0\\)")
+}
+
+func (s *OpsSuite) TestFailsChangeWhichGoesNegative(c *C) {
+	failing := s.schedule(c, s.validator(0, 5), PowerDecrease, 4)
+	s.app.EndBlock(1)
+	other := s.schedule(c, s.validator(1, 4), PowerSet, 4)
+	s.app.EndBlock(2)
+	// scheduled after, but emitted before the decrease
+	s.schedule(c, s.validator(0, 3), PowerSet, 3)
+	c.Check(s.app.EndBlock(3).Diffs, DeepEquals, []*types.Validator{s.validator(0, 3)})
+
+	c.Check(s.app.EndBlock(4).Diffs, DeepEquals, []*types.Validator{s.validator(1, 4)})
+	status, err := s.app.ValidatorChangeStatus(failing)
+	c.Assert(err, IsNil)
+	c.Check(status.Status, Equals, ChangeFailed)
+	c.Check(status.Height, Equals, uint64(4))
+	status, err = s.app.ValidatorChangeStatus(other)
+	c.Assert(err, IsNil)
+	c.Check(status.Status, Equals, ChangeApplied)
+}
+
+func (s *OpsSuite) TestResolvesRPCOperations(c *C) {
+	validators, ops, err := s.app.resolveValidators([]*ValidatorPowerChange{
+		{PubKey: s.keys[0], Power: 3, Op: PowerRemove},
+		{PubKey: s.keys[1], Power: 2, Op: PowerIncrease},
+	})
+	c.Assert(err, IsNil)
+	c.Check(validators, DeepEquals, []*types.Validator{s.validator(0, 0), s.validator(1, 2)})
+	c.Check(ops, DeepEquals, []PowerOp{PowerSet, PowerIncrease})
+
+	_, _, err = s.app.resolveValidators([]*ValidatorPowerChange{{PubKey: s.keys[0], Op: "double"}})
+	c.Check(err, ErrorMatches, "Unknown power operation \"double\".*")
+	_, err = s.app.resolveAbsoluteValidators([]*ValidatorPowerChange{{PubKey: s.keys[0], Power: 1, Op: PowerIncrease}})
+	c.Check(err, ErrorMatches, "Only the set and remove power operations are supported here")
+}
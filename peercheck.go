@@ -0,0 +1,348 @@
+package abciproxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventPeerDivergence is fired on the RPC websocket when the validator
+// change schedule of a peer proxy differs from ours
+const EventPeerDivergence = "peer_divergence"
+
+// HeightHash is the hash of the validator diffs scheduled at a height
+type HeightHash struct {
+	Height uint64 `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// ValidatorScheduleResult describes the validator changes a proxy will
+// emit between two heights, to compare them with the ones of its peers
+type ValidatorScheduleResult struct {
+	// current height of the proxy
+	Height     uint64 `json:"height"`
+	FromHeight uint64 `json:"from_height"`
+	ToHeight   uint64 `json:"to_height"`
+	// hash of the whole schedule
+	Hash string `json:"hash"`
+	// hashes of the heights with changes, ordered by height
+	Heights []*HeightHash `json:"heights"`
+}
+
+// PeerDivergence is a difference between our validator change schedule
+// and the one of a peer
+type PeerDivergence struct {
+	Peer string `json:"peer"`
+	// height of the check
+	Height uint64 `json:"height"`
+	// heights where the schedules differ
+	Heights []uint64 `json:"heights"`
+}
+
+// PeerCheckStatus summarizes the comparisons of the schedules with the
+// peers
+type PeerCheckStatus struct {
+	Enabled bool   `json:"enabled"`
+	Window  uint64 `json:"window"`
+	// height of the last check
+	Height      uint64 `json:"height"`
+	Checks      uint64 `json:"checks"`
+	Divergences uint64 `json:"divergences"`
+	PeerErrors  uint64 `json:"peer_errors"`
+	// diverging peers found by the last check
+	Diverging []*PeerDivergence `json:"diverging"`
+	// errors of the last check, by peer
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// peerCheck compares periodically the validator change schedule of the
+// proxy with the ones of its peers. It only raises alerts: the
+// comparisons are made by each node at its own time, so they cannot
+// decide which diffs are emitted without forking the chain. The
+// operators refuse the diverging heights with
+// BroadcastValidatorHeightRefusal instead.
+type peerCheck struct {
+	mtx    sync.Mutex
+	status PeerCheckStatus
+}
+
+// ValidatorSchedule returns the hashes of the validator diffs scheduled
+// from fromHeight to toHeight included. Two proxies with the same
+// schedule emit exactly the same diffs at these heights.
+func (app *ProxyApplication) ValidatorSchedule(fromHeight, toHeight uint64) *ValidatorScheduleResult {
+	res := &ValidatorScheduleResult{
+		Height:     app.currentHeight(),
+		FromHeight: fromHeight,
+		ToHeight:   toHeight,
+		Heights:    make([]*HeightHash, 0),
+	}
+	all := sha256.New()
+	for _, c := range app.PendingValidatorChanges() {
+		if c.ScheduledHeight < fromHeight || c.ScheduledHeight > toHeight {
+			continue
+		}
+		h := diffsHash(c.ScheduledHeight, c)
+		all.Write(h)
+		res.Heights = append(res.Heights, &HeightHash{
+			Height: c.ScheduledHeight,
+			Hash:   hex.EncodeToString(h),
+		})
+	}
+	res.Hash = hex.EncodeToString(all.Sum(nil))
+	return res
+}
+
+// diffsHash hashes the diffs of c and their operations in order, as
+// they are emitted
+func diffsHash(height uint64, c ValidatorSetChange) []byte {
+	h := sha256.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+	h.Write(buf[:binary.PutUvarint(buf, height)])
+	for i, v := range c.Diffs {
+		h.Write(buf[:binary.PutUvarint(buf, uint64(len(v.PubKey)))])
+		h.Write(v.PubKey)
+		h.Write(buf[:binary.PutUvarint(buf, v.Power)])
+		op := opAt(c.Ops, i)
+		h.Write(buf[:binary.PutUvarint(buf, uint64(len(op)))])
+		h.Write([]byte(op))
+	}
+	return h.Sum(nil)
+}
+
+// divergingHeights returns the heights above skip where the schedules
+// ours and theirs differ
+func divergingHeights(ours, theirs *ValidatorScheduleResult, skip uint64) []uint64 {
+	hashes := make(map[uint64]string)
+	for _, h := range ours.Heights {
+		hashes[h.Height] = h.Hash
+	}
+	diverging := make(map[uint64]bool)
+	for _, h := range theirs.Heights {
+		if hashes[h.Height] != h.Hash {
+			diverging[h.Height] = true
+		}
+		delete(hashes, h.Height)
+	}
+	for height := range hashes {
+		diverging[height] = true
+	}
+	res := make([]uint64, 0, len(diverging))
+	for height := range diverging {
+		if height > skip {
+			res = append(res, height)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// EnablePeerCheck makes CheckPeerSchedules compare the next window
+// heights of the schedule with the peers.
+func (app *ProxyApplication) EnablePeerCheck(window uint64) {
+	app.peerCheck = &peerCheck{
+		status: PeerCheckStatus{
+			Enabled: true,
+			Window:  window,
+		},
+	}
+}
+
+// StartPeerCheck runs CheckPeerSchedules every interval
+func (app *ProxyApplication) StartPeerCheck(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if _, err := app.CheckPeerSchedules(); err != nil {
+				app.logger.Error("could not check the peer schedules", "error", err)
+			}
+		}
+	}()
+}
+
+// CheckPeerSchedules compares the validator change schedule with the
+// one of every peer, and raises an alert for each diverging peer.
+func (app *ProxyApplication) CheckPeerSchedules() (*PeerCheckStatus, error) {
+	pc := app.peerCheck
+	if pc == nil {
+		return nil, fmt.Errorf("The peer check is not enabled")
+	}
+	if _, known := app.knownHeight(); known == false {
+		return nil, fmt.Errorf("The current block height is not known yet, waiting for the handshake with Tendermint")
+	}
+	pc.mtx.Lock()
+	window := pc.status.Window
+	pc.mtx.Unlock()
+
+	height := app.currentHeight()
+	ours := app.ValidatorSchedule(height+1, height+window)
+	var wg sync.WaitGroup
+	results := make([]*ValidatorScheduleResult, len(app.peers))
+	errs := make([]error, len(app.peers))
+	for i, p := range app.peers {
+		wg.Add(1)
+		go func(i int, p *Peer) {
+			defer wg.Done()
+			results[i], errs[i] = p.Client.ValidatorSchedule(ours.FromHeight, ours.ToHeight)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var divergences []*PeerDivergence
+	peerErrors := make(map[string]string)
+	for i, p := range app.peers {
+		if errs[i] != nil {
+			app.logger.Error("could not get the validator schedule of a peer", "peer", p.Name, "error", errs[i])
+			peerErrors[p.Name] = errs[i].Error()
+			continue
+		}
+		if results[i].Hash == ours.Hash {
+			continue
+		}
+		// the heights a peer already processed are no longer in its
+		// schedule
+		skip := height
+		if results[i].Height > skip {
+			skip = results[i].Height
+		}
+		heights := divergingHeights(ours, results[i], skip)
+		if len(heights) == 0 {
+			continue
+		}
+		d := &PeerDivergence{Peer: p.Name, Height: height, Heights: heights}
+		app.logger.Error("validator change schedule diverges from peer", "peer", p.Name, "heights", heights)
+		app.fireEvent(EventPeerDivergence, d)
+		divergences = append(divergences, d)
+	}
+
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	pc.status.Height = height
+	pc.status.Checks++
+	pc.status.Divergences += uint64(len(divergences))
+	pc.status.PeerErrors += uint64(len(peerErrors))
+	pc.status.Diverging = divergences
+	pc.status.Errors = peerErrors
+	res := pc.status
+	return &res, nil
+}
+
+// PeerCheckStatus returns the result of the peer checks so far
+func (app *ProxyApplication) PeerCheckStatus() *PeerCheckStatus {
+	pc := app.peerCheck
+	if pc == nil {
+		return &PeerCheckStatus{}
+	}
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	res := pc.status
+	return &res
+}
+
+// RefuseValidatorHeightResult is the outcome of RefuseValidatorHeight
+type RefuseValidatorHeightResult struct {
+	Height uint64 `json:"height"`
+	// IDs of the pending changes which were refused
+	Refused []uint64 `json:"refused"`
+}
+
+// RefuseValidatorHeight drops the diffs scheduled at height, and makes
+// the proxy emit none at this height. Like a change, it must be made
+// before the height, on every proxy, for the nodes to agree.
+func (app *ProxyApplication) RefuseValidatorHeight(height uint64) (*RefuseValidatorHeightResult, error) {
+	if err := app.checkScheduledHeight(height); err != nil {
+		return nil, err
+	}
+	if earliest := app.currentHeight() + app.minLead; app.minLead != 0 && height < earliest {
+		return nil, fmt.Errorf("Validator heights must be refused at least %d blocks ahead (wanted:%d, earliest:%d)", app.minLead, height, earliest)
+	}
+
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	// EndBlock may have reached the height in the meantime
+	if height <= app.lastHeight {
+		return nil, fmt.Errorf("Could not refuse a block height back in time (wanted:%d, current:%d)", height, app.lastHeight)
+	}
+	app.refusedHeights[height] = true
+	res := &RefuseValidatorHeightResult{Height: height, Refused: make([]uint64, 0)}
+	if c, ok := app.diffs[height]; ok == true {
+		app.setChangesStatus(c.IDs, ChangeRefused, app.lastHeight)
+		res.Refused = append(res.Refused, c.IDs...)
+		delete(app.diffs, height)
+	}
+	app.logger.Info("refused validator height", "height", height, "changes", res.Refused)
+	return res, nil
+}
+
+// RefusalBroadcastResult is the outcome of
+// BroadcastValidatorHeightRefusal
+type RefusalBroadcastResult struct {
+	Height uint64 `json:"height"`
+	// IDs of the local changes which were refused
+	Refused []uint64 `json:"refused"`
+	// true if every peer refused the height too
+	Committed bool                   `json:"committed"`
+	Peers     []*PeerBroadcastStatus `json:"peers"`
+	// names of the peers which did not refuse the height, and of the
+	// ones whose outcome is unknown
+	Failed  []string `json:"failed"`
+	Unknown []string `json:"unknown"`
+}
+
+// BroadcastValidatorHeightRefusal refuses height on this proxy and all
+// the peers, for instance after the peer check found their schedules
+// diverging at this height. A refusal cannot be rolled back: the peers
+// which failed should be retried before the height.
+func (app *ProxyApplication) BroadcastValidatorHeightRefusal(height uint64) (*RefusalBroadcastResult, error) {
+	local, err := app.RefuseValidatorHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	res := &RefusalBroadcastResult{
+		Height:  height,
+		Refused: local.Refused,
+		Peers:   make([]*PeerBroadcastStatus, len(app.peers)),
+		Failed:  make([]string, 0),
+		Unknown: make([]string, 0),
+	}
+
+	var wg sync.WaitGroup
+	for i, p := range app.peers {
+		res.Peers[i] = &PeerBroadcastStatus{Peer: p.Name}
+		wg.Add(1)
+		go func(p *Peer, status *PeerBroadcastStatus) {
+			defer wg.Done()
+			err := p.Client.RefuseValidatorHeight(height)
+			if _, refused := err.(*PeerRefusal); refused == true {
+				status.Outcome = PeerRefused
+				status.Error = err.Error()
+				return
+			} else if err != nil {
+				status.Outcome = PeerUnknown
+				status.Error = err.Error()
+				return
+			}
+			status.Outcome = PeerAccepted
+		}(p, res.Peers[i])
+	}
+	wg.Wait()
+
+	for _, status := range res.Peers {
+		switch status.Outcome {
+		case PeerRefused:
+			res.Failed = append(res.Failed, status.Peer)
+		case PeerUnknown:
+			res.Unknown = append(res.Unknown, status.Peer)
+		}
+	}
+	res.Committed = len(res.Failed) == 0 && len(res.Unknown) == 0
+	if res.Committed == false {
+		app.logger.Error("validator height refusal broadcast failed",
+			"height", height,
+			"failed", res.Failed,
+			"unknown", res.Unknown)
+	}
+	return res, nil
+}
@@ -0,0 +1,172 @@
+package abciproxy
+
+import (
+	"fmt"
+
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/tmlibs/events"
+
+	. "gopkg.in/check.v1"
+)
+
+type PeerCheckSuite struct {
+	app   *ProxyApplication
+	peers []*localPeer
+	diffs []*types.Validator
+}
+
+var _ = Suite(&PeerCheckSuite{})
+
+func (s *PeerCheckSuite) SetUpTest(c *C) {
+	s.app = newStartedProxy()
+	s.peers = nil
+	for i := 0; i < 2; i++ {
+		p := &localPeer{app: newStartedProxy()}
+		s.peers = append(s.peers, p)
+		s.app.AddPeer(&Peer{Name: fmt.Sprintf("peer%d", i), Client: p})
+	}
+	s.diffs = []*types.Validator{
+		&types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		},
+	}
+}
+
+// schedule schedules diffs at height on every given proxy, and makes
+// them see the first block
+func (s *PeerCheckSuite) schedule(c *C, diffs []*types.Validator, height uint64, apps ...*ProxyApplication) {
+	for _, app := range apps {
+		c.Assert(app.ChangeValidators(diffs, height), IsNil)
+		app.EndBlock(1)
+	}
+}
+
+func (s *PeerCheckSuite) TestSameSchedulesAgree(c *C) {
+	s.app.EnablePeerCheck(10)
+	s.schedule(c, s.diffs, 3, s.app, s.peers[0].app, s.peers[1].app)
+
+	ours := s.app.ValidatorSchedule(2, 11)
+	c.Check(ours.Heights, HasLen, 1)
+	c.Check(s.peers[0].app.ValidatorSchedule(2, 11), DeepEquals, ours)
+
+	status, err := s.app.CheckPeerSchedules()
+	c.Assert(err, IsNil)
+	c.Check(status.Checks, Equals, uint64(1))
+	c.Check(status.Divergences, Equals, uint64(0))
+	c.Check(status.Diverging, HasLen, 0)
+}
+
+func (s *PeerCheckSuite) TestDetectsDivergingPeer(c *C) {
+	s.app.EnablePeerCheck(10)
+	s.schedule(c, s.diffs, 3, s.app, s.peers[0].app)
+	s.peers[1].app.EndBlock(1)
+
+	var fired []*PeerDivergence
+	s.app.evsw.AddListenerForEvent("test", EventPeerDivergence, func(data events.EventData) {
+		fired = append(fired, data.(*PeerDivergence))
+	})
+
+	status, err := s.app.CheckPeerSchedules()
+	c.Assert(err, IsNil)
+	c.Check(status.Divergences, Equals, uint64(1))
+	c.Assert(status.Diverging, HasLen, 1)
+	c.Check(status.Diverging[0].Peer, Equals, "peer1")
+	c.Check(status.Diverging[0].Heights, DeepEquals, []uint64{3})
+	c.Check(fired, DeepEquals, status.Diverging)
+
+	// the diffs are still emitted
+	s.app.EndBlock(2)
+	c.Check(s.app.EndBlock(3).Diffs, DeepEquals, s.diffs)
+}
+
+func (s *PeerCheckSuite) TestIgnoresHeightsProcessedByPeer(c *C) {
+	s.app.EnablePeerCheck(10)
+	s.schedule(c, s.diffs, 2, s.app, s.peers[0].app, s.peers[1].app)
+	// the peer already emitted the diffs of height 2
+	s.peers[1].app.EndBlock(2)
+
+	status, err := s.app.CheckPeerSchedules()
+	c.Assert(err, IsNil)
+	c.Check(status.Diverging, HasLen, 0)
+}
+
+func (s *PeerCheckSuite) TestCountsPeerErrors(c *C) {
+	s.app.EnablePeerCheck(10)
+	s.peers[0].fail = true
+
+	status, err := s.app.CheckPeerSchedules()
+	c.Assert(err, IsNil)
+	c.Check(status.PeerErrors, Equals, uint64(1))
+	c.Check(status.Errors, DeepEquals, map[string]string{"peer0": "peer is down"})
+}
+
+func (s *PeerCheckSuite) TestCountersAccumulate(c *C) {
+	s.app.EnablePeerCheck(10)
+	s.schedule(c, s.diffs, 3, s.app)
+	s.peers[0].app.EndBlock(1)
+	s.peers[1].fail = true
+	for i := 0; i < 2; i++ {
+		_, err := s.app.CheckPeerSchedules()
+		c.Assert(err, IsNil)
+	}
+
+	status := s.app.PeerCheckStatus()
+	c.Check(status.Checks, Equals, uint64(2))
+	c.Check(status.Divergences, Equals, uint64(2))
+	c.Check(status.PeerErrors, Equals, uint64(2))
+	c.Check(status.Diverging, HasLen, 1)
+}
+
+func (s *PeerCheckSuite) TestRefusesDivergingHeights(c *C) {
+	s.app.EnablePeerCheck(10)
+	s.schedule(c, s.diffs, 3, s.app, s.peers[0].app)
+	s.peers[1].app.EndBlock(1)
+	status, err := s.app.CheckPeerSchedules()
+	c.Assert(err, IsNil)
+	c.Assert(status.Diverging, HasLen, 1)
+	changes := s.app.PendingValidatorChanges()
+	c.Assert(changes, HasLen, 1)
+
+	res, err := s.app.BroadcastValidatorHeightRefusal(3)
+	c.Assert(err, IsNil)
+	c.Check(res.Committed, Equals, true)
+	c.Check(res.Refused, DeepEquals, changes[0].IDs)
+	refused, err := s.app.ValidatorChangeStatus(changes[0].IDs[0])
+	c.Assert(err, IsNil)
+	c.Check(refused.Status, Equals, ChangeRefused)
+
+	// the schedules agree again, and the height stays refused
+	status, err = s.app.CheckPeerSchedules()
+	c.Assert(err, IsNil)
+	c.Check(status.Diverging, HasLen, 0)
+	_, err = s.app.ScheduleValidatorChange(s.diffs, 3)
+	c.Check(err, ErrorMatches, "Validator changes at height 3 are refused")
+
+	for i, app := range []*ProxyApplication{s.app, s.peers[0].app, s.peers[1].app} {
+		app.EndBlock(2)
+		c.Check(app.EndBlock(3).Diffs, HasLen, 0, Commentf("node %d", i))
+	}
+}
+
+func (s *PeerCheckSuite) TestRefusalReportsFailingPeers(c *C) {
+	s.peers[0].fail = true
+	s.peers[1].app.EndBlock(3)
+
+	res, err := s.app.BroadcastValidatorHeightRefusal(3)
+	c.Assert(err, IsNil)
+	c.Check(res.Committed, Equals, false)
+	c.Check(res.Unknown, DeepEquals, []string{"peer0"})
+	c.Check(res.Failed, DeepEquals, []string{"peer1"})
+	c.Check(res.Peers[1].Error, Matches, "Could not schedule for a block height back in time.*")
+
+	_, err = s.app.RefuseValidatorHeight(0)
+	c.Check(err, ErrorMatches, "Could not schedule for a block height back in time.*")
+}
+
+func (s *PeerCheckSuite) TestRequiresEnabling(c *C) {
+	_, err := s.app.CheckPeerSchedules()
+	c.Check(err, ErrorMatches, "The peer check is not enabled")
+	c.Check(s.app.PeerCheckStatus().Enabled, Equals, false)
+}
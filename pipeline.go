@@ -0,0 +1,118 @@
+package abciproxy
+
+import (
+	"time"
+
+	"github.com/tendermint/abci/types"
+)
+
+// AsyncTxApplication is implemented by applications able to answer
+// CheckTx and DeliverTx asynchronously. Callbacks should be called in
+// the order of the requests. FlushConsensus and FlushMempool are
+// called when the client flushes its DeliverTx and CheckTx requests,
+// and should make sure all their pending callbacks are eventually
+// called.
+type AsyncTxApplication interface {
+	types.Application
+	DeliverTxAsync(tx []byte, cb func(types.Result))
+	CheckTxAsync(tx []byte, cb func(types.Result))
+	FlushConsensus()
+	FlushMempool()
+}
+
+var _ AsyncTxApplication = &ProxyApplication{}
+
+// toResult converts an asynchronous response to a Result, reporting
+// any exception as an internal error.
+func toResult(res *types.Response, value func(*types.Response) (types.CodeType, []byte, string)) types.Result {
+	if e := res.GetException(); e != nil {
+		return types.ErrInternalError.SetLog(e.Error)
+	}
+	code, data, log := value(res)
+	return types.Result{Code: code, Data: data, Log: log}
+}
+
+func deliverTxValue(res *types.Response) (types.CodeType, []byte, string) {
+	r := res.GetDeliverTx()
+	if r == nil {
+		return types.CodeType_InternalError, nil, "Unexpected response to DeliverTx"
+	}
+	return r.Code, r.Data, r.Log
+}
+
+func checkTxValue(res *types.Response) (types.CodeType, []byte, string) {
+	r := res.GetCheckTx()
+	if r == nil {
+		return types.CodeType_InternalError, nil, "Unexpected response to CheckTx"
+	}
+	return r.Code, r.Data, r.Log
+}
+
+// DeliverTxAsync forwards tx to the target application without waiting
+// for its response. cb is called once the response arrives.
+func (app *ProxyApplication) DeliverTxAsync(tx []byte, cb func(types.Result)) {
+	app.calls.tx(methodDeliverTx, tx)
+	app.txFilters.delivered(tx)
+	if handler, payload, ok := app.txRouter.route(tx); ok == true {
+		cb(handler.DeliverTx(payload))
+		return
+	}
+	start := time.Now()
+	height := app.currentBlockHeight()
+	reqRes := app.consensusClient().DeliverTxAsync(tx)
+	reqRes.SetCallback(func(res *types.Response) {
+		result := toResult(res, deliverTxValue)
+		if app.recorder != nil {
+			app.recordAt(height, start, reqRes.Request, res)
+		}
+		if app.shadow != nil {
+			app.shadow.deliverTx(tx, result)
+		}
+		cb(result)
+	})
+}
+
+// CheckTxAsync filters then forwards tx to the target application
+// without waiting for its response. cb is called once the response
+// arrives.
+func (app *ProxyApplication) CheckTxAsync(tx []byte, cb func(types.Result)) {
+	app.calls.tx(methodCheckTx, tx)
+	if res := app.txFilters.filter(tx); res.IsErr() {
+		app.logger.Debug("tx rejected", "tx_hash", TxHash(tx), "log", res.Log)
+		cb(res)
+		return
+	}
+	if handler, payload, ok := app.txRouter.route(tx); ok == true {
+		res := handler.CheckTx(payload)
+		app.txFilters.checkedTx(tx, res)
+		cb(res)
+		return
+	}
+	start := time.Now()
+	height := app.currentBlockHeight()
+	client, release := app.mempoolClient()
+	reqRes := client.CheckTxAsync(tx)
+	reqRes.SetCallback(func(res *types.Response) {
+		release()
+		if app.recorder != nil {
+			app.recordAt(height, start, reqRes.Request, res)
+		}
+		result := toResult(res, checkTxValue)
+		app.txFilters.checkedTx(tx, result)
+		cb(result)
+	})
+}
+
+// FlushConsensus sends the pending DeliverTx requests to the target
+// application.
+func (app *ProxyApplication) FlushConsensus() {
+	app.consensusClient().FlushAsync()
+}
+
+// FlushMempool sends the pending CheckTx requests to the target
+// application.
+func (app *ProxyApplication) FlushMempool() {
+	client, release := app.mempoolClient()
+	defer release()
+	client.FlushAsync()
+}
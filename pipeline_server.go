@@ -0,0 +1,282 @@
+package abciproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+	cmn "github.com/tendermint/tmlibs/common"
+)
+
+// size of the queue of responses waiting to be written, per
+// connection
+const pipelineQueueSize = 1000
+
+// pendingResponse is a response which may not be known yet
+type pendingResponse struct {
+	done chan struct{}
+	res  *types.Response
+}
+
+func newPendingResponse() *pendingResponse {
+	return &pendingResponse{done: make(chan struct{})}
+}
+
+func (p *pendingResponse) resolve(res *types.Response) {
+	p.res = res
+	close(p.done)
+}
+
+func resolvedResponse(res *types.Response) *pendingResponse {
+	p := newPendingResponse()
+	p.resolve(res)
+	return p
+}
+
+// pipelinedLanes records which asynchronous requests a connection sent,
+// so that its flushes only flush the matching downstream connection
+type pipelinedLanes struct {
+	consensus bool
+	mempool   bool
+}
+
+// ConcurrentQueryApplication is implemented by applications whose
+// query connection methods (Info, SetOption and Query) may be called
+// concurrently with the consensus and mempool ones.
+type ConcurrentQueryApplication interface {
+	types.Application
+	ConcurrentQueries() bool
+}
+
+// PipelinedServer is an ABCI socket server which does not wait for
+// CheckTx and DeliverTx answers before reading the next request, if
+// its application implements AsyncTxApplication. Responses are still
+// written in the order of the requests. It behaves as the abci socket
+// server for all other applications and requests. Queries are not
+// serialized with the other requests if the application implements
+// ConcurrentQueryApplication.
+type PipelinedServer struct {
+	cmn.BaseService
+
+	proto    string
+	addr     string
+	listener net.Listener
+
+	connsMtx   sync.Mutex
+	conns      map[int]net.Conn
+	nextConnID int
+
+	appMtx   sync.Mutex
+	queryMtx sync.Mutex
+	app      types.Application
+}
+
+func NewPipelinedServer(protoAddr string, app types.Application) cmn.Service {
+	proto, addr := cmn.ProtocolAndAddress(protoAddr)
+	s := &PipelinedServer{
+		proto: proto,
+		addr:  addr,
+		app:   app,
+		conns: make(map[int]net.Conn),
+	}
+	s.BaseService = *cmn.NewBaseService(nil, "ABCIPipelinedServer", s)
+	return s
+}
+
+func (s *PipelinedServer) OnStart() error {
+	s.BaseService.OnStart()
+	ln, err := net.Listen(s.proto, s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+	go s.acceptConnectionsRoutine()
+	return nil
+}
+
+func (s *PipelinedServer) OnStop() {
+	s.BaseService.OnStop()
+	s.listener.Close()
+
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
+	for id, conn := range s.conns {
+		delete(s.conns, id)
+		if err := conn.Close(); err != nil {
+			s.Logger.Error("Error closing connection", "id", id, "conn", conn, "err", err)
+		}
+	}
+}
+
+func (s *PipelinedServer) addConn(conn net.Conn) int {
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
+	connID := s.nextConnID
+	s.nextConnID++
+	s.conns[connID] = conn
+	return connID
+}
+
+func (s *PipelinedServer) rmConn(connID int, conn net.Conn) {
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
+	delete(s.conns, connID)
+	conn.Close()
+}
+
+func (s *PipelinedServer) acceptConnectionsRoutine() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !s.IsRunning() {
+				return // Ignore error from listener closing.
+			}
+			s.Logger.Error("Failed to accept connection", "err", err)
+			continue
+		}
+		s.Logger.Info("Accepted a new connection")
+
+		connID := s.addConn(conn)
+		closeConn := make(chan error, 2)
+		responses := make(chan *pendingResponse, pipelineQueueSize)
+		// closed when no more responses can be written
+		done := make(chan struct{})
+
+		go s.handleRequests(closeConn, conn, responses, done)
+		go s.handleResponses(closeConn, conn, responses, done)
+
+		go func() {
+			err := <-closeConn
+			if err == io.EOF {
+				s.Logger.Error("Connection was closed by client")
+			} else if err != nil {
+				s.Logger.Error("Connection error", "error", err)
+			}
+			s.rmConn(connID, conn)
+		}()
+	}
+}
+
+// handleRequests reads requests and dispatches them to the application,
+// until the connection fails or responses cannot be written anymore
+func (s *PipelinedServer) handleRequests(closeConn chan error, conn net.Conn, responses chan<- *pendingResponse, done <-chan struct{}) {
+	defer close(responses)
+	bufReader := bufio.NewReader(conn)
+	lanes := &pipelinedLanes{}
+	for {
+		req := &types.Request{}
+		if err := types.ReadMessage(bufReader, req); err != nil {
+			if err == io.EOF {
+				closeConn <- err
+			} else {
+				closeConn <- fmt.Errorf("Error reading message: %v", err)
+			}
+			return
+		}
+		mtx := s.lockFor(req)
+		mtx.Lock()
+		p := s.handleRequest(req, lanes)
+		mtx.Unlock()
+		select {
+		case responses <- p:
+		case <-done:
+			return
+		}
+	}
+}
+
+// lockFor returns the mutex serializing req with the other requests
+func (s *PipelinedServer) lockFor(req *types.Request) *sync.Mutex {
+	app, ok := s.app.(ConcurrentQueryApplication)
+	if ok == false || app.ConcurrentQueries() == false {
+		return &s.appMtx
+	}
+	switch req.Value.(type) {
+	case *types.Request_Info, *types.Request_SetOption, *types.Request_Query:
+		return &s.queryMtx
+	default:
+		return &s.appMtx
+	}
+}
+
+func (s *PipelinedServer) handleRequest(req *types.Request, lanes *pipelinedLanes) *pendingResponse {
+	async, isAsync := s.app.(AsyncTxApplication)
+
+	switch r := req.Value.(type) {
+	case *types.Request_Echo:
+		return resolvedResponse(types.ToResponseEcho(r.Echo.Message))
+	case *types.Request_Flush:
+		if isAsync && lanes.consensus {
+			async.FlushConsensus()
+		}
+		if isAsync && lanes.mempool {
+			async.FlushMempool()
+		}
+		return resolvedResponse(types.ToResponseFlush())
+	case *types.Request_Info:
+		return resolvedResponse(types.ToResponseInfo(s.app.Info()))
+	case *types.Request_SetOption:
+		so := r.SetOption
+		return resolvedResponse(types.ToResponseSetOption(s.app.SetOption(so.Key, so.Value)))
+	case *types.Request_DeliverTx:
+		if isAsync == false {
+			res := s.app.DeliverTx(r.DeliverTx.Tx)
+			return resolvedResponse(types.ToResponseDeliverTx(res.Code, res.Data, res.Log))
+		}
+		lanes.consensus = true
+		p := newPendingResponse()
+		async.DeliverTxAsync(r.DeliverTx.Tx, func(res types.Result) {
+			p.resolve(types.ToResponseDeliverTx(res.Code, res.Data, res.Log))
+		})
+		return p
+	case *types.Request_CheckTx:
+		if isAsync == false {
+			res := s.app.CheckTx(r.CheckTx.Tx)
+			return resolvedResponse(types.ToResponseCheckTx(res.Code, res.Data, res.Log))
+		}
+		lanes.mempool = true
+		p := newPendingResponse()
+		async.CheckTxAsync(r.CheckTx.Tx, func(res types.Result) {
+			p.resolve(types.ToResponseCheckTx(res.Code, res.Data, res.Log))
+		})
+		return p
+	case *types.Request_Commit:
+		res := s.app.Commit()
+		return resolvedResponse(types.ToResponseCommit(res.Code, res.Data, res.Log))
+	case *types.Request_Query:
+		return resolvedResponse(types.ToResponseQuery(s.app.Query(*r.Query)))
+	case *types.Request_InitChain:
+		s.app.InitChain(r.InitChain.Validators)
+		return resolvedResponse(types.ToResponseInitChain())
+	case *types.Request_BeginBlock:
+		s.app.BeginBlock(r.BeginBlock.Hash, r.BeginBlock.Header)
+		return resolvedResponse(types.ToResponseBeginBlock())
+	case *types.Request_EndBlock:
+		return resolvedResponse(types.ToResponseEndBlock(s.app.EndBlock(r.EndBlock.Height)))
+	default:
+		return resolvedResponse(types.ToResponseException("Unknown request"))
+	}
+}
+
+// handleResponses writes the responses in the order of the requests,
+// waiting for the asynchronous ones. done is closed when it returns.
+func (s *PipelinedServer) handleResponses(closeConn chan error, conn net.Conn, responses <-chan *pendingResponse, done chan<- struct{}) {
+	defer close(done)
+	bufWriter := bufio.NewWriter(conn)
+	for p := range responses {
+		<-p.done
+		if err := types.WriteMessage(p.res, bufWriter); err != nil {
+			closeConn <- fmt.Errorf("Error writing message: %v", err.Error())
+			return
+		}
+		if _, ok := p.res.Value.(*types.Response_Flush); ok {
+			if err := bufWriter.Flush(); err != nil {
+				closeConn <- fmt.Errorf("Error flushing write buffer: %v", err.Error())
+				return
+			}
+		}
+	}
+}
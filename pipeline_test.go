@@ -0,0 +1,123 @@
+package abciproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type PipelineSuite struct{}
+
+var _ = Suite(&PipelineSuite{})
+
+func startSocketClient(c *C, port int) abcicli.Client {
+	client := abcicli.NewSocketClient(fmt.Sprintf("tcp://127.0.0.1:%d", port), true)
+	_, err := client.Start()
+	c.Assert(err, IsNil)
+	return client
+}
+
+func (s *PipelineSuite) TestPipelinedResponsesAreOrdered(c *C) {
+	app := NewTestApplication(false)
+	app.SetOption("serial", "on")
+	srv := NewPipelinedServer("tcp://127.0.0.1:50503", NewProxyApp(abcicli.NewLocalClient(nil, app)))
+	_, err := srv.Start()
+	c.Assert(err, IsNil)
+	defer srv.Stop()
+	time.Sleep(20 * time.Millisecond)
+
+	client := startSocketClient(c, 50503)
+	defer client.Stop()
+
+	var codes []types.CodeType
+	// nonces 0, 1, 2 are valid, then 2 is reused
+	for _, nonce := range []uint64{0, 1, 2, 2} {
+		tx := make([]byte, 8)
+		binary.BigEndian.PutUint64(tx, nonce)
+		reqRes := client.DeliverTxAsync(tx)
+		reqRes.SetCallback(func(res *types.Response) {
+			codes = append(codes, res.GetDeliverTx().Code)
+		})
+	}
+	c.Assert(client.FlushSync(), IsNil)
+	c.Check(codes, DeepEquals, []types.CodeType{
+		types.CodeType_OK,
+		types.CodeType_OK,
+		types.CodeType_OK,
+		types.CodeType_BadNonce,
+	})
+	c.Check(client.CommitSync().Data, DeepEquals, []byte{0, 0, 0, 0, 0, 0, 0, 3})
+}
+
+// flushRecorder is an asynchronous application recording its flushes
+type flushRecorder struct {
+	*TestApplication
+	flushes []string
+}
+
+func (app *flushRecorder) DeliverTxAsync(tx []byte, cb func(types.Result)) {
+	cb(app.DeliverTx(tx))
+}
+
+func (app *flushRecorder) CheckTxAsync(tx []byte, cb func(types.Result)) {
+	cb(app.CheckTx(tx))
+}
+
+func (app *flushRecorder) FlushConsensus() {
+	app.flushes = append(app.flushes, "consensus")
+}
+
+func (app *flushRecorder) FlushMempool() {
+	app.flushes = append(app.flushes, "mempool")
+}
+
+func (s *PipelineSuite) TestFlushOnlyFlushesTheLaneOfTheConnection(c *C) {
+	app := &flushRecorder{TestApplication: NewTestApplication(false)}
+	srv := NewPipelinedServer("tcp://127.0.0.1:50504", app).(*PipelinedServer)
+	flush := types.ToRequestFlush()
+
+	mempool := &pipelinedLanes{}
+	srv.handleRequest(types.ToRequestCheckTx([]byte{0x00}), mempool)
+	srv.handleRequest(flush, mempool)
+	c.Check(app.flushes, DeepEquals, []string{"mempool"})
+
+	consensus := &pipelinedLanes{}
+	srv.handleRequest(types.ToRequestDeliverTx([]byte{0x00}), consensus)
+	srv.handleRequest(flush, consensus)
+	c.Check(app.flushes, DeepEquals, []string{"mempool", "consensus"})
+
+	// nothing to flush on a query connection
+	srv.handleRequest(flush, &pipelinedLanes{})
+	c.Check(app.flushes, HasLen, 2)
+}
+
+func (s *PipelineSuite) TestRequestsStopWhenResponsesCannotBeWritten(c *C) {
+	srv := NewPipelinedServer("tcp://127.0.0.1:50505", NewTestApplication(false)).(*PipelinedServer)
+	server, client := net.Pipe()
+	defer client.Close()
+	closeConn := make(chan error, 2)
+	responses := make(chan *pendingResponse)
+	done := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		srv.handleRequests(closeConn, server, responses, done)
+		close(returned)
+	}()
+
+	go types.WriteMessage(types.ToRequestEcho("hello"), client)
+	// the writer of the responses is gone
+	close(done)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		c.Fatal("requests are still handled")
+	}
+	_, ok := <-responses
+	c.Check(ok, Equals, false)
+}
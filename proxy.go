@@ -2,29 +2,103 @@ package abciproxy
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	abcicli "github.com/tendermint/abci/client"
 	"github.com/tendermint/abci/types"
+	"github.com/tendermint/tmlibs/events"
 	tmlog "github.com/tendermint/tmlibs/log"
 )
 
 type ValidatorSetChange struct {
-	Diffs           []*types.Validator
+	Diffs []*types.Validator
+	// operations of the diffs, nil if they all set their power
+	Ops             []PowerOp
 	ScheduledHeight uint64
+	// IDs of the changes merged in Diffs, see ScheduleValidatorChange
+	IDs []uint64
+	// diffs of each change merged in Diffs, to rebuild them when a
+	// change is removed
+	parts []changeDiffs
 }
 
 // ProxyApplication is a super-simple proxy example.
 // It just passes (almost) everything to another abci application
-// However, if the CheckTX/DeliverTX starts with a given prefix, it echos the result
+// However, if the CheckTX/DeliverTX starts with a registered prefix, it
+// is answered by the proxy itself (see RegisterTxHandler)
 type ProxyApplication struct {
 	types.BaseApplication
-	next   abcicli.Client
+	// protects next, which can be switched at runtime, and inflight
+	nextMtx sync.RWMutex
+	next    Connections
+	// calls to next outside of the consensus connection
+	inflight *sync.WaitGroup
+
 	logger tmlog.Logger
+	// logs the received ABCI calls
+	calls *callLogger
+
+	txRouter  *txRouter
+	txFilters *txFilterChain
+
+	// wraps the Info response with the proxy metadata
+	infoMetadata bool
+
+	// mirrors consensus calls to a second application, nil if disabled
+	shadow *shadow
+
+	// records all calls to the target application, nil if disabled
+	recorder *Recorder
 
-	// to change concurrently the validator set
-	lastHeight   uint64
-	diffsChannel chan ValidatorSetChange
+	// scheduled switch of the target application, nil if none
+	switchMtx sync.Mutex
+	appSwitch *AppSwitch
+
+	// to change concurrently the validator set: protects lastHeight,
+	// heightKnown, diffs, changes and refusedHeights, which are read
+	// by Query and the RPC
+	mtx        sync.Mutex
+	lastHeight uint64
+	// false until lastHeight is known, from the Info handshake,
+	// InitChain or EndBlock
+	heightKnown  bool
 	diffs        map[uint64]ValidatorSetChange
+	changes      map[uint64]*ValidatorChangeStatus
+	nextChangeID uint64
+	// heights at which no diffs are emitted, see RefuseValidatorHeight
+	refusedHeights map[uint64]bool
+
+	// minimum number of blocks between the current height and the one
+	// of a change, and whether to bump the changes scheduled too early
+	minLead  uint64
+	autoBump bool
+
+	// proxies of the other nodes, to broadcast validator changes to
+	peers []*Peer
+	// comparison of the schedule with the peers, nil if disabled
+	peerCheck *peerCheck
+
+	// events sent to the RPC websocket subscribers
+	evsw events.EventSwitch
+
+	validators *validatorSet
+	// names of the validator public keys
+	keys *keyRegistry
+	// changes of the genesis validators, nil if none
+	genesis *GenesisConfig
+	// diffs emitted at each height, for blocks replayed by Tendermint
+	history *diffHistory
+
+	// height of the block currently processed, as given by BeginBlock.
+	// Protected by mtx, as it is read by the mempool and query calls.
+	blockHeight uint64
+
+	// multi-signature approval of validator changes, nil if disabled
+	approvals *approvalBook
+	// on-chain validator changes, nil if disabled
+	governance *governance
 }
 
 var _ types.Application = &ProxyApplication{}
@@ -34,74 +108,233 @@ func NewProxyApp(next abcicli.Client) *ProxyApplication {
 }
 
 func NewProxyAppWithLogger(next abcicli.Client, logger tmlog.Logger) *ProxyApplication {
+	return NewProxyAppWithConnections(SharedConnections(next), logger)
+}
+
+// NewProxyAppWithConnections creates a proxy using a separate client to
+// the target application for each ABCI connection.
+func NewProxyAppWithConnections(next Connections, logger tmlog.Logger) *ProxyApplication {
 	return &ProxyApplication{
-		next:   next,
-		logger: logger,
-		//TODO: maybe a buffer of one isn't enough.
-		diffsChannel: make(chan ValidatorSetChange, 1),
-		diffs:        make(map[uint64]ValidatorSetChange),
-		lastHeight:   0,
+		next:           next,
+		inflight:       &sync.WaitGroup{},
+		logger:         logger,
+		calls:          newCallLogger(logger),
+		diffs:          make(map[uint64]ValidatorSetChange),
+		changes:        make(map[uint64]*ValidatorChangeStatus),
+		lastHeight:     0,
+		refusedHeights: make(map[uint64]bool),
+		validators:     newValidatorSet(),
+		keys:           newKeyRegistry(),
+		history:        newDiffHistory(),
+		txRouter:       &txRouter{},
+		txFilters:      newTxFilterChain(),
+		evsw:           events.NewEventSwitch(),
 	}
 }
 
 func (app *ProxyApplication) Info() (resInfo types.ResponseInfo) {
-	LogCall(app.logger)
+	app.calls.log(methodInfo)
+	start := time.Now()
 	// TODO: better error handling!
-	info, _ := app.next.InfoSync()
+	client, release := app.queryClient()
+	info, err := client.InfoSync()
+	release()
+	if app.recorder != nil {
+		app.record(start, types.ToRequestInfo(), types.ToResponseInfo(info))
+	}
+	if err == nil {
+		app.recoverHeight(info.LastBlockHeight)
+	}
+	if app.infoMetadata == true {
+		return app.wrapInfo(info)
+	}
 	return info
 }
 
 func (app *ProxyApplication) SetOption(key string, value string) (log string) {
-	LogCall(app.logger, "key", key, "value", value)
+	app.calls.log(methodSetOption, "key", key, "value", value)
+	start := time.Now()
 	// TODO: better error handling!
-	res := app.next.SetOptionSync(key, value)
+	client, release := app.queryClient()
+	res := client.SetOptionSync(key, value)
+	release()
+	if app.recorder != nil {
+		app.record(start, types.ToRequestSetOption(key, value), types.ToResponseSetOption(res.Log))
+	}
 	return res.Log
 }
 
 func (app *ProxyApplication) DeliverTx(tx []byte) types.Result {
-	LogCall(app.logger, "tx", tx)
-	return app.next.DeliverTxSync(tx)
+	app.calls.tx(methodDeliverTx, tx)
+	app.txFilters.delivered(tx)
+	if handler, payload, ok := app.txRouter.route(tx); ok == true {
+		return handler.DeliverTx(payload)
+	}
+	start := time.Now()
+	res := app.consensusClient().DeliverTxSync(tx)
+	if app.recorder != nil {
+		app.record(start, types.ToRequestDeliverTx(tx), types.ToResponseDeliverTx(res.Code, res.Data, res.Log))
+	}
+	if app.shadow != nil {
+		app.shadow.deliverTx(tx, res)
+	}
+	return res
 }
 
 func (app *ProxyApplication) CheckTx(tx []byte) types.Result {
-	LogCall(app.logger, "tx", tx)
-	return app.next.CheckTxSync(tx)
+	app.calls.tx(methodCheckTx, tx)
+	if res := app.txFilters.filter(tx); res.IsErr() {
+		app.logger.Debug("tx rejected", "tx_hash", TxHash(tx), "log", res.Log)
+		return res
+	}
+	var res types.Result
+	if handler, payload, ok := app.txRouter.route(tx); ok == true {
+		res = handler.CheckTx(payload)
+	} else {
+		start := time.Now()
+		client, release := app.mempoolClient()
+		res = client.CheckTxSync(tx)
+		release()
+		if app.recorder != nil {
+			app.record(start, types.ToRequestCheckTx(tx), types.ToResponseCheckTx(res.Code, res.Data, res.Log))
+		}
+	}
+	app.txFilters.checkedTx(tx, res)
+	return res
 }
 
 func (app *ProxyApplication) Commit() types.Result {
-	LogCall(app.logger)
-	return app.next.CommitSync()
+	app.calls.log(methodCommit)
+	if app.governance != nil {
+		// before the target application commits, see governanceStateFile
+		height, _ := app.knownHeight()
+		app.saveGovernanceState(height)
+	}
+	start := time.Now()
+	res := app.consensusClient().CommitSync()
+	if app.recorder != nil {
+		app.record(start, types.ToRequestCommit(), types.ToResponseCommit(res.Code, res.Data, res.Log))
+	}
+	if app.shadow != nil {
+		app.shadow.commit(res)
+	}
+	app.maybeSwitchApp(res)
+	return res
 }
 
 func (app *ProxyApplication) Query(reqQuery types.RequestQuery) (resQuery types.ResponseQuery) {
-	LogCall(app.logger, "query", reqQuery)
+	app.calls.query(reqQuery)
+	if strings.HasPrefix(reqQuery.Path, ProxyQueryPrefix) {
+		return app.proxyQuery(reqQuery)
+	}
+	start := time.Now()
 	// TODO: better error handling!
-	res, _ := app.next.QuerySync(reqQuery)
+	client, release := app.queryClient()
+	res, _ := client.QuerySync(reqQuery)
+	release()
+	if app.recorder != nil {
+		app.record(start, types.ToRequestQuery(reqQuery), types.ToResponseQuery(res))
+	}
 	return res
 }
 
-func (app *ProxyApplication) InitChain(validators []*types.Validator) {
-	LogCall(app.logger, "validators", validators)
+func (app *ProxyApplication) InitChain(genesis []*types.Validator) {
+	app.calls.log(methodInitChain, "validators", len(genesis))
+	validators := app.initialValidators(genesis)
+	app.validators.reset(validators)
+	if err := app.history.add(0, validators); err != nil {
+		panic(fmt.Sprintf("Could not persist the initial validator set: %s", err))
+	}
+	app.mtx.Lock()
+	app.heightKnown = true
+	app.mtx.Unlock()
+	start := time.Now()
 	// TODO: better error handling!
-	_ = app.next.InitChainSync(validators)
+	_ = app.consensusClient().InitChainSync(validators)
+	if app.recorder != nil {
+		app.record(start, types.ToRequestInitChain(validators), types.ToResponseInitChain())
+	}
+	if app.shadow != nil {
+		app.shadow.initChain(validators)
+	}
 }
 
 func (app *ProxyApplication) BeginBlock(hash []byte, header *types.Header) {
-	LogCall(app.logger, "hash", hash, "header", header)
+	app.calls.log(methodBeginBlock, "hash", hash, "height", header.GetHeight())
+	if header != nil {
+		app.mtx.Lock()
+		app.blockHeight = header.Height
+		app.mtx.Unlock()
+	}
+	start := time.Now()
 	// TODO: better error handling!
-	_ = app.next.BeginBlockSync(hash, header)
+	_ = app.consensusClient().BeginBlockSync(hash, header)
+	if app.recorder != nil {
+		app.record(start, types.ToRequestBeginBlock(hash, header), types.ToResponseBeginBlock())
+	}
+	if app.shadow != nil {
+		app.shadow.beginBlock(hash, header)
+	}
 }
 
 func (app *ProxyApplication) ChangeValidators(newValidators []*types.Validator, targetHeight uint64) error {
-	app.logger.Debug("received new validator set",
-		"validators", newValidators,
-		"targetHeight", targetHeight)
-	if targetHeight <= app.lastHeight {
-		return fmt.Errorf("Could not schedule for a block height back in time (wanted:%d, current:%d)", targetHeight, app.lastHeight)
+	_, err := app.ScheduleValidatorChange(newValidators, targetHeight)
+	return err
+}
+
+// recoverHeight sets the last height after a restart, from the one of
+// the target application, which Tendermint queries with Info during
+// its handshake. It does nothing if the height is already known.
+func (app *ProxyApplication) recoverHeight(height uint64) {
+	app.mtx.Lock()
+	if app.heightKnown == true {
+		app.mtx.Unlock()
+		return
+	}
+	app.lastHeight = height
+	app.heightKnown = true
+	app.mtx.Unlock()
+	app.logger.Info("recovered last block height from the target application", "height", height)
+	if app.governance != nil {
+		app.restoreGovernanceState(height)
+	}
+}
+
+// knownHeight returns the last height seen by the proxy, and false if
+// it is not known yet
+func (app *ProxyApplication) knownHeight() (uint64, bool) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	return app.lastHeight, app.heightKnown
+}
+
+// currentBlockHeight returns the height of the block being processed
+func (app *ProxyApplication) currentBlockHeight() uint64 {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	return app.blockHeight
+}
+
+// currentHeight is the highest height processed
+func (app *ProxyApplication) currentHeight() uint64 {
+	current, _ := app.knownHeight()
+	// after a restart, Tendermint replays the blocks the target
+	// application did not commit, which may be above its height
+	if h := app.history.lastHeight(); h > current {
+		current = h
+	}
+	return current
+}
+
+// checkScheduledHeight returns an error if something cannot be
+// scheduled at targetHeight
+func (app *ProxyApplication) checkScheduledHeight(targetHeight uint64) error {
+	if _, known := app.knownHeight(); known == false {
+		return fmt.Errorf("The current block height is not known yet, waiting for the handshake with Tendermint")
 	}
-	app.diffsChannel <- ValidatorSetChange{
-		Diffs:           newValidators,
-		ScheduledHeight: targetHeight,
+	current := app.currentHeight()
+	if targetHeight <= current {
+		return fmt.Errorf("Could not schedule for a block height back in time (wanted:%d, current:%d)", targetHeight, current)
 	}
 	return nil
 }
@@ -111,42 +344,84 @@ func mergeValidatorDiffs(merged, newChanges []*types.Validator) []*types.Validat
 	return append(merged, newChanges...)
 }
 
+// scheduleChange adds change to the diffs to emit
+func (app *ProxyApplication) scheduleChange(change ValidatorSetChange) {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	app.scheduleChangeUnsafe(change)
+}
+
+// scheduleChangeUnsafe is scheduleChange. app.mtx should be held.
+func (app *ProxyApplication) scheduleChangeUnsafe(change ValidatorSetChange) {
+	c, ok := app.diffs[change.ScheduledHeight]
+	if ok == false {
+		c = ValidatorSetChange{ScheduledHeight: change.ScheduledHeight}
+	}
+	c.parts = append(c.changeParts(), change.changeParts()...)
+	app.diffs[change.ScheduledHeight] = c.rebuilt()
+}
+
 func (app *ProxyApplication) EndBlock(height uint64) (resEndBlock types.ResponseEndBlock) {
-	LogCall(app.logger, "height", height)
+	app.calls.log(methodEndBlock, "height", height)
+	app.mtx.Lock()
 	app.lastHeight = height
+	app.heightKnown = true
+	app.mtx.Unlock()
+	start := time.Now()
 	// TODO: better error handling!
-	res, _ := app.next.EndBlockSync(height)
-
-	//
-	haveValidators := true
-	for haveValidators == true {
-		select {
-		case change := <-app.diffsChannel:
-			if change.ScheduledHeight < height {
-				app.logger.Error("got a validator change too late",
-					"currentHeight", height,
-					"targetHeight", change.ScheduledHeight,
-					"diffs", change.Diffs)
-			}
-			if c, ok := app.diffs[change.ScheduledHeight]; ok == true {
-				c.Diffs = mergeValidatorDiffs(c.Diffs, change.Diffs)
-				app.diffs[change.ScheduledHeight] = c
-			} else {
-				app.diffs[change.ScheduledHeight] = change
-			}
-		default:
-			//if none pending simply stop the consuming
-			haveValidators = false
+	res, _ := app.consensusClient().EndBlockSync(height)
+	if app.recorder != nil {
+		app.record(start, types.ToRequestEndBlock(height), types.ToResponseEndBlock(res))
+	}
+	if app.shadow != nil {
+		app.shadow.endBlock(height)
+	}
+
+	if app.governance != nil {
+		app.expireGovernanceProposals(height)
+	}
+
+	app.mtx.Lock()
+	app.expireChanges(height)
+	app.mtx.Unlock()
+	app.txFilters.endBlock(height)
+
+	if diffs, replayed := app.history.get(height); replayed == true {
+		// the block was already processed before a crash, emit the
+		// same diffs than the first time
+		res.Diffs = diffs
+		app.validators.apply(res.Diffs)
+		// the ones scheduled for it were emitted before the crash
+		app.mtx.Lock()
+		delete(app.diffs, height)
+		app.mtx.Unlock()
+		if len(res.Diffs) != 0 {
+			app.logger.Info("re-emitting validator diffs of a replayed block", "height", height, "validators", res.Diffs)
 		}
+		return res
 	}
 
-	if c, ok := app.diffs[height]; ok == true {
-		res.Diffs = c.Diffs
+	app.mtx.Lock()
+	if c, ok := app.diffs[height]; ok == true && app.refusedHeights[height] == true {
+		app.logger.Error("dropping refused validator diffs", "height", height, "diffs", c.Diffs)
+		app.setChangesStatus(c.IDs, ChangeRefused, height)
+		delete(app.diffs, height)
+		res.Diffs = nil
+	} else if ok == true {
+		res.Diffs = app.resolveScheduledChange(c, height)
+		app.setChangesStatus(c.IDs, ChangeApplied, height)
 		delete(app.diffs, height)
 	} else {
 		// remove any target app wanted changes
 		res.Diffs = nil
 	}
+	app.mtx.Unlock()
+	if err := app.history.add(height, res.Diffs); err != nil {
+		// a replay of this block could emit other diffs, and fork
+		// the chain: stop like Tendermint does on WAL errors
+		panic(fmt.Sprintf("Could not persist the validator diffs of height %d: %s", height, err))
+	}
+	app.validators.apply(res.Diffs)
 
 	if len(res.Diffs) != 0 {
 		app.logger.Debug("submitting new validators", "validators", res.Diffs)
@@ -0,0 +1,65 @@
+package abciproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tendermint/abci/types"
+)
+
+// ProxyQueryPrefix is the path namespace answered by the proxy
+// instead of the target application. Values are JSON encoded.
+//
+//	/proxy/height           the last height seen by the proxy
+//	/proxy/version          the proxy version
+//	/proxy/validators       the current validator set
+//	/proxy/pending_changes  the validator changes scheduled in the future
+const ProxyQueryPrefix = "/proxy/"
+
+func (app *ProxyApplication) proxyQuery(reqQuery types.RequestQuery) types.ResponseQuery {
+	var value interface{}
+	var err error
+	height, known := app.knownHeight()
+
+	switch strings.TrimPrefix(reqQuery.Path, ProxyQueryPrefix) {
+	case "height":
+		if known == false {
+			err = fmt.Errorf("The current block height is not known yet")
+		}
+		value = &CurrentHeightResult{Height: height}
+	case "version":
+		value = &VersionResult{Version: Version}
+	case "validators":
+		value, err = app.newValidatorsResult(app.Validators())
+	case "pending_changes":
+		value, err = app.newPendingChangesResult(app.PendingValidatorChanges())
+	default:
+		return types.ResponseQuery{
+			Code: types.CodeType_UnknownRequest,
+			Log:  fmt.Sprintf("Unknown proxy query path %s", reqQuery.Path),
+		}
+	}
+
+	if err != nil {
+		return types.ResponseQuery{
+			Code: types.CodeType_InternalError,
+			Log:  err.Error(),
+		}
+	}
+
+	bz, err := json.Marshal(value)
+	if err != nil {
+		return types.ResponseQuery{
+			Code: types.CodeType_InternalError,
+			Log:  err.Error(),
+		}
+	}
+
+	return types.ResponseQuery{
+		Code:   types.CodeType_OK,
+		Key:    []byte(reqQuery.Path),
+		Value:  bz,
+		Height: height,
+	}
+}
@@ -0,0 +1,98 @@
+package abciproxy
+
+import (
+	"encoding/json"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type QuerySuite struct {
+	testApplication *TestApplication
+	app             *ProxyApplication
+	genesis         []*types.Validator
+}
+
+var _ = Suite(&QuerySuite{})
+
+func (s *QuerySuite) SetUpTest(c *C) {
+	s.testApplication = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+	s.genesis = nil
+	for i := 0; i < 2; i++ {
+		s.genesis = append(s.genesis, &types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		})
+	}
+	s.app.InitChain(s.genesis)
+}
+
+func (s *QuerySuite) query(c *C, path string, value interface{}) {
+	res := s.app.Query(types.RequestQuery{Path: path})
+	c.Assert(res.Code, Equals, types.CodeType_OK, Commentf("%s", res.Log))
+	c.Assert(json.Unmarshal(res.Value, value), IsNil)
+}
+
+func (s *QuerySuite) TestProxyPathsAreAnsweredByTheProxy(c *C) {
+	c.Assert(s.app.ChangeValidators([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[0].PubKey, Power: 0},
+	}, 2), IsNil)
+	s.app.EndBlock(1)
+
+	height := &CurrentHeightResult{}
+	s.query(c, "/proxy/height", height)
+	c.Check(height.Height, Equals, uint64(1))
+
+	version := &VersionResult{}
+	s.query(c, "/proxy/version", version)
+	c.Check(version.Version, Equals, Version)
+
+	pending := &PendingChangesResult{}
+	s.query(c, "/proxy/pending_changes", pending)
+	c.Assert(pending.Changes, HasLen, 1)
+	c.Check(pending.Changes[0].ScheduledHeight, Equals, uint64(2))
+	c.Check(pending.Changes[0].Validators[0].PubKey.Bytes(), DeepEquals, s.genesis[0].PubKey)
+
+	validators := &ValidatorsResult{}
+	s.query(c, "/proxy/validators", validators)
+	c.Check(validators.Validators, HasLen, 2)
+
+	s.app.EndBlock(2)
+	s.query(c, "/proxy/validators", validators)
+	c.Assert(validators.Validators, HasLen, 1)
+	c.Check(validators.Validators[0].PubKey.Bytes(), DeepEquals, s.genesis[1].PubKey)
+
+	res := s.app.Query(types.RequestQuery{Path: "/proxy/unknown"})
+	c.Check(res.Code, Equals, types.CodeType_UnknownRequest)
+
+	c.Check(s.testApplication.QueryCalls.Calls, HasLen, 0)
+}
+
+func (s *QuerySuite) TestPendingChangesIncludeNewChanges(c *C) {
+	s.app.EndBlock(1)
+	// no EndBlock is needed for a change to be pending, nor to
+	// schedule another one
+	c.Assert(s.app.ChangeValidators([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[0].PubKey, Power: 5},
+	}, 3), IsNil)
+	c.Assert(s.app.ChangeValidators([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[1].PubKey, Power: 5},
+	}, 4), IsNil)
+
+	pending := &PendingChangesResult{}
+	s.query(c, "/proxy/pending_changes", pending)
+	c.Assert(pending.Changes, HasLen, 2)
+	c.Check(pending.Changes[0].ScheduledHeight, Equals, uint64(3))
+	c.Check(pending.Changes[1].ScheduledHeight, Equals, uint64(4))
+}
+
+func (s *QuerySuite) TestOtherPathsAreForwarded(c *C) {
+	res := s.app.Query(types.RequestQuery{Path: "tx"})
+	c.Check(res.Code, Equals, types.CodeType_OK)
+	c.Check(string(res.Value), Equals, "0")
+	c.Check(s.testApplication.QueryCalls.Calls, HasLen, 1)
+}
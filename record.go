@@ -0,0 +1,232 @@
+package abciproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tendermint/abci/types"
+)
+
+// recordMagic starts every ABCI record log
+const recordMagic = "ABCIREC1"
+
+// RecordEntry is a single request sent to the target application,
+// and its response.
+type RecordEntry struct {
+	// height of the block being processed
+	Height   uint64
+	Time     time.Time
+	Duration time.Duration
+	Request  *types.Request
+	Response *types.Response
+}
+
+// Recorder writes all the requests forwarded to the target
+// application and their responses in a compact binary log. Each
+// entry is the uvarint height, the varint unix nano time, the uvarint
+// duration in ns, followed by the length prefixed protobuf request and
+// response.
+type Recorder struct {
+	mtx  sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	buf  []byte
+}
+
+// NewRecorder creates the log at path, or appends to it if it already
+// exists. An entry left incomplete by a crash is dropped first.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		file: f,
+		w:    bufio.NewWriter(f),
+		buf:  make([]byte, binary.MaxVarintLen64),
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if _, err := r.w.WriteString(recordMagic); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	end, err := recordLogEnd(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not append to record log %s: %s", path, err)
+	}
+	if end != info.Size() {
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// recordLogEnd returns the size of the complete entries of the log in
+// f, with its header
+func recordLogEnd(f *os.File) (int64, error) {
+	cr := &countingReader{r: f}
+	rr, err := NewRecordReader(cr)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		end := cr.n - int64(rr.r.Buffered())
+		_, err := rr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// an incomplete entry is the end of a block which was
+			// not entirely flushed
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *Recorder) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(r.buf, v)
+	_, err := r.w.Write(r.buf[:n])
+	return err
+}
+
+func (r *Recorder) writeVarint(v int64) error {
+	n := binary.PutVarint(r.buf, v)
+	_, err := r.w.Write(r.buf[:n])
+	return err
+}
+
+// Record appends an entry to the log. The log is flushed on every
+// Commit, so a crash loses at most the current block.
+func (r *Recorder) Record(height uint64, start time.Time, req *types.Request, res *types.Response) error {
+	duration := time.Since(start)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.writeUvarint(height); err != nil {
+		return err
+	}
+	if err := r.writeVarint(start.UnixNano()); err != nil {
+		return err
+	}
+	if err := r.writeUvarint(uint64(duration)); err != nil {
+		return err
+	}
+	if err := types.WriteMessage(req, r.w); err != nil {
+		return err
+	}
+	if err := types.WriteMessage(res, r.w); err != nil {
+		return err
+	}
+	if req.GetCommit() != nil {
+		return r.w.Flush()
+	}
+	return nil
+}
+
+// Close flushes and closes the log
+func (r *Recorder) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// RecordReader reads back a log written by a Recorder
+type RecordReader struct {
+	r *bufio.Reader
+}
+
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, fmt.Errorf("Could not read record header: %s", err)
+	}
+	if string(magic) != recordMagic {
+		return nil, fmt.Errorf("Not an ABCI record log")
+	}
+	return &RecordReader{r: br}, nil
+}
+
+// Next returns the next entry of the log, or io.EOF at its end
+func (rr *RecordReader) Next() (*RecordEntry, error) {
+	height, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		// a clean end of file can only happen here
+		return nil, err
+	}
+	nanos, err := binary.ReadVarint(rr.r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	duration, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	res := &RecordEntry{
+		Height:   height,
+		Time:     time.Unix(0, nanos),
+		Duration: time.Duration(duration),
+		Request:  &types.Request{},
+		Response: &types.Response{},
+	}
+	if err := types.ReadMessage(rr.r, res.Request); err != nil {
+		return nil, noEOF(err)
+	}
+	if err := types.ReadMessage(rr.r, res.Response); err != nil {
+		return nil, noEOF(err)
+	}
+	return res, nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// EnableRecording records all calls forwarded to the target
+// application in recorder.
+func (app *ProxyApplication) EnableRecording(recorder *Recorder) {
+	app.recorder = recorder
+}
+
+func (app *ProxyApplication) record(start time.Time, req *types.Request, res *types.Response) {
+	app.recordAt(app.currentBlockHeight(), start, req, res)
+}
+
+func (app *ProxyApplication) recordAt(height uint64, start time.Time, req *types.Request, res *types.Response) {
+	if err := app.recorder.Record(height, start, req, res); err != nil {
+		app.logger.Error("could not record ABCI call", "error", err)
+	}
+}
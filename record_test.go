@@ -0,0 +1,136 @@
+package abciproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type RecordSuite struct {
+	testHome string
+	logPath  string
+}
+
+var _ = Suite(&RecordSuite{})
+
+func (s *RecordSuite) SetUpTest(c *C) {
+	var err error
+	s.testHome, err = ioutil.TempDir("", "abci_proxy_record")
+	c.Assert(err, IsNil)
+	s.logPath = filepath.Join(s.testHome, "abci.rec")
+
+	recorder, err := NewRecorder(s.logPath)
+	c.Assert(err, IsNil)
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	app.EnableRecording(recorder)
+
+	app.InitChain(nil)
+	for h := uint64(1); h <= 2; h++ {
+		app.BeginBlock(nil, &types.Header{Height: h})
+		app.DeliverTx([]byte{0x00})
+		app.EndBlock(h)
+		app.Commit()
+	}
+	app.Query(types.RequestQuery{Path: "tx"})
+	c.Assert(recorder.Close(), IsNil)
+}
+
+func (s *RecordSuite) TearDownTest(c *C) {
+	c.Check(os.RemoveAll(s.testHome), IsNil)
+}
+
+func (s *RecordSuite) openLog(c *C) *RecordReader {
+	f, err := os.Open(s.logPath)
+	c.Assert(err, IsNil)
+	rr, err := NewRecordReader(f)
+	c.Assert(err, IsNil)
+	return rr
+}
+
+func (s *RecordSuite) TestCanReadRecordedCalls(c *C) {
+	rr := s.openLog(c)
+	var entries []*RecordEntry
+	for {
+		e, err := rr.Next()
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	// InitChain + 2 * (BeginBlock, DeliverTx, EndBlock, Commit) + Query
+	c.Assert(entries, HasLen, 10)
+	c.Check(entries[0].Request.GetInitChain(), NotNil)
+	c.Check(entries[2].Height, Equals, uint64(1))
+	c.Check(entries[2].Request.GetDeliverTx().Tx, DeepEquals, []byte{0x00})
+	c.Check(entries[8].Height, Equals, uint64(2))
+	c.Check(entries[8].Request.GetCommit(), NotNil)
+	c.Check(entries[9].Response.GetQuery().Value, DeepEquals, []byte("2"))
+}
+
+func (s *RecordSuite) TestReplayIntoSameApplication(c *C) {
+	report, err := Replay(s.openLog(c), abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	c.Assert(err, IsNil)
+	c.Check(report.Entries, Equals, 10)
+	c.Check(report.Divergence, IsNil)
+}
+
+func (s *RecordSuite) TestReplayReportsFirstDivergence(c *C) {
+	// second tx has a wrong nonce for a serial application
+	report, err := Replay(s.openLog(c), abcicli.NewLocalClient(nil, NewTestApplication(true)))
+	c.Assert(err, IsNil)
+	c.Assert(report.Divergence, NotNil)
+	c.Check(report.Divergence.Entry, Equals, 6)
+	c.Check(report.Divergence.Height, Equals, uint64(2))
+	c.Check(report.Divergence.Method, Equals, "DeliverTx")
+}
+
+func (s *RecordSuite) readAll(c *C) []*RecordEntry {
+	rr := s.openLog(c)
+	var entries []*RecordEntry
+	for {
+		e, err := rr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		c.Assert(err, IsNil)
+		entries = append(entries, e)
+	}
+}
+
+func (s *RecordSuite) TestRecorderAppendsToExistingLog(c *C) {
+	recorder, err := NewRecorder(s.logPath)
+	c.Assert(err, IsNil)
+	app := NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	app.EnableRecording(recorder)
+	app.Query(types.RequestQuery{Path: "tx"})
+	c.Assert(recorder.Close(), IsNil)
+
+	entries := s.readAll(c)
+	c.Assert(entries, HasLen, 11)
+	c.Check(entries[10].Request.GetQuery(), NotNil)
+}
+
+func (s *RecordSuite) TestRecorderDropsIncompleteEntry(c *C) {
+	info, err := os.Stat(s.logPath)
+	c.Assert(err, IsNil)
+	// cut the last response
+	c.Assert(os.Truncate(s.logPath, info.Size()-1), IsNil)
+
+	recorder, err := NewRecorder(s.logPath)
+	c.Assert(err, IsNil)
+	c.Assert(recorder.Close(), IsNil)
+	c.Check(s.readAll(c), HasLen, 9)
+}
+
+func (s *RecordSuite) TestRecorderRefusesOtherFiles(c *C) {
+	path := filepath.Join(s.testHome, "other")
+	c.Assert(ioutil.WriteFile(path, []byte("not a record log"), 0644), IsNil)
+	_, err := NewRecorder(path)
+	c.Check(err, ErrorMatches, "Could not append to record log .*: Not an ABCI record log")
+}
@@ -0,0 +1,135 @@
+package abciproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+)
+
+// ReplayDivergence is the first response of the replayed application
+// differing from the recorded one
+type ReplayDivergence struct {
+	// index of the entry in the log
+	Entry    int
+	Height   uint64
+	Method   string
+	Recorded string
+	Replayed string
+}
+
+func (d *ReplayDivergence) String() string {
+	return fmt.Sprintf("entry %d (height %d) %s diverged:\n  recorded: %s\n  replayed: %s",
+		d.Entry, d.Height, d.Method, d.Recorded, d.Replayed)
+}
+
+// ReplayReport is the result of a Replay
+type ReplayReport struct {
+	Entries    int
+	Divergence *ReplayDivergence
+}
+
+// compared holds the parts of a response that should be reproducible
+type compared struct {
+	method string
+	code   types.CodeType
+	data   []byte
+}
+
+func (c compared) String() string {
+	return fmt.Sprintf("code:%d data:%X", c.code, c.data)
+}
+
+func (c compared) equals(other compared) bool {
+	return c.code == other.code && bytes.Equal(c.data, other.data)
+}
+
+// replayRequest sends req to client. It returns false for the requests
+// whose responses are not compared.
+func replayRequest(client abcicli.Client, req *types.Request) (compared, bool, error) {
+	switch {
+	case req.GetDeliverTx() != nil:
+		res := client.DeliverTxSync(req.GetDeliverTx().Tx)
+		return compared{"DeliverTx", res.Code, res.Data}, true, nil
+	case req.GetCheckTx() != nil:
+		res := client.CheckTxSync(req.GetCheckTx().Tx)
+		return compared{"CheckTx", res.Code, nil}, true, nil
+	case req.GetCommit() != nil:
+		res := client.CommitSync()
+		return compared{"Commit", res.Code, res.Data}, true, nil
+	case req.GetQuery() != nil:
+		res, err := client.QuerySync(*req.GetQuery())
+		return compared{"Query", res.Code, res.Value}, true, err
+	case req.GetInitChain() != nil:
+		return compared{}, false, client.InitChainSync(req.GetInitChain().Validators)
+	case req.GetBeginBlock() != nil:
+		return compared{}, false, client.BeginBlockSync(req.GetBeginBlock().Hash, req.GetBeginBlock().Header)
+	case req.GetEndBlock() != nil:
+		_, err := client.EndBlockSync(req.GetEndBlock().Height)
+		return compared{}, false, err
+	case req.GetSetOption() != nil:
+		client.SetOptionSync(req.GetSetOption().Key, req.GetSetOption().Value)
+		return compared{}, false, nil
+	case req.GetInfo() != nil:
+		_, err := client.InfoSync()
+		return compared{}, false, err
+	default:
+		return compared{}, false, fmt.Errorf("Unsupported recorded request %v", req)
+	}
+}
+
+func recordedResponse(method string, res *types.Response) compared {
+	switch {
+	case res.GetDeliverTx() != nil:
+		r := res.GetDeliverTx()
+		return compared{method, r.Code, r.Data}
+	case res.GetCheckTx() != nil:
+		return compared{method, res.GetCheckTx().Code, nil}
+	case res.GetCommit() != nil:
+		r := res.GetCommit()
+		return compared{method, r.Code, r.Data}
+	case res.GetQuery() != nil:
+		r := res.GetQuery()
+		return compared{method, r.Code, r.Value}
+	default:
+		return compared{method: method, code: types.CodeType_InternalError}
+	}
+}
+
+// Replay feeds all the requests of a record log to client, and stops
+// at the first response differing from the recorded one (DeliverTx,
+// CheckTx and Query results, and Commit app hashes).
+func Replay(rr *RecordReader, client abcicli.Client) (*ReplayReport, error) {
+	report := &ReplayReport{}
+	for {
+		entry, err := rr.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Entries++
+
+		replayed, compare, err := replayRequest(client, entry.Request)
+		if err != nil {
+			return report, fmt.Errorf("entry %d (height %d): %s", report.Entries-1, entry.Height, err)
+		}
+		if compare == false {
+			continue
+		}
+		recorded := recordedResponse(replayed.method, entry.Response)
+		if recorded.equals(replayed) == false {
+			report.Divergence = &ReplayDivergence{
+				Entry:    report.Entries - 1,
+				Height:   entry.Height,
+				Method:   replayed.method,
+				Recorded: recorded.String(),
+				Replayed: replayed.String(),
+			}
+			return report, nil
+		}
+	}
+}
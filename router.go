@@ -0,0 +1,125 @@
+package abciproxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+)
+
+// TxHandler answers CheckTx and DeliverTx in the proxy, without
+// reaching the target application. Handlers receive the tx without
+// the prefix they were registered with.
+type TxHandler interface {
+	CheckTx(tx []byte) types.Result
+	DeliverTx(tx []byte) types.Result
+}
+
+// TxHandlerFunc is a TxHandler answering the same way to CheckTx and
+// DeliverTx
+type TxHandlerFunc func(tx []byte) types.Result
+
+func (f TxHandlerFunc) CheckTx(tx []byte) types.Result {
+	return f(tx)
+}
+
+func (f TxHandlerFunc) DeliverTx(tx []byte) types.Result {
+	return f(tx)
+}
+
+// CheckTxOnlyHandler answers CheckTx, and refuses the tx in DeliverTx.
+// It is for handlers answering from the node local state: in DeliverTx,
+// the nodes would not agree on the results of the block.
+type CheckTxOnlyHandler func(tx []byte) types.Result
+
+func (f CheckTxOnlyHandler) CheckTx(tx []byte) types.Result {
+	return f(tx)
+}
+
+func (f CheckTxOnlyHandler) DeliverTx(tx []byte) types.Result {
+	return types.ErrUnauthorized.SetLog("This transaction is only answered by CheckTx")
+}
+
+// EchoTxHandler answers with the tx itself
+var EchoTxHandler = TxHandlerFunc(func(tx []byte) types.Result {
+	return types.NewResultOK(tx, "")
+})
+
+// PingTxHandler answers pong, to check the proxy is alive
+var PingTxHandler = TxHandlerFunc(func(tx []byte) types.Result {
+	return types.NewResultOK([]byte("pong"), "")
+})
+
+type txRoute struct {
+	prefix  []byte
+	handler TxHandler
+}
+
+// txRouter dispatches txs to the handler with the longest matching
+// prefix
+type txRouter struct {
+	mtx    sync.RWMutex
+	routes []txRoute
+}
+
+func (r *txRouter) register(prefix []byte, handler TxHandler) error {
+	if len(prefix) == 0 {
+		return fmt.Errorf("Transaction handler prefix cannot be empty")
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, route := range r.routes {
+		if bytes.Equal(route.prefix, prefix) {
+			return fmt.Errorf("A transaction handler is already registered for prefix %q", prefix)
+		}
+	}
+	r.routes = append(r.routes, txRoute{
+		prefix:  append([]byte{}, prefix...),
+		handler: handler,
+	})
+	return nil
+}
+
+func (r *txRouter) route(tx []byte) (TxHandler, []byte, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	var best *txRoute
+	for i, route := range r.routes {
+		if bytes.HasPrefix(tx, route.prefix) == false {
+			continue
+		}
+		if best == nil || len(route.prefix) > len(best.prefix) {
+			best = &r.routes[i]
+		}
+	}
+	if best == nil {
+		return nil, nil, false
+	}
+	return best.handler, tx[len(best.prefix):], true
+}
+
+// RegisterTxHandler makes the proxy answer all CheckTx and DeliverTx
+// starting with prefix using handler. The target application never
+// sees these txs.
+func (app *ProxyApplication) RegisterTxHandler(prefix []byte, handler TxHandler) error {
+	return app.txRouter.register(prefix, handler)
+}
+
+// ControlTxHandler answers read-only queries about the proxy state:
+// "height" and "pending_changes". As the state is the one of the node,
+// they are refused in DeliverTx.
+func (app *ProxyApplication) ControlTxHandler() TxHandler {
+	return CheckTxOnlyHandler(func(tx []byte) types.Result {
+		switch string(tx) {
+		case "height":
+			height, _ := app.knownHeight()
+			return types.NewResultOK([]byte(strconv.FormatUint(height, 10)), "")
+		case "pending_changes":
+			return types.NewResultOK([]byte(strconv.Itoa(len(app.PendingValidatorChanges()))), "")
+		default:
+			return types.ErrUnknownRequest.SetLog(fmt.Sprintf("Unknown proxy control command %q", tx))
+		}
+	})
+}
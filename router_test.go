@@ -0,0 +1,79 @@
+package abciproxy
+
+import (
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type RouterSuite struct {
+	testApplication *TestApplication
+	app             *ProxyApplication
+}
+
+var _ = Suite(&RouterSuite{})
+
+func (s *RouterSuite) SetUpTest(c *C) {
+	s.testApplication = NewTestApplication(false)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.testApplication))
+	c.Assert(s.app.RegisterTxHandler([]byte("proxy/echo:"), EchoTxHandler), IsNil)
+	c.Assert(s.app.RegisterTxHandler([]byte("proxy/ping"), PingTxHandler), IsNil)
+	c.Assert(s.app.RegisterTxHandler([]byte("proxy/"), s.app.ControlTxHandler()), IsNil)
+}
+
+func (s *RouterSuite) TestHandledTxsBypassTheApplication(c *C) {
+	res := s.app.CheckTx([]byte("proxy/echo:hello"))
+	c.Check(res.IsOK(), Equals, true)
+	c.Check([]byte(res.Data), DeepEquals, []byte("hello"))
+
+	res = s.app.DeliverTx([]byte("proxy/echo:world"))
+	c.Check(res.IsOK(), Equals, true)
+	c.Check([]byte(res.Data), DeepEquals, []byte("world"))
+
+	res = s.app.DeliverTx([]byte("proxy/ping"))
+	c.Check([]byte(res.Data), DeepEquals, []byte("pong"))
+
+	c.Check(s.testApplication.CheckTxCalls.Calls, HasLen, 0)
+	c.Check(s.testApplication.DeliverTxCalls.Calls, HasLen, 0)
+
+	s.app.DeliverTx([]byte("hello"))
+	s.app.CheckTx([]byte("proxy"))
+	c.Check(s.testApplication.DeliverTxCalls.Calls, HasLen, 1)
+	c.Check(s.testApplication.CheckTxCalls.Calls, HasLen, 1)
+}
+
+func (s *RouterSuite) TestLongestPrefixWins(c *C) {
+	longest := TxHandlerFunc(func(tx []byte) types.Result {
+		return types.NewResultOK([]byte("longest"), "")
+	})
+	c.Assert(s.app.RegisterTxHandler([]byte("proxy/height"), longest), IsNil)
+
+	// "proxy/" also matches, but is the control handler
+	res := s.app.DeliverTx([]byte("proxy/height"))
+	c.Check(res.IsOK(), Equals, true)
+	c.Check([]byte(res.Data), DeepEquals, []byte("longest"))
+
+	res = s.app.CheckTx([]byte("proxy/pending_changes"))
+	c.Check(res.IsOK(), Equals, true)
+	c.Check([]byte(res.Data), DeepEquals, []byte("0"))
+}
+
+func (s *RouterSuite) TestControlTxsAreOnlyAnsweredByCheckTx(c *C) {
+	res := s.app.CheckTx([]byte("proxy/height"))
+	c.Check(res.IsOK(), Equals, true)
+	c.Check([]byte(res.Data), DeepEquals, []byte("0"))
+
+	res = s.app.CheckTx([]byte("proxy/unknown"))
+	c.Check(res.Code, Equals, types.CodeType_UnknownRequest)
+
+	// the answer depends on the node, the block results would not
+	res = s.app.DeliverTx([]byte("proxy/height"))
+	c.Check(res.Code, Equals, types.CodeType_Unauthorized)
+	c.Check(s.testApplication.DeliverTxCalls.Calls, HasLen, 0)
+}
+
+func (s *RouterSuite) TestCannotRegisterTwice(c *C) {
+	c.Check(s.app.RegisterTxHandler([]byte("proxy/ping"), EchoTxHandler), ErrorMatches, "A transaction handler is already registered for prefix \"proxy/ping\"")
+	c.Check(s.app.RegisterTxHandler(nil, EchoTxHandler), ErrorMatches, "Transaction handler prefix cannot be empty")
+}
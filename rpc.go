@@ -1,11 +1,17 @@
 package abciproxy
 
 import (
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/tendermint/abci/types"
 	"github.com/tendermint/go-crypto"
 	"github.com/tendermint/tendermint/rpc/lib/server"
+	"github.com/tendermint/tendermint/rpc/lib/types"
+	"github.com/tendermint/tmlibs/events"
 )
 
 type CurrentHeightResult struct {
@@ -13,35 +19,549 @@ type CurrentHeightResult struct {
 }
 
 type ChangeValidatorsResult struct {
+	ID              uint64 `json:"id"`
+	Key             string `json:"key,omitempty"`
+	RequestedHeight uint64 `json:"requested_height"`
+	ScheduledHeight uint64 `json:"scheduled_height"`
 }
 
+type ValidatorChangeStatusResult struct {
+	ID              uint64                  `json:"id"`
+	Key             string                  `json:"key,omitempty"`
+	Validators      []*ValidatorPowerChange `json:"validators"`
+	ScheduledHeight uint64                  `json:"scheduled_height"`
+	Status          ChangeStatus            `json:"status"`
+	Height          uint64                  `json:"height,omitempty"`
+}
+
+// ValidatorPowerChange is a validator and its voting power. Validators
+// can be given by their registered name instead of their public key.
+// Op tells how Power applies to the current voting power, set if empty.
 type ValidatorPowerChange struct {
+	Name   string        `json:"name,omitempty"`
 	PubKey crypto.PubKey `json:"pub_key"`
 	Power  uint64        `json:"power"`
+	Op     PowerOp       `json:"op,omitempty"`
+}
+
+type VersionResult struct {
+	Version string `json:"version"`
+}
+
+type InfoResult struct {
+	Proxy ProxyInfo      `json:"proxy"`
+	App   *AppInfoResult `json:"app"`
+	Error string         `json:"error,omitempty"`
+}
+
+type AppInfoResult struct {
+	Data             string `json:"data"`
+	Version          string `json:"version"`
+	LastBlockHeight  uint64 `json:"last_block_height"`
+	LastBlockAppHash string `json:"last_block_app_hash"`
+}
+
+type ValidatorsResult struct {
+	Validators []*ValidatorPowerChange `json:"validators"`
+}
+
+type ScheduledValidatorChange struct {
+	ScheduledHeight uint64                  `json:"scheduled_height"`
+	Validators      []*ValidatorPowerChange `json:"validators"`
+}
+
+type PendingChangesResult struct {
+	Changes []*ScheduledValidatorChange `json:"changes"`
+}
+
+type ValidatorChangeProposalResult struct {
+	ID              uint64                  `json:"id"`
+	ScheduledHeight uint64                  `json:"scheduled_height"`
+	Validators      []*ValidatorPowerChange `json:"validators"`
+	Deadline        time.Time               `json:"deadline"`
+	Status          ProposalStatus          `json:"status"`
+	Signers         []string                `json:"signers"`
+	SignBytes       string                  `json:"sign_bytes"`
+	RejectBytes     string                  `json:"reject_bytes"`
+}
+
+type ListValidatorChangesResult struct {
+	Proposals []*ValidatorChangeProposalResult `json:"proposals"`
+}
+
+type GovernanceProposalResult struct {
+	Hash            string                  `json:"hash"`
+	ScheduledHeight uint64                  `json:"scheduled_height"`
+	Validators      []*ValidatorPowerChange `json:"validators"`
+	Status          ProposalStatus          `json:"status"`
+	Voters          []string                `json:"voters"`
+}
+
+type ListGovernanceProposalsResult struct {
+	Proposals []*GovernanceProposalResult `json:"proposals"`
+}
+
+type GovernanceSignBytesResult struct {
+	Hash      string `json:"hash"`
+	SignBytes string `json:"sign_bytes"`
+}
+
+type SubscribeResult struct{}
+
+// EventResult is sent to the websocket subscribers of an event
+type EventResult struct {
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+type ValidatorKeysResult struct {
+	Keys []*ValidatorKey `json:"keys"`
+}
+
+type ImportValidatorsResult struct {
+	Validators []*ValidatorPowerChange `json:"validators"`
+	// the scheduled change, if any
+	Change *ChangeValidatorsResult `json:"change,omitempty"`
+}
+
+type SimulateValidatorChangeResult struct {
+	ScheduledHeight uint64                  `json:"scheduled_height"`
+	Validators      []*ValidatorPowerChange `json:"validators"`
+	TotalPower      uint64                  `json:"total_power"`
+	PowerChange     uint64                  `json:"power_change"`
+	Warnings        []string                `json:"warnings"`
+}
+
+func (app *ProxyApplication) newValidatorChangeStatusResult(status *ValidatorChangeStatus) (*ValidatorChangeStatusResult, error) {
+	validators, err := app.validatorPowerChanges(status.Validators)
+	if err != nil {
+		return nil, err
+	}
+	setPowerOps(validators, status.Ops)
+	return &ValidatorChangeStatusResult{
+		ID:              status.ID,
+		Key:             status.Key,
+		Validators:      validators,
+		ScheduledHeight: status.ScheduledHeight,
+		Status:          status.Status,
+		Height:          status.Height,
+	}, nil
+}
+
+func toABCIValidators(validators []*ValidatorPowerChange) []*types.Validator {
+	res := make([]*types.Validator, 0, len(validators))
+	for _, vpc := range validators {
+		res = append(res, &types.Validator{
+			PubKey: vpc.PubKey.Bytes(),
+			Power:  vpc.Power,
+		})
+	}
+	return res
+}
+
+func toValidatorPowerChanges(validators []*types.Validator) ([]*ValidatorPowerChange, error) {
+	res := make([]*ValidatorPowerChange, 0, len(validators))
+	for _, v := range validators {
+		pubKey, err := crypto.PubKeyFromBytes(v.PubKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid validator public key %X: %s", v.PubKey, err)
+		}
+		res = append(res, &ValidatorPowerChange{
+			PubKey: pubKey,
+			Power:  v.Power,
+		})
+	}
+	return res, nil
+}
+
+// setPowerOps sets the operations of the relative changes
+func setPowerOps(validators []*ValidatorPowerChange, ops []PowerOp) {
+	if relativeOps(ops) == false {
+		return
+	}
+	for i, v := range validators {
+		v.Op = opAt(ops, i)
+	}
+}
+
+func (app *ProxyApplication) newValidatorsResult(validators []*types.Validator) (*ValidatorsResult, error) {
+	res, err := app.validatorPowerChanges(validators)
+	if err != nil {
+		return nil, err
+	}
+	return &ValidatorsResult{Validators: res}, nil
+}
+
+func (app *ProxyApplication) newPendingChangesResult(changes []ValidatorSetChange) (*PendingChangesResult, error) {
+	res := &PendingChangesResult{
+		Changes: make([]*ScheduledValidatorChange, 0, len(changes)),
+	}
+	for _, c := range changes {
+		validators, err := app.validatorPowerChanges(c.Diffs)
+		if err != nil {
+			return nil, err
+		}
+		setPowerOps(validators, c.Ops)
+		res.Changes = append(res.Changes, &ScheduledValidatorChange{
+			ScheduledHeight: c.ScheduledHeight,
+			Validators:      validators,
+		})
+	}
+	return res, nil
+}
+
+func (app *ProxyApplication) newValidatorChangeProposalResult(p *ValidatorChangeProposal) (*ValidatorChangeProposalResult, error) {
+	validators, err := app.validatorPowerChanges(p.Validators)
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]string, 0, len(p.Signatures))
+	for k := range p.Signatures {
+		signers = append(signers, k)
+	}
+	sort.Strings(signers)
+	return &ValidatorChangeProposalResult{
+		ID:              p.ID,
+		ScheduledHeight: p.ScheduledHeight,
+		Validators:      validators,
+		Deadline:        p.Deadline,
+		Status:          p.Status,
+		Signers:         signers,
+		SignBytes:       hex.EncodeToString(p.SignBytes()),
+		RejectBytes:     hex.EncodeToString(p.RejectBytes()),
+	}, nil
+}
+
+// proposalRPCResult wraps the result of one of the approval workflow
+// call for the RPC.
+func (app *ProxyApplication) proposalRPCResult(p *ValidatorChangeProposal, err error) (*ValidatorChangeProposalResult, error) {
+	if p == nil {
+		return nil, err
+	}
+	res, convErr := app.newValidatorChangeProposalResult(p)
+	if err == nil {
+		err = convErr
+	}
+	return res, err
+}
+
+// fireEvent sends data to the websocket subscribers of event
+func (app *ProxyApplication) fireEvent(event string, data interface{}) {
+	app.evsw.FireEvent(event, data)
+}
+
+// checkDirectChanges returns an error if validator changes cannot be
+// scheduled directly through the RPC
+func (app *ProxyApplication) checkDirectChanges() error {
+	if app.RequiresApproval() == true {
+		return fmt.Errorf("Validator changes require approval, use propose_validator_change")
+	}
+	if app.governance != nil {
+		return fmt.Errorf("Validator changes are decided on-chain in governance mode")
+	}
+	return nil
+}
+
+// cancelRPCResult cancels a scheduled change for the
+// cancel_validator_change RPC method, by key if one is given
+func (app *ProxyApplication) cancelRPCResult(id uint64, key string) (*ValidatorChangeStatusResult, error) {
+	// approved or decided changes cannot be undone by a single operator
+	if err := app.checkDirectChanges(); err != nil {
+		return nil, err
+	}
+	var status *ValidatorChangeStatus
+	var err error
+	if len(key) != 0 {
+		status, err = app.CancelValidatorChangeByKey(key)
+	} else {
+		status, err = app.CancelValidatorChange(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return app.newValidatorChangeStatusResult(status)
+}
+
+// importRPCResult imports validators for the import RPC methods
+func (app *ProxyApplication) importRPCResult(validators []*ImportedValidator, register bool, scheduledHeight uint64) (*ImportValidatorsResult, error) {
+	if scheduledHeight != 0 {
+		if err := app.checkDirectChanges(); err != nil {
+			return nil, err
+		}
+	}
+	status, err := app.ImportValidators(validators, register, scheduledHeight)
+	if err != nil {
+		return nil, err
+	}
+	res := &ImportValidatorsResult{}
+	abciValidators := make([]*types.Validator, 0, len(validators))
+	for _, v := range validators {
+		abciValidators = append(abciValidators, &types.Validator{PubKey: v.PubKey.Bytes(), Power: v.Power})
+	}
+	res.Validators, err = app.validatorPowerChanges(abciValidators)
+	if err != nil {
+		return nil, err
+	}
+	if status != nil {
+		res.Change = &ChangeValidatorsResult{
+			ID:              status.ID,
+			RequestedHeight: status.RequestedHeight,
+			ScheduledHeight: status.ScheduledHeight,
+		}
+	}
+	return res, nil
 }
 
 func (app *ProxyApplication) StartRPCServer(rpcAddress string) {
 
 	var routes = map[string]*rpcserver.RPCFunc{
-		"change_validators": rpcserver.NewRPCFunc(func(validators []*ValidatorPowerChange, scheduledHeight uint64) (*ChangeValidatorsResult, error) {
-			toABCI := make([]*types.Validator, 0, len(validators))
-			for _, vpc := range validators {
-				toABCI = append(toABCI, &types.Validator{
-					PubKey: vpc.PubKey.Bytes(),
-					Power:  vpc.Power,
-				})
+		"change_validators": rpcserver.NewRPCFunc(func(validators []*ValidatorPowerChange, scheduledHeight uint64, key string) (*ChangeValidatorsResult, error) {
+			if err := app.checkDirectChanges(); err != nil {
+				return nil, err
+			}
+			resolved, ops, err := app.resolveValidators(validators)
+			if err != nil {
+				return nil, err
+			}
+			status, err := app.ScheduleKeyedValidatorChange(key, resolved, ops, scheduledHeight)
+			if err != nil {
+				return nil, err
 			}
-			err := app.ChangeValidators(toABCI, scheduledHeight)
-			return &ChangeValidatorsResult{}, err
+			return &ChangeValidatorsResult{
+				ID:              status.ID,
+				Key:             status.Key,
+				RequestedHeight: status.RequestedHeight,
+				ScheduledHeight: status.ScheduledHeight,
+			}, nil
+		}, "validators,scheduled_height,key"),
+		"broadcast_validator_change": rpcserver.NewRPCFunc(func(validators []*ValidatorPowerChange, scheduledHeight uint64, key string) (*BroadcastResult, error) {
+			if err := app.checkDirectChanges(); err != nil {
+				return nil, err
+			}
+			resolved, ops, err := app.resolveValidators(validators)
+			if err != nil {
+				return nil, err
+			}
+			return app.BroadcastValidatorChange(key, resolved, ops, scheduledHeight)
+		}, "validators,scheduled_height,key"),
+		"cancel_validator_change": rpcserver.NewRPCFunc(app.cancelRPCResult, "id,key"),
+		"validator_change_status": rpcserver.NewRPCFunc(func(id uint64) (*ValidatorChangeStatusResult, error) {
+			status, err := app.ValidatorChangeStatus(id)
+			if err != nil {
+				return nil, err
+			}
+			return app.newValidatorChangeStatusResult(status)
+		}, "id"),
+		"simulate_validator_change": rpcserver.NewRPCFunc(func(validators []*ValidatorPowerChange, scheduledHeight uint64) (*SimulateValidatorChangeResult, error) {
+			resolved, ops, err := app.resolveValidators(validators)
+			if err != nil {
+				return nil, err
+			}
+			sim, err := app.SimulateValidatorPowerChanges(resolved, ops, scheduledHeight)
+			if err != nil {
+				return nil, err
+			}
+			resulting, err := app.validatorPowerChanges(sim.Validators)
+			if err != nil {
+				return nil, err
+			}
+			return &SimulateValidatorChangeResult{
+				ScheduledHeight: sim.ScheduledHeight,
+				Validators:      resulting,
+				TotalPower:      sim.TotalPower,
+				PowerChange:     sim.PowerChange,
+				Warnings:        sim.Warnings,
+			}, nil
 		}, "validators,scheduled_height"),
+		"validator_schedule": rpcserver.NewRPCFunc(func(fromHeight, toHeight uint64) (*ValidatorScheduleResult, error) {
+			if _, known := app.knownHeight(); known == false {
+				return nil, fmt.Errorf("The current block height is not known yet, waiting for the handshake with Tendermint")
+			}
+			return app.ValidatorSchedule(fromHeight, toHeight), nil
+		}, "from_height,to_height"),
+		"refuse_validator_height": rpcserver.NewRPCFunc(func(height uint64) (*RefuseValidatorHeightResult, error) {
+			if err := app.checkDirectChanges(); err != nil {
+				return nil, err
+			}
+			return app.RefuseValidatorHeight(height)
+		}, "height"),
+		"broadcast_validator_height_refusal": rpcserver.NewRPCFunc(func(height uint64) (*RefusalBroadcastResult, error) {
+			if err := app.checkDirectChanges(); err != nil {
+				return nil, err
+			}
+			return app.BroadcastValidatorHeightRefusal(height)
+		}, "height"),
+		"peer_check_status": rpcserver.NewRPCFunc(func() (*PeerCheckStatus, error) {
+			return app.PeerCheckStatus(), nil
+		}, ""),
 		"current_height": rpcserver.NewRPCFunc(func() (*CurrentHeightResult, error) {
-			return &CurrentHeightResult{Height: app.lastHeight}, nil
+			height, known := app.knownHeight()
+			if known == false {
+				return nil, fmt.Errorf("The current block height is not known yet, waiting for the handshake with Tendermint")
+			}
+			return &CurrentHeightResult{Height: height}, nil
+		}, ""),
+		"info": rpcserver.NewRPCFunc(func() (*InfoResult, error) {
+			res := &InfoResult{Proxy: app.proxyInfo()}
+			client, release := app.queryClient()
+			info, err := client.InfoSync()
+			release()
+			if err != nil {
+				res.Error = err.Error()
+				return res, nil
+			}
+			res.App = &AppInfoResult{
+				Data:             info.Data,
+				Version:          info.Version,
+				LastBlockHeight:  info.LastBlockHeight,
+				LastBlockAppHash: hex.EncodeToString(info.LastBlockAppHash),
+			}
+			return res, nil
+		}, ""),
+		"shadow_status": rpcserver.NewRPCFunc(func(fromHeight uint64) (*ShadowStatus, error) {
+			res := app.ShadowStatus(fromHeight)
+			if res == nil {
+				return nil, fmt.Errorf("Shadow mode is not enabled")
+			}
+			return res, nil
+		}, "from_height"),
+		"schedule_app_switch": rpcserver.NewRPCFunc(func(address string, height uint64) (*AppSwitch, error) {
+			conns, err := NewSocketConnections(address)
+			if err != nil {
+				return nil, fmt.Errorf("Could not connect to %s: %s", address, err)
+			}
+			if err := app.ScheduleAppSwitch(address, conns, height); err != nil {
+				conns.Stop()
+				return nil, err
+			}
+			return app.AppSwitchStatus(), nil
+		}, "address,height"),
+		"cancel_app_switch": rpcserver.NewRPCFunc(func() (*AppSwitch, error) {
+			if err := app.CancelAppSwitch(); err != nil {
+				return nil, err
+			}
+			return app.AppSwitchStatus(), nil
+		}, ""),
+		"app_switch_status": rpcserver.NewRPCFunc(func() (*AppSwitch, error) {
+			res := app.AppSwitchStatus()
+			if res == nil {
+				return nil, fmt.Errorf("No target application switch was scheduled")
+			}
+			return res, nil
+		}, ""),
+		"propose_validator_change": rpcserver.NewRPCFunc(func(validators []*ValidatorPowerChange, scheduledHeight uint64) (*ValidatorChangeProposalResult, error) {
+			resolved, err := app.resolveAbsoluteValidators(validators)
+			if err != nil {
+				return nil, err
+			}
+			return app.proposalRPCResult(app.ProposeValidatorChange(resolved, scheduledHeight))
+		}, "validators,scheduled_height"),
+		"sign_validator_change": rpcserver.NewRPCFunc(func(id uint64, pubKey crypto.PubKey, signature crypto.Signature) (*ValidatorChangeProposalResult, error) {
+			return app.proposalRPCResult(app.SignValidatorChange(id, pubKey, signature))
+		}, "id,pub_key,signature"),
+		"reject_validator_change": rpcserver.NewRPCFunc(func(id uint64, pubKey crypto.PubKey, signature crypto.Signature) (*ValidatorChangeProposalResult, error) {
+			return app.proposalRPCResult(app.RejectValidatorChange(id, pubKey, signature))
+		}, "id,pub_key,signature"),
+		"list_validator_changes": rpcserver.NewRPCFunc(func() (*ListValidatorChangesResult, error) {
+			res := &ListValidatorChangesResult{}
+			for _, p := range app.ValidatorChangeProposals() {
+				pRes, err := app.newValidatorChangeProposalResult(p)
+				if err != nil {
+					return nil, err
+				}
+				res.Proposals = append(res.Proposals, pRes)
+			}
+			return res, nil
+		}, ""),
+		"list_governance_proposals": rpcserver.NewRPCFunc(func() (*ListGovernanceProposalsResult, error) {
+			res := &ListGovernanceProposalsResult{}
+			for _, p := range app.GovernanceProposals() {
+				validators, err := app.validatorPowerChanges(p.Validators)
+				if err != nil {
+					return nil, err
+				}
+				res.Proposals = append(res.Proposals, &GovernanceProposalResult{
+					Hash:            hex.EncodeToString(p.Hash),
+					ScheduledHeight: p.ScheduledHeight,
+					Validators:      validators,
+					Status:          p.Status,
+					Voters:          p.Voters,
+				})
+			}
+			return res, nil
+		}, ""),
+		"tx_filter_stats": rpcserver.NewRPCFunc(func() (*TxFilterStats, error) {
+			res := app.TxFilterStats()
+			return &res, nil
+		}, ""),
+		"register_validator_key": rpcserver.NewRPCFunc(func(name string, pubKey crypto.PubKey, moniker, contact, nodeAddress string, replace bool) (*ValidatorKey, error) {
+			key := &ValidatorKey{
+				Name:        name,
+				PubKey:      pubKey,
+				Moniker:     moniker,
+				Contact:     contact,
+				NodeAddress: nodeAddress,
+			}
+			if err := app.RegisterValidatorKey(key, replace); err != nil {
+				return nil, err
+			}
+			return key, nil
+		}, "name,pub_key,moniker,contact,node_address,replace"),
+		"remove_validator_key": rpcserver.NewRPCFunc(func(name string) (*ValidatorKeysResult, error) {
+			if err := app.RemoveValidatorKey(name); err != nil {
+				return nil, err
+			}
+			return &ValidatorKeysResult{Keys: app.ValidatorKeys()}, nil
+		}, "name"),
+		"list_validator_keys": rpcserver.NewRPCFunc(func() (*ValidatorKeysResult, error) {
+			return &ValidatorKeysResult{Keys: app.ValidatorKeys()}, nil
 		}, ""),
+		"import_genesis": rpcserver.NewRPCFunc(func(genesis string, register bool, scheduledHeight uint64) (*ImportValidatorsResult, error) {
+			validators, err := ParseGenesisValidators([]byte(genesis))
+			if err != nil {
+				return nil, err
+			}
+			return app.importRPCResult(validators, register, scheduledHeight)
+		}, "genesis,register,scheduled_height"),
+		"import_priv_validator": rpcserver.NewRPCFunc(func(privValidator string, name string, power uint64, register bool, scheduledHeight uint64) (*ImportValidatorsResult, error) {
+			pubKey, err := ParsePrivValidatorKey([]byte(privValidator))
+			if err != nil {
+				return nil, err
+			}
+			validators := []*ImportedValidator{{Name: name, PubKey: pubKey, Power: power}}
+			return app.importRPCResult(validators, register, scheduledHeight)
+		}, "priv_validator,name,power,register,scheduled_height"),
+		"governance_sign_bytes": rpcserver.NewRPCFunc(func(validators []*ValidatorPowerChange, scheduledHeight uint64) (*GovernanceSignBytesResult, error) {
+			toABCI, err := app.resolveAbsoluteValidators(validators)
+			if err != nil {
+				return nil, err
+			}
+			return &GovernanceSignBytesResult{
+				Hash:      hex.EncodeToString(GovernanceProposalHash(toABCI, scheduledHeight)),
+				SignBytes: hex.EncodeToString(GovernanceSignBytes(toABCI, scheduledHeight)),
+			}, nil
+		}, "validators,scheduled_height"),
+	}
+
+	// websocket only
+	routes["subscribe"] = rpcserver.NewWSRPCFunc(func(wsCtx rpctypes.WSRPCContext, event string) (*SubscribeResult, error) {
+		wsCtx.GetEventSwitch().AddListenerForEvent(wsCtx.GetRemoteAddr(), event, func(data events.EventData) {
+			wsCtx.TryWriteRPCResponse(rpctypes.NewRPCResponse(wsCtx.Request.ID+"#event", &EventResult{Name: event, Data: data}, ""))
+		})
+		return &SubscribeResult{}, nil
+	}, "event")
+	routes["unsubscribe"] = rpcserver.NewWSRPCFunc(func(wsCtx rpctypes.WSRPCContext, event string) (*SubscribeResult, error) {
+		wsCtx.GetEventSwitch().RemoveListenerForEvent(event, wsCtx.GetRemoteAddr())
+		return &SubscribeResult{}, nil
+	}, "event")
+
+	if _, err := app.evsw.Start(); err != nil {
+		panic(err)
 	}
 
 	mux := http.NewServeMux()
 	rpcserver.RegisterRPCFuncs(mux, routes, app.logger)
-	wm := rpcserver.NewWebsocketManager(routes, nil)
+	wm := rpcserver.NewWebsocketManager(routes, app.evsw)
 	wm.SetLogger(app.logger)
 	mux.HandleFunc("/websocket/endpoint", wm.WebsocketHandler)
 
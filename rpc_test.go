@@ -62,7 +62,7 @@ func (s *RPCSuite) TestCanFetchCurrentHeight(c *C) {
 	res := new(CurrentHeightResult)
 	_, err := s.cli.Call("current_height", map[string]interface{}{}, res)
 	c.Assert(err, IsNil)
-	c.Check(res.Height, Equals, s.node.proxy.lastHeight)
+	c.Check(res.Height, Equals, s.node.proxy.currentHeight())
 
 }
 
@@ -72,13 +72,13 @@ func (s *RPCSuite) TestCanChangeValidators(c *C) {
 	// change should be in the future
 	res := new(ChangeValidatorsResult)
 	_, err := s.cli.Call("change_validators", map[string]interface{}{
-		"scheduled_height": s.node.proxy.lastHeight - 1,
+		"scheduled_height": s.node.proxy.currentHeight() - 1,
 		"validators":       []*ValidatorPowerChange{},
 	}, res)
 	c.Check(err, ErrorMatches, `Response error: Could not schedule for a block height back in time.*`)
 
 	_, err = s.cli.Call("change_validators", map[string]interface{}{
-		"scheduled_height": s.node.proxy.lastHeight + 5,
+		"scheduled_height": s.node.proxy.currentHeight() + 5,
 		"validators": []*ValidatorPowerChange{
 			&ValidatorPowerChange{
 				PubKey: s.genesisFile.Validators[0].PubKey,
@@ -87,5 +87,69 @@ func (s *RPCSuite) TestCanChangeValidators(c *C) {
 		},
 	}, res)
 	c.Check(err, IsNil)
+	c.Check(res.ID, Not(Equals), uint64(0))
 
+	status := new(ValidatorChangeStatusResult)
+	_, err = s.cli.Call("validator_change_status", map[string]interface{}{
+		"id": res.ID,
+	}, status)
+	c.Check(err, IsNil)
+	c.Check(status.Status, Equals, ChangePending)
+}
+
+func (s *RPCSuite) TestCanChangeValidatorsByName(c *C) {
+	key := new(ValidatorKey)
+	_, err := s.cli.Call("register_validator_key", map[string]interface{}{
+		"name":    "node0",
+		"pub_key": s.genesisFile.Validators[0].PubKey,
+		"moniker": "first node",
+	}, key)
+	c.Assert(err, IsNil)
+	c.Check(key.Moniker, Equals, "first node")
+
+	s.node.testApplication.EndBlockCalls.ExpectCall(1)
+	s.node.testApplication.EndBlockCalls.WaitForExpected()
+	res := new(ChangeValidatorsResult)
+	_, err = s.cli.Call("change_validators", map[string]interface{}{
+		"scheduled_height": s.node.proxy.currentHeight() + 5,
+		"validators": []*ValidatorPowerChange{
+			&ValidatorPowerChange{Name: "node0", Power: 20},
+		},
+	}, res)
+	c.Assert(err, IsNil)
+
+	status := new(ValidatorChangeStatusResult)
+	_, err = s.cli.Call("validator_change_status", map[string]interface{}{
+		"id": res.ID,
+	}, status)
+	c.Assert(err, IsNil)
+	c.Assert(status.Validators, HasLen, 1)
+	c.Check(status.Validators[0].Name, Equals, "node0")
+	c.Check(status.Validators[0].PubKey, Equals, s.genesisFile.Validators[0].PubKey)
+}
+
+func (s *RPCSuite) TestInfoReturnsProxyAndAppMetadata(c *C) {
+	s.node.testApplication.EndBlockCalls.ExpectCall(1)
+	s.node.testApplication.EndBlockCalls.WaitForExpected()
+
+	res := new(InfoResult)
+	_, err := s.cli.Call("info", map[string]interface{}{}, res)
+	c.Assert(err, IsNil)
+	c.Check(res.Proxy.Version, Equals, Version)
+	c.Check(res.Proxy.GoVersion, Not(Equals), "")
+	c.Check(res.Error, Equals, "")
+	c.Assert(res.App, NotNil)
+	c.Check(res.App.Data, Matches, `\{"hashes":[0-9]+,"txs":[0-9]+\}`)
+	c.Check(res.App.LastBlockHeight, Not(Equals), uint64(0))
+
+	// the target app metadata is not wrapped in the RPC result
+	s.node.proxy.EnableInfoMetadata()
+	defer func() { s.node.proxy.infoMetadata = false }()
+	wrapped := new(InfoResult)
+	_, err = s.cli.Call("info", map[string]interface{}{}, wrapped)
+	c.Assert(err, IsNil)
+	c.Check(wrapped.Proxy.Version, Equals, Version)
+	c.Assert(wrapped.App, NotNil)
+	c.Check(wrapped.App.Data, Matches, `\{"hashes":[0-9]+,"txs":[0-9]+\}`)
+	c.Check(s.node.proxy.Info().Data, Matches, `\{"data":.*,"proxy":\{.*\}\}`)
 }
@@ -0,0 +1,223 @@
+package abciproxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	tmlog "github.com/tendermint/tmlibs/log"
+)
+
+// size of the queue of calls waiting to be mirrored
+const shadowQueueSize = 4096
+
+// number of heights for which we keep the divergences
+const shadowHistory = 1000
+
+// ShadowDivergence is a difference between the primary and the shadow
+// application
+type ShadowDivergence struct {
+	Height uint64 `json:"height"`
+	// "deliver_tx" or "commit"
+	Kind string `json:"kind"`
+	// index of the tx in the block for deliver_tx
+	TxIndex int    `json:"tx_index"`
+	Primary string `json:"primary"`
+	Shadow  string `json:"shadow"`
+}
+
+// ShadowStatus summarizes the comparison of the primary and shadow
+// applications
+type ShadowStatus struct {
+	// false if the shadow could not keep up, and has been dropped
+	Running          bool                `json:"running"`
+	Height           uint64              `json:"height"`
+	ComparedTxs      uint64              `json:"compared_txs"`
+	ComparedCommits  uint64              `json:"compared_commits"`
+	DivergentTxs     uint64              `json:"divergent_txs"`
+	DivergentCommits uint64              `json:"divergent_commits"`
+	Divergences      []*ShadowDivergence `json:"divergences"`
+}
+
+// shadow mirrors all the consensus calls to a second application, and
+// compares its results with the primary ones. It never affects the
+// responses sent to tendermint.
+type shadow struct {
+	client abcicli.Client
+	logger tmlog.Logger
+	calls  chan func()
+
+	mtx     sync.Mutex
+	status  ShadowStatus
+	txIndex int
+	// divergences indexed by height
+	divergences map[uint64][]*ShadowDivergence
+}
+
+// EnableShadow mirrors every consensus call to client, and compares
+// its DeliverTx results and Commit hashes with the target application
+// ones.
+func (app *ProxyApplication) EnableShadow(client abcicli.Client) {
+	s := &shadow{
+		client:      client,
+		logger:      app.logger.With("module", "shadow"),
+		calls:       make(chan func(), shadowQueueSize),
+		divergences: make(map[uint64][]*ShadowDivergence),
+	}
+	s.status.Running = true
+	go s.run()
+	app.shadow = s
+}
+
+func (s *shadow) run() {
+	for call := range s.calls {
+		call()
+	}
+}
+
+// enqueue schedules call without ever blocking. If the shadow cannot
+// keep up it is dropped, as its state would be wrong.
+func (s *shadow) enqueue(call func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.status.Running == false {
+		return
+	}
+	select {
+	case s.calls <- call:
+	default:
+		s.logger.Error("shadow application is too slow, stop mirroring")
+		s.status.Running = false
+		close(s.calls)
+	}
+}
+
+// wait returns true once all the calls enqueued so far are mirrored,
+// or mirroring stopped, and false if it takes more than timeout
+func (s *shadow) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	s.enqueue(func() {
+		close(done)
+	})
+	s.mtx.Lock()
+	running := s.status.Running
+	s.mtx.Unlock()
+	if running == false {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *shadow) diverge(d *ShadowDivergence) {
+	s.logger.Error("shadow application diverged",
+		"height", d.Height,
+		"kind", d.Kind,
+		"txIndex", d.TxIndex,
+		"primary", d.Primary,
+		"shadow", d.Shadow)
+	s.divergences[d.Height] = append(s.divergences[d.Height], d)
+	for h := range s.divergences {
+		if h+shadowHistory < d.Height {
+			delete(s.divergences, h)
+		}
+	}
+}
+
+func describeResult(res types.Result) string {
+	return fmt.Sprintf("code:%d data:%X log:%s", res.Code, []byte(res.Data), res.Log)
+}
+
+func (s *shadow) initChain(validators []*types.Validator) {
+	s.enqueue(func() {
+		_ = s.client.InitChainSync(validators)
+	})
+}
+
+func (s *shadow) beginBlock(hash []byte, header *types.Header) {
+	s.enqueue(func() {
+		_ = s.client.BeginBlockSync(hash, header)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if header != nil {
+			s.status.Height = header.Height
+		}
+		s.txIndex = 0
+	})
+}
+
+func (s *shadow) deliverTx(tx []byte, primary types.Result) {
+	s.enqueue(func() {
+		res := s.client.DeliverTxSync(tx)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.status.ComparedTxs++
+		if res.Code != primary.Code || bytes.Equal(res.Data, primary.Data) == false {
+			s.status.DivergentTxs++
+			s.diverge(&ShadowDivergence{
+				Height:  s.status.Height,
+				Kind:    "deliver_tx",
+				TxIndex: s.txIndex,
+				Primary: describeResult(primary),
+				Shadow:  describeResult(res),
+			})
+		}
+		s.txIndex++
+	})
+}
+
+func (s *shadow) endBlock(height uint64) {
+	s.enqueue(func() {
+		_, _ = s.client.EndBlockSync(height)
+	})
+}
+
+func (s *shadow) commit(primary types.Result) {
+	s.enqueue(func() {
+		res := s.client.CommitSync()
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.status.ComparedCommits++
+		if res.Code != primary.Code || bytes.Equal(res.Data, primary.Data) == false {
+			s.status.DivergentCommits++
+			s.diverge(&ShadowDivergence{
+				Height:  s.status.Height,
+				Kind:    "commit",
+				Primary: describeResult(primary),
+				Shadow:  describeResult(res),
+			})
+		}
+	})
+}
+
+// ShadowStatus returns the comparison counters and the divergences
+// since fromHeight. It returns nil if shadow mode is disabled.
+func (app *ProxyApplication) ShadowStatus(fromHeight uint64) *ShadowStatus {
+	if app.shadow == nil {
+		return nil
+	}
+	s := app.shadow
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	res := s.status
+	heights := make([]uint64, 0, len(s.divergences))
+	for h := range s.divergences {
+		if h >= fromHeight {
+			heights = append(heights, h)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	res.Divergences = nil
+	for _, h := range heights {
+		res.Divergences = append(res.Divergences, s.divergences[h]...)
+	}
+	return &res
+}
@@ -0,0 +1,58 @@
+package abciproxy
+
+import (
+	"time"
+
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+
+	. "gopkg.in/check.v1"
+)
+
+type ShadowSuite struct {
+	primary, shadow *TestApplication
+	app             *ProxyApplication
+}
+
+var _ = Suite(&ShadowSuite{})
+
+func (s *ShadowSuite) SetUpTest(c *C) {
+	s.primary = NewTestApplication(false)
+	// the shadow only accepts serial txs, so it will diverge
+	s.shadow = NewTestApplication(true)
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, s.primary))
+	s.app.EnableShadow(abcicli.NewLocalClient(nil, s.shadow))
+}
+
+func (s *ShadowSuite) TestDivergencesAreReported(c *C) {
+	s.app.BeginBlock(nil, &types.Header{Height: 1})
+	c.Check(s.app.DeliverTx([]byte{0x00}).IsOK(), Equals, true)
+	s.app.EndBlock(1)
+	s.app.Commit()
+
+	s.app.BeginBlock(nil, &types.Header{Height: 2})
+	c.Check(s.app.DeliverTx([]byte{0x01}).IsOK(), Equals, true)
+	// not the expected nonce for the shadow
+	c.Check(s.app.DeliverTx([]byte{0x05}).IsOK(), Equals, true)
+	s.app.EndBlock(2)
+	s.app.Commit()
+
+	// the comparisons are made after the shadow calls return
+	c.Assert(s.app.shadow.wait(10*time.Second), Equals, true)
+
+	status := s.app.ShadowStatus(0)
+	c.Assert(status, NotNil)
+	c.Check(status.Running, Equals, true)
+	c.Check(status.Height, Equals, uint64(2))
+	c.Check(status.ComparedTxs, Equals, uint64(3))
+	c.Check(status.ComparedCommits, Equals, uint64(2))
+	c.Check(status.DivergentTxs, Equals, uint64(1))
+	c.Check(status.DivergentCommits, Equals, uint64(1))
+	c.Assert(status.Divergences, HasLen, 2)
+	c.Check(status.Divergences[0].Kind, Equals, "deliver_tx")
+	c.Check(status.Divergences[0].Height, Equals, uint64(2))
+	c.Check(status.Divergences[0].TxIndex, Equals, 1)
+	c.Check(status.Divergences[1].Kind, Equals, "commit")
+
+	c.Check(s.app.ShadowStatus(3).Divergences, HasLen, 0)
+}
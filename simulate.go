@@ -0,0 +1,100 @@
+package abciproxy
+
+import (
+	"fmt"
+
+	"github.com/tendermint/abci/types"
+)
+
+// ValidatorChangeSimulation is the validator set which would result
+// from a validator change, once all the changes pending up to its
+// height are applied.
+type ValidatorChangeSimulation struct {
+	// height the change would be scheduled at, after the minimum lead
+	// is applied
+	ScheduledHeight uint64
+	Validators      []*types.Validator
+	TotalPower      uint64
+	// voting power moved by the change, compared to the set right
+	// before it
+	PowerChange uint64
+	Warnings    []string
+}
+
+func powerDifference(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// SimulateValidatorChange computes the effect of scheduling
+// newValidators at targetHeight, without scheduling anything. As for
+// a scheduled change, the height is moved according to the minimum
+// lead.
+func (app *ProxyApplication) SimulateValidatorChange(newValidators []*types.Validator, targetHeight uint64) (*ValidatorChangeSimulation, error) {
+	return app.SimulateValidatorPowerChanges(newValidators, nil, targetHeight)
+}
+
+// projectedValidators returns the validator set once the changes
+// pending up to height are applied
+func (app *ProxyApplication) projectedValidators(height uint64) *validatorSet {
+	vs := newValidatorSet()
+	vs.reset(app.Validators())
+	// diffs are emitted in the EndBlock of their height, in order
+	for _, c := range app.PendingValidatorChanges() {
+		if c.ScheduledHeight > height {
+			break
+		}
+		diffs, err := resolveDiffs(vs, c.Diffs, c.Ops)
+		if err != nil {
+			// a change of this height will fail, which only
+			// EndBlock can tell: approximate by skipping the height
+			continue
+		}
+		vs.apply(diffs)
+	}
+	return vs
+}
+
+// SimulateValidatorPowerChanges is SimulateValidatorChange with an
+// operation for each validator, see ScheduleValidatorPowerChanges.
+func (app *ProxyApplication) SimulateValidatorPowerChanges(newValidators []*types.Validator, ops []PowerOp, targetHeight uint64) (*ValidatorChangeSimulation, error) {
+	if err := app.checkScheduledHeight(targetHeight); err != nil {
+		return nil, err
+	}
+	scheduledHeight, err := app.effectiveHeight(targetHeight)
+	if err != nil {
+		return nil, err
+	}
+	res := &ValidatorChangeSimulation{ScheduledHeight: scheduledHeight}
+
+	if len(app.Validators()) == 0 {
+		res.Warnings = append(res.Warnings, "the current validator set is unknown or empty, it is only tracked from InitChain")
+	}
+	vs := app.projectedValidators(scheduledHeight)
+	resolved, err := resolveDiffs(vs, newValidators, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	before := vs.totalPower()
+	for _, v := range resolved {
+		old := vs.power(v.PubKey)
+		if v.Power == 0 && old == 0 {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("validator %X is removed but is not in the set", v.PubKey))
+		}
+		res.PowerChange += powerDifference(old, v.Power)
+	}
+	vs.apply(resolved)
+
+	res.Validators = vs.list()
+	res.TotalPower = vs.totalPower()
+	if 3*res.PowerChange > before {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("the change moves %d of the %d voting power, more than 1/3", res.PowerChange, before))
+	}
+	if res.TotalPower == 0 {
+		res.Warnings = append(res.Warnings, "the resulting validator set has no voting power")
+	}
+	return res, nil
+}
@@ -0,0 +1,102 @@
+package abciproxy
+
+import (
+	abcicli "github.com/tendermint/abci/client"
+	"github.com/tendermint/abci/types"
+	"github.com/tendermint/go-crypto"
+
+	. "gopkg.in/check.v1"
+)
+
+type SimulateSuite struct {
+	app     *ProxyApplication
+	genesis []*types.Validator
+}
+
+var _ = Suite(&SimulateSuite{})
+
+func (s *SimulateSuite) SetUpTest(c *C) {
+	s.app = NewProxyApp(abcicli.NewLocalClient(nil, NewTestApplication(false)))
+	s.genesis = nil
+	for i := 0; i < 3; i++ {
+		s.genesis = append(s.genesis, &types.Validator{
+			PubKey: crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes(),
+			Power:  10,
+		})
+	}
+	s.app.InitChain(s.genesis)
+	s.app.EndBlock(1)
+}
+
+func (s *SimulateSuite) TestAppliesPendingChanges(c *C) {
+	c.Assert(s.app.ChangeValidators([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[0].PubKey, Power: 15},
+	}, 3), IsNil)
+
+	sim, err := s.app.SimulateValidatorChange([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[1].PubKey, Power: 12},
+	}, 4)
+	c.Assert(err, IsNil)
+	c.Check(sim.Validators, HasLen, 3)
+	c.Check(sim.TotalPower, Equals, uint64(37))
+	c.Check(sim.PowerChange, Equals, uint64(2))
+	c.Check(sim.Warnings, HasLen, 0)
+
+	// changes pending at the same height are applied first
+	sim, err = s.app.SimulateValidatorChange([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[1].PubKey, Power: 12},
+	}, 3)
+	c.Assert(err, IsNil)
+	c.Check(sim.TotalPower, Equals, uint64(37))
+
+	// nothing was scheduled
+	pending := s.app.PendingValidatorChanges()
+	c.Assert(pending, HasLen, 1)
+	c.Check(pending[0].ScheduledHeight, Equals, uint64(3))
+}
+
+func (s *SimulateSuite) TestRespectsTheMinimumLead(c *C) {
+	s.app.SetMinimumLead(3, true)
+	c.Assert(s.app.ChangeValidators([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[0].PubKey, Power: 15},
+	}, 4), IsNil)
+
+	// moved to height 4, after the pending change
+	sim, err := s.app.SimulateValidatorChange([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[1].PubKey, Power: 12},
+	}, 2)
+	c.Assert(err, IsNil)
+	c.Check(sim.ScheduledHeight, Equals, uint64(4))
+	c.Check(sim.TotalPower, Equals, uint64(37))
+
+	s.app.SetMinimumLead(3, false)
+	_, err = s.app.SimulateValidatorChange(nil, 2)
+	c.Check(err, ErrorMatches, "Validator changes must be scheduled at least 3 blocks ahead.*")
+}
+
+func (s *SimulateSuite) TestWarnings(c *C) {
+	sim, err := s.app.SimulateValidatorChange([]*types.Validator{
+		&types.Validator{PubKey: s.genesis[0].PubKey, Power: 0},
+		&types.Validator{PubKey: s.genesis[1].PubKey, Power: 0},
+		&types.Validator{PubKey: s.genesis[2].PubKey, Power: 0},
+	}, 2)
+	c.Assert(err, IsNil)
+	c.Check(sim.Validators, HasLen, 0)
+	c.Check(sim.Warnings, DeepEquals, []string{
+		"the change moves 30 of the 30 voting power, more than 1/3",
+		"the resulting validator set has no voting power",
+	})
+
+	unknown := crypto.GenPrivKeyEd25519().Wrap().PubKey().Bytes()
+	sim, err = s.app.SimulateValidatorChange([]*types.Validator{
+		&types.Validator{PubKey: unknown, Power: 0},
+	}, 2)
+	c.Assert(err, IsNil)
+	c.Check(sim.Warnings, HasLen, 1)
+	c.Check(sim.Warnings[0], Matches, "validator .* is removed but is not in the set")
+}
+
+func (s *SimulateSuite) TestCannotSimulateInThePast(c *C) {
+	_, err := s.app.SimulateValidatorChange(nil, 1)
+	c.Check(err, ErrorMatches, "Could not schedule for a block height back in time.*")
+}
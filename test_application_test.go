@@ -17,12 +17,18 @@ type TestApplication struct {
 	txCount   int
 	serial    bool
 
+	// height of the current block, and last committed block
+	height           uint64
+	lastBlockHeight  uint64
+	lastBlockAppHash []byte
+
 	InfoCalls      InterceptedMethod
 	CommitCalls    InterceptedMethod
 	SetOptionCalls InterceptedMethod
 	DeliverTxCalls InterceptedMethod
 	CheckTxCalls   InterceptedMethod
 	QueryCalls     InterceptedMethod
+	InitChainCalls InterceptedMethod
 	EndBlockCalls  InterceptedMethod
 }
 
@@ -35,13 +41,18 @@ func NewTestApplication(serial bool) *TestApplication {
 		DeliverTxCalls: NewInterceptedMethod("DeliverTx"),
 		CheckTxCalls:   NewInterceptedMethod("CheckTx"),
 		QueryCalls:     NewInterceptedMethod("Query"),
+		InitChainCalls: NewInterceptedMethod("InitChain"),
 		EndBlockCalls:  NewInterceptedMethod("EndBlock"),
 	}
 }
 
 func (app *TestApplication) Info() types.ResponseInfo {
 	app.InfoCalls.Notify()
-	return types.ResponseInfo{Data: cmn.Fmt("{\"hashes\":%v,\"txs\":%v}", app.hashCount, app.txCount)}
+	return types.ResponseInfo{
+		Data:             cmn.Fmt("{\"hashes\":%v,\"txs\":%v}", app.hashCount, app.txCount),
+		LastBlockHeight:  app.lastBlockHeight,
+		LastBlockAppHash: app.lastBlockAppHash,
+	}
 }
 
 func (app *TestApplication) SetOption(key string, value string) (log string) {
@@ -70,6 +81,7 @@ func (app *TestApplication) DeliverTx(tx []byte) types.Result {
 }
 
 func (app *TestApplication) CheckTx(tx []byte) types.Result {
+	app.CheckTxCalls.Notify(tx)
 	if app.serial {
 		if len(tx) > 8 {
 			return types.ErrEncodingError.SetLog(cmn.Fmt("Max tx size is 8 bytes, got %d", len(tx)))
@@ -87,11 +99,14 @@ func (app *TestApplication) CheckTx(tx []byte) types.Result {
 func (app *TestApplication) Commit() types.Result {
 	app.CommitCalls.Notify()
 	app.hashCount++
+	app.lastBlockHeight = app.height
 	if app.txCount == 0 {
+		app.lastBlockAppHash = nil
 		return types.OK
 	}
 	hash := make([]byte, 8)
 	binary.BigEndian.PutUint64(hash, uint64(app.txCount))
+	app.lastBlockAppHash = hash
 	return types.NewResultOK(hash, "")
 }
 
@@ -107,7 +122,12 @@ func (app *TestApplication) Query(reqQuery types.RequestQuery) types.ResponseQue
 	}
 }
 
+func (app *TestApplication) InitChain(validators []*types.Validator) {
+	app.InitChainCalls.Notify(validators)
+}
+
 func (app *TestApplication) EndBlock(height uint64) (resEndBlock types.ResponseEndBlock) {
 	app.EndBlockCalls.Notify(height)
+	app.height = height
 	return types.ResponseEndBlock{}
 }
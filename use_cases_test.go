@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	abcitypes "github.com/tendermint/abci/types"
@@ -264,3 +265,90 @@ func (s *UseCaseSuite) TestCanMakeObserverAValidator(c *C) {
 	}
 
 }
+
+func (s *UseCaseSuite) TestReplaysValidatorDiffsAfterRestart(c *C) {
+	n := s.nodes[0]
+	n.testApplication.EndBlockCalls.ExpectCall(5)
+
+	s.StartNodes(c)
+
+	validators := make([]*abcitypes.Validator, 0, len(s.nodes))
+	for _, g := range s.genesisFiles {
+		validators = append(validators, &abcitypes.Validator{
+			PubKey: g.Validators[0].PubKey.Bytes(),
+			Power:  10,
+		})
+	}
+
+	n.testApplication.EndBlockCalls.WaitForExpected()
+	for _, node := range s.nodes {
+		c.Assert(node.proxy.ChangeValidators(validators, 8), IsNil)
+	}
+	n.testApplication.EndBlockCalls.ExpectCall(5)
+	n.testApplication.EndBlockCalls.WaitForExpected()
+
+	// restart the node with an application which lost its state, so
+	// tendermint replays all the blocks through the new proxy
+	c.Assert(n.Stop(), IsNil)
+	n.testApplication = NewTestApplication(false)
+	n.testApplication.EndBlockCalls.ExpectCall(12)
+	c.Assert(n.Start(s.nodes), IsNil)
+	n.testApplication.EndBlockCalls.WaitForExpected()
+
+	c.Check(strings.Contains(n.proxyOutput.String(), "re-emitting validator diffs of a replayed block"), Equals, true,
+		Commentf("---proxy output---\n%s", n.proxyOutput.String()))
+
+	client := rpc.NewJSONRPCClient(fmt.Sprintf("http://localhost:%d", n.RPCPort()))
+	res := new(rpctypes.ResultValidators)
+	_, err := client.Call("validators", map[string]interface{}{}, res)
+	c.Assert(err, IsNil)
+	c.Check(res.Validators, HasLen, TotalTestNode)
+	for _, v := range res.Validators {
+		c.Check(v.VotingPower, Equals, int64(10))
+	}
+}
+
+func (s *UseCaseSuite) TestGenesisConfigStartsWithObservers(c *C) {
+	// all nodes are genesis validators, but the proxies start the
+	// chain with the last one as an observer
+	c.Assert(s.SetUpGenesis(s.nodes, nil), IsNil)
+	observerKey := s.genesisFiles[TotalTestNode-1].Validators[0].PubKey
+	cfg := &GenesisConfig{Mode: GenesisOverride}
+	for _, g := range s.genesisFiles {
+		power := uint64(10)
+		if g.Validators[0].PubKey == observerKey {
+			power = 0
+		}
+		cfg.Validators = append(cfg.Validators, &ValidatorPowerChange{
+			PubKey: g.Validators[0].PubKey,
+			Power:  power,
+		})
+	}
+	for _, n := range s.nodes {
+		n.genesisConfig = cfg
+		n.testApplication.EndBlockCalls.ExpectCall(4)
+	}
+
+	s.StartNodes(c)
+
+	for _, n := range s.nodes {
+		n.testApplication.EndBlockCalls.WaitForExpected()
+
+		// the target application got the initial set
+		c.Assert(n.testApplication.InitChainCalls.Calls, HasLen, 1)
+		initial := n.testApplication.InitChainCalls.Calls[0][0].([]*abcitypes.Validator)
+		c.Check(initial, HasLen, TotalTestNode-1)
+
+		client := rpc.NewJSONRPCClient(fmt.Sprintf("http://localhost:%d", n.RPCPort()))
+		res := new(rpctypes.ResultValidators)
+		_, err := client.Call("validators", map[string]interface{}{}, res)
+		if c.Check(err, IsNil) == false {
+			continue
+		}
+		c.Check(res.Validators, HasLen, TotalTestNode-1)
+		for _, v := range res.Validators {
+			c.Check(v.PubKey, Not(Equals), observerKey)
+			c.Check(v.VotingPower, Equals, int64(10))
+		}
+	}
+}
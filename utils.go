@@ -3,8 +3,6 @@ package abciproxy
 import (
 	"fmt"
 	"runtime"
-
-	tmlog "github.com/tendermint/tmlibs/log"
 )
 
 func CallerName() string {
@@ -16,10 +14,6 @@ func CallerName() string {
 	return fun.Name()
 }
 
-func LogCall(logger tmlog.Logger, keyvals ...interface{}) {
-	logger.Debug(CallerName(), keyvals...)
-}
-
 func NotYetImplemented() error {
 	return fmt.Errorf("%s is not et implemented", CallerName())
 }
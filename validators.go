@@ -0,0 +1,107 @@
+package abciproxy
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/tendermint/abci/types"
+)
+
+// validatorSet tracks the validator set as seen by tendermint: the
+// genesis one given to InitChain, updated by all the diffs we emitted
+// in EndBlock.
+type validatorSet struct {
+	mtx sync.RWMutex
+	// voting power indexed by hex encoded public key
+	powers map[string]uint64
+}
+
+func newValidatorSet() *validatorSet {
+	return &validatorSet{
+		powers: make(map[string]uint64),
+	}
+}
+
+func (vs *validatorSet) reset(validators []*types.Validator) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+	vs.powers = make(map[string]uint64, len(validators))
+	vs.applyUnsafe(validators)
+}
+
+func (vs *validatorSet) apply(diffs []*types.Validator) {
+	vs.mtx.Lock()
+	defer vs.mtx.Unlock()
+	vs.applyUnsafe(diffs)
+}
+
+func (vs *validatorSet) applyUnsafe(diffs []*types.Validator) {
+	for _, v := range diffs {
+		key := hex.EncodeToString(v.PubKey)
+		if v.Power == 0 {
+			delete(vs.powers, key)
+			continue
+		}
+		vs.powers[key] = v.Power
+	}
+}
+
+// power returns the voting power of pubKey, 0 if not a validator
+func (vs *validatorSet) power(pubKey []byte) uint64 {
+	vs.mtx.RLock()
+	defer vs.mtx.RUnlock()
+	return vs.powers[hex.EncodeToString(pubKey)]
+}
+
+func (vs *validatorSet) totalPower() uint64 {
+	vs.mtx.RLock()
+	defer vs.mtx.RUnlock()
+	var res uint64
+	for _, p := range vs.powers {
+		res += p
+	}
+	return res
+}
+
+// list returns the validators ordered by public key
+func (vs *validatorSet) list() []*types.Validator {
+	vs.mtx.RLock()
+	defer vs.mtx.RUnlock()
+	keys := make([]string, 0, len(vs.powers))
+	for k := range vs.powers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]*types.Validator, 0, len(keys))
+	for _, k := range keys {
+		// keys are always valid hex
+		pubKey, _ := hex.DecodeString(k)
+		res = append(res, &types.Validator{
+			PubKey: pubKey,
+			Power:  vs.powers[k],
+		})
+	}
+	return res
+}
+
+// Validators returns the current validator set, as known by the
+// proxy. It is only accurate if the proxy saw InitChain.
+func (app *ProxyApplication) Validators() []*types.Validator {
+	return app.validators.list()
+}
+
+// PendingValidatorChanges returns the validator changes scheduled for
+// future heights, ordered by height
+func (app *ProxyApplication) PendingValidatorChanges() []ValidatorSetChange {
+	app.mtx.Lock()
+	defer app.mtx.Unlock()
+	res := make([]ValidatorSetChange, 0, len(app.diffs))
+	for _, c := range app.diffs {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ScheduledHeight < res[j].ScheduledHeight
+	})
+	return res
+}
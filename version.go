@@ -0,0 +1,25 @@
+package abciproxy
+
+import "runtime"
+
+// Version of the proxy
+const Version = "0.1.0"
+
+// GitCommit is set at build time with
+// -ldflags "-X github.com/MultiverseHQ/abci_proxy.GitCommit=<commit>"
+var GitCommit = ""
+
+// BuildInfo describes the running proxy
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	GoVersion string `json:"go_version"`
+}
+
+func NewBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		GoVersion: runtime.Version(),
+	}
+}